@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"onyx/internal/api"
+
+	"github.com/spf13/cobra"
+)
+
+var changesCmd = &cobra.Command{
+	Use:   "changes",
+	Short: "Review destructive actions waiting for a second owner's approval",
+	Long: `When two-person approval is enabled on an engine ('onyx approvals enable'), revoking a
+console, rotating the CA, removing a site or inviting an owner through the control plane only
+proposes the change.
+A different owner then approves or rejects it here before it expires. Requires the owner role.`,
+}
+
+var changesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the changes waiting for approval",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		list, err := client.ListChanges()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if list.Policy.Enabled {
+			fmt.Printf("Two-person approval is enabled on %s; proposals expire after %s.\n\n", node.Name, list.Policy.Window)
+		} else {
+			fmt.Printf("Two-person approval is disabled on %s.\n\n", node.Name)
+		}
+		if len(list.Changes) == 0 {
+			fmt.Println("No changes are waiting for approval.")
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tACTION\tTARGET\tPROPOSED BY\tPROPOSED\tEXPIRES")
+		for _, c := range list.Changes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Action, changeTarget(c), changeProposer(c),
+				c.ProposedAt.Local().Format("2006-01-02 15:04"), c.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		tw.Flush()
+	},
+}
+
+var changesApproveCmd = &cobra.Command{
+	Use:   "approve <id>",
+	Short: "Approve a change proposed by another owner, which the engine then carries out",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		c, err := client.ApproveChange(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if c.Status == api.ChangeFailed {
+			fmt.Printf("Error: change %s was approved, but %s failed on %s: %s\n", c.ID, c.Action, node.Name, c.Error)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] Change %s approved: %s %s was carried out on %s.\n", c.ID, c.Action, changeTarget(*c), node.Name)
+
+		// The token of an approved owner invitation is only ever shown to the approver
+		if c.Action == "invite.create" {
+			var invite api.Invitation
+			if err := json.Unmarshal(c.Result, &invite); err != nil {
+				fmt.Printf("Error: the engine returned an unreadable invitation: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println()
+			printInvitation(node, &invite)
+		}
+	},
+}
+
+var changesRejectCmd = &cobra.Command{
+	Use:   "reject <id>",
+	Short: "Discard a pending change; proposers may withdraw their own",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		c, err := client.RejectChange(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] Change %s (%s %s) rejected on %s.\n", c.ID, c.Action, changeTarget(*c), node.Name)
+	},
+}
+
+// reportPending explains an action that the engine queued for approval instead of carrying
+// out, and reports whether err was such a case.
+func reportPending(err error, node string) bool {
+	var pending *api.ApprovalPendingError
+	if !errors.As(err, &pending) {
+		return false
+	}
+	c := pending.Change
+	fmt.Printf("[!] %s requires a second owner's approval. Proposed as change %s, expiring %s.\n",
+		node, c.ID, c.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("    Another owner can carry it out with: onyx-admin changes approve %s --node %s\n", c.ID, node)
+	return true
+}
+
+func changeTarget(c api.PendingChange) string {
+	if c.Target == "" {
+		return "-"
+	}
+	return shortFingerprint(c.Target)
+}
+
+func changeProposer(c api.PendingChange) string {
+	if c.ProposedByName != "" {
+		return fmt.Sprintf("%s (%s)", c.ProposedByName, shortFingerprint(c.ProposedBy))
+	}
+	return shortFingerprint(c.ProposedBy)
+}
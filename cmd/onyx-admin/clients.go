@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"onyx/internal/api"
+	"onyx/internal/config"
+	"onyx/internal/crypto"
+
+	"github.com/spf13/cobra"
+)
+
+// lookupNode finds the paired engine named by --node, or the only one if there is just one.
+func lookupNode(cmd *cobra.Command) (*config.AdminConfig, *config.Node, error) {
+	ref, _ := cmd.Flags().GetString("node")
+
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	switch {
+	case ref != "":
+		node, err := conf.LookupNode(ref)
+		return conf, node, err
+	case len(conf.Nodes) == 1:
+		return conf, &conf.Nodes[0], nil
+	}
+	return nil, nil, fmt.Errorf("%d engines are paired; choose one with --node", len(conf.Nodes))
+}
+
+// connectNode opens an API client for the paired engine named by --node, renewing the
+// console's certificate first if it is close to expiry or the engine CA is being rotated.
+func connectNode(cmd *cobra.Command) (*api.Client, *config.Node, error) {
+	conf, node, err := lookupNode(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshIdentity(conf.Settings, node)
+
+	httpClient, err := crypto.NewMTLSClient(node.CertFile, node.KeyFile, node.CAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return api.NewClient(httpClient, fmt.Sprintf("%s:%d", node.Address, node.Port)), node, nil
+}
+
+var clientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "Manage the admin consoles paired with an engine",
+}
+
+var clientsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the admin consoles paired with an engine",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		clients, err := client.ListClients()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Admin consoles paired with %s (%s):\n\n", node.Name, node.Address)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FINGERPRINT\tNAME\tROLE\tEXPIRES\tLAST USED\tSTATUS")
+		for _, c := range clients {
+			lastUsed := "never"
+			if !c.LastUsed.IsZero() {
+				lastUsed = c.LastUsed.Local().Format("2006-01-02 15:04")
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				c.Fingerprint[:16], c.Name, c.Role, c.ExpiresAt.Local().Format("2006-01-02"), lastUsed, c.Status())
+		}
+		tw.Flush()
+	},
+}
+
+var clientsRenameCmd = &cobra.Command{
+	Use:   "rename <fingerprint> <name>",
+	Short: "Give an admin console a recognisable name",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, _, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		c, err := client.RenameClient(args[0], args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] Client %s is now named %q.\n", c.Fingerprint[:16], c.Name)
+	},
+}
+
+var clientsRevokeCmd = &cobra.Command{
+	Use:   "revoke <fingerprint> | --all",
+	Short: "Revoke an admin console; the engine refuses it from the next handshake on",
+	Long: `With --all, every console paired with the engine is revoked, this one included, as after a
+suspected compromise. Access is restored by pairing again from the engine host.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		if all == (len(args) == 1) {
+			fmt.Println("Error: give either a fingerprint or --all")
+			os.Exit(1)
+		}
+
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if all {
+			revoked, err := client.RevokeAllClients()
+			if reportPending(err, node.Name) {
+				return
+			}
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("[✓] Revoked %d client(s) on %s. Their open sessions were closed.\n", len(revoked), node.Name)
+			fmt.Println("    Pair again from the engine host with 'sudo onyx --pair'.")
+			return
+		}
+
+		c, err := client.RevokeClient(args[0])
+		if reportPending(err, node.Name) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] Client %s (%s) has been revoked on %s. Its open sessions were closed.\n", c.Name, c.Fingerprint[:16], node.Name)
+	},
+}
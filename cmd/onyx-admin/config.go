@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"onyx/internal/api"
+	"onyx/internal/diff"
+
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Validate, inspect and roll back the configuration of an engine",
+	Long: `Every configuration an engine applies, from a reload, a site change or a rollback, is kept
+in its history under /var/lib/onyx/history with a content hash, the time and who applied
+it. Listing requires the viewer role; reading and restoring snapshots require operator.`,
+}
+
+var configHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the configurations the engine applied, newest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		history, err := client.ConfigHistory()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(history) == 0 {
+			fmt.Printf("No configurations recorded on %s yet.\n", node.Name)
+			return
+		}
+
+		fmt.Printf("Configuration history of %s (%s):\n\n", node.Name, node.Address)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tAPPLIED\tBY\tSOURCE\tHASH")
+		for i, s := range history {
+			id := strconv.Itoa(s.ID)
+			if i == 0 {
+				id += " *"
+			}
+			by := shortFingerprint(s.AppliedBy)
+			if s.AppliedByName != "" {
+				by = fmt.Sprintf("%s (%s)", s.AppliedByName, by)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", id, s.AppliedAt.Local().Format("2006-01-02 15:04:05"), by, s.Source, s.Hash[:12])
+		}
+		tw.Flush()
+		fmt.Println("\n* active configuration")
+	},
+}
+
+var configDiffCmd = &cobra.Command{
+	Use:   "diff <a> <b>",
+	Short: "Show what changed between two configurations in the history",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ids, err := snapshotIDs(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		client, _, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		a, err := client.ConfigSnapshot(ids[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		b, err := client.ConfigSnapshot(ids[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		caddyfile := diff.Unified(fmt.Sprintf("#%d/Caddyfile", a.ID), fmt.Sprintf("#%d/Caddyfile", b.ID), a.Caddyfile, b.Caddyfile)
+		sites := diff.Unified(fmt.Sprintf("#%d/sites", a.ID), fmt.Sprintf("#%d/sites", b.ID), siteLines(a.Sites), siteLines(b.Sites))
+		if caddyfile == "" && sites == "" {
+			fmt.Printf("Configurations #%d and #%d are identical.\n", a.ID, b.ID)
+			return
+		}
+		fmt.Print(caddyfile + sites)
+	},
+}
+
+var configRollbackCmd = &cobra.Command{
+	Use:   "rollback <id>",
+	Short: "Re-apply a configuration from the history",
+	Long: `Swaps the Caddyfile and managed sites of a snapshot into the running engine through the same
+validate-then-swap path as a reload, so a config that fails to load leaves the current one in
+place. Rolling back to a config without some of the live managed sites needs a second owner
+when the approval policy is enabled.
+
+The engine cannot write /etc/onyx, so it saves the restored Caddyfile as
+/var/lib/onyx/Caddyfile.rollback; copy it over /etc/onyx/Caddyfile on the engine host, or the
+next reload brings back the file on disk.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ids, err := snapshotIDs(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		snap, err := client.RollbackConfig(ids[0])
+		if reportPending(err, node.Name) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if snap.ID == ids[0] {
+			fmt.Printf("[✓] %s is already running configuration #%d.\n", node.Name, snap.ID)
+			return
+		}
+		fmt.Printf("[✓] %s rolled back to configuration #%d, recorded as #%d (%s).\n", node.Name, ids[0], snap.ID, snap.Hash[:12])
+		fmt.Println("    To keep its Caddyfile across reloads, on the engine host run:")
+		fmt.Println("    sudo install -m 640 -o root -g onyx /var/lib/onyx/Caddyfile.rollback /etc/onyx/Caddyfile")
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate <caddyfile>",
+	Short: "Check a Caddyfile on the engine, with its exact modules, without applying it",
+	Long: `Uploads a local Caddyfile over the control plane. The engine adapts it with the same modules
+it runs (standard, Coraza WAF, OVH DNS), merges in its managed sites and provisions the result
+as a reload would, but loads nothing. Only the uploaded text is checked: file imports,
+environment variables and WAF directives that read files are refused, so inline them first.
+Exits with status 1 if the Caddyfile has errors. Requires the operator role; the resulting
+config is only returned to owners.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		printConfig, _ := cmd.Flags().GetBool("print-config")
+
+		body, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		res, err := client.ValidateConfig(args[0], body)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		switch {
+		case asJSON:
+			out, _ := json.MarshalIndent(res, "", "  ")
+			fmt.Println(string(out))
+		case printConfig && res.Valid && len(res.Config) == 0:
+			fmt.Printf("[✓] %s is valid on %s; the resulting config is only shown to owners.\n", args[0], node.Name)
+		case printConfig && res.Valid:
+			var out bytes.Buffer
+			json.Indent(&out, res.Config, "", "  ")
+			fmt.Println(out.String())
+		default:
+			for _, d := range res.Errors {
+				fmt.Println(diagnosticLine("error", d))
+			}
+			for _, d := range res.Warnings {
+				fmt.Println(diagnosticLine("warning", d))
+			}
+			if res.Valid {
+				fmt.Printf("[✓] %s is valid on %s (%d warning(s)).\n", args[0], node.Name, len(res.Warnings))
+			}
+		}
+
+		if !res.Valid {
+			os.Exit(1)
+		}
+	},
+}
+
+// diagnosticLine formats a diagnostic like a compiler message: file:line: severity: message.
+func diagnosticLine(severity string, d api.Diagnostic) string {
+	var loc string
+	switch {
+	case d.File != "" && d.Line > 0:
+		loc = fmt.Sprintf("%s:%d: ", d.File, d.Line)
+	case d.File != "":
+		loc = d.File + ": "
+	}
+	msg := d.Message
+	if d.Directive != "" && !strings.Contains(msg, d.Directive) {
+		msg = d.Directive + ": " + msg
+	}
+	return loc + severity + ": " + msg
+}
+
+func snapshotIDs(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid configuration ID %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// siteLines renders managed sites one per line, so they can be diffed like a file.
+func siteLines(sites []api.Site) string {
+	var b strings.Builder
+	for _, s := range sites {
+		fmt.Fprintf(&b, "%s -> %s (waf %s, allow %s, balancing %s, health %s)\n", s.Host, strings.Join(s.Upstreams, ", "),
+			wafLabel(s.WAF), allowLabel(s.Allow), balancingLabel(s.LoadBalancing), healthLabel(s.HealthChecks))
+	}
+	return b.String()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"onyx/internal/api"
+	"onyx/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+var inviteCmd = &cobra.Command{
+	Use:   "invite",
+	Short: "Invite a colleague to pair with an engine, without access to its terminal",
+	Long: `Asks the engine for a one-time enrolment token. The colleague redeems it with the printed
+'onyx-admin pair' command, which authenticates the engine by its CA fingerprint instead of a
+verification code on the engine console. Requires the owner role. While two-person approval is
+enabled, owner invitations are proposed for another owner to approve, and the approving owner
+receives the token.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		roleFlag, _ := cmd.Flags().GetString("role")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+
+		role, err := api.ParseRole(roleFlag)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		invite, err := client.Invite(role, ttl)
+		if reportPending(err, node.Name) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		printInvitation(node, invite)
+	},
+}
+
+// printInvitation shows the command that redeems invite on node.
+func printInvitation(node *config.Node, invite *api.Invitation) {
+	fmt.Printf("[✓] Invitation %s created on %s for the %s role, valid until %s.\n\n",
+		invite.ID, node.Name, invite.Role, invite.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	fmt.Println("Send this command to your colleague over a trusted channel; the token works once:")
+	fmt.Printf("\n  onyx-admin pair %s --port %d --token %s --ca-fingerprint %s\n\n",
+		node.Address, node.Port, invite.Token, invite.CAFingerprint)
+}
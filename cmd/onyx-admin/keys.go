@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"onyx/internal/agent"
+	"onyx/internal/config"
+	"onyx/internal/crypto"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Protect this console's private keys with a passphrase",
+}
+
+var keyEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt every private key of this console with a passphrase",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		files, err := keyFiles()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		passphrase, err := readNewPassphrase()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		for _, path := range files {
+			if crypto.IsEncryptedKey(path) {
+				fmt.Printf("  %s is already encrypted\n", path)
+				continue
+			}
+
+			priv, err := crypto.LoadPrivateKey(path)
+			if err != nil {
+				fmt.Printf("Error: %s: %v\n", path, err)
+				os.Exit(1)
+			}
+			data, err := crypto.EncryptPrivateKey(priv, passphrase)
+			if err != nil {
+				fmt.Printf("Error: %s: %v\n", path, err)
+				os.Exit(1)
+			}
+			if err := replaceKeyFile(path, data); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("[✓] Encrypted %s\n", path)
+		}
+
+		fmt.Println("\nStart 'onyx-admin agent' to unlock the keys for a working session.")
+	},
+}
+
+var keyDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Remove passphrase protection from this console's private keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		files, err := keyFiles()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		keys, err := unlockKeys(files)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		for path, priv := range keys {
+			data, err := crypto.EncodePrivateKey(priv)
+			if err != nil {
+				fmt.Printf("Error: %s: %v\n", path, err)
+				os.Exit(1)
+			}
+			if err := replaceKeyFile(path, data); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("[✓] Decrypted %s\n", path)
+		}
+	},
+}
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Hold decrypted keys in memory so onyx-admin can use them without a passphrase",
+	Long: `The agent asks once for the passphrase of each encrypted key and then signs on behalf
+of onyx-admin over a unix socket that only your user can reach. Keys are wiped from memory
+when the lifetime ends or the agent is stopped.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		lifetime, _ := cmd.Flags().GetDuration("lifetime")
+		if lifetime <= 0 {
+			fmt.Println("Error: --lifetime must be positive")
+			os.Exit(1)
+		}
+
+		files, err := keyFiles()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		unlocked, err := unlockKeys(files)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(unlocked) == 0 {
+			fmt.Println("No encrypted keys found; encrypt them first with 'onyx-admin key encrypt'.")
+			os.Exit(1)
+		}
+
+		keys := make([]ed25519.PrivateKey, 0, len(unlocked))
+		for _, priv := range unlocked {
+			keys = append(keys, priv)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		ctx, cancel := context.WithTimeout(ctx, lifetime)
+		defer cancel()
+
+		socket := agent.DefaultSocket()
+		fmt.Printf("Agent holding %d key(s) on %s until %s. Press Ctrl+C to stop.\n",
+			len(keys), socket, time.Now().Add(lifetime).Format("15:04"))
+
+		if err := agent.Serve(ctx, socket, keys); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Agent stopped; keys wiped from memory.")
+	},
+}
+
+// keyFiles lists every private key this console uses: the shared key and any dedicated node keys.
+func keyFiles() ([]string, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	var files []string
+	add := func(path string) {
+		if path == "" || slices.Contains(files, path) {
+			return
+		}
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	add(config.SharedKeyPath())
+	for _, n := range conf.Nodes {
+		add(n.KeyFile)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("this console has no private keys yet; pair an engine first")
+	}
+	return files, nil
+}
+
+// unlockKeys decrypts every encrypted key among files. A passphrase that opened one key is tried
+// on the next before asking again, since most consoles use the same one for all keys.
+func unlockKeys(files []string) (map[string]ed25519.PrivateKey, error) {
+	keys := make(map[string]ed25519.PrivateKey)
+	var last []byte
+
+	for _, path := range files {
+		if !crypto.IsEncryptedKey(path) {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if last != nil {
+			if priv, err := crypto.DecryptPrivateKey(data, last); err == nil {
+				keys[path] = priv
+				continue
+			}
+		}
+
+		for attempt := 0; ; attempt++ {
+			passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", path))
+			if err != nil {
+				return nil, err
+			}
+
+			priv, err := crypto.DecryptPrivateKey(data, passphrase)
+			if errors.Is(err, crypto.ErrBadPassphrase) && attempt < 2 {
+				fmt.Println("Incorrect passphrase, try again.")
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+
+			keys[path], last = priv, passphrase
+			break
+		}
+	}
+
+	return keys, nil
+}
+
+// readNewPassphrase asks for a passphrase twice and insists on a minimum length.
+func readNewPassphrase() ([]byte, error) {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) < 8 {
+		return nil, fmt.Errorf("passphrase must be at least 8 characters")
+	}
+
+	again, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// readPassphrase prompts on the terminal without echoing the input.
+func readPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("a terminal is required to enter a passphrase")
+	}
+
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+// replaceKeyFile atomically swaps the key file at path for data.
+func replaceKeyFile(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".new")
+	if err := crypto.SavePEM(tmp, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
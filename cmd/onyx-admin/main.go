@@ -2,16 +2,21 @@
 package main
 
 import (
+	stdcrypto "crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"onyx/internal/api"
 	"onyx/internal/config"
 	"onyx/internal/crypto"
+	"onyx/internal/pairing"
 	"onyx/internal/ui"
 
 	"github.com/spf13/cobra"
@@ -24,10 +29,7 @@ var rootCmd = &cobra.Command{
 	Short: "Onyx Admin: The management console for the Onyx Security Appliance.",
 	Run: func(cmd *cobra.Command, args []string) {
 		// 1. Load Configuration
-		home, _ := os.UserHomeDir()
-		configPath := filepath.Join(home, ".config", "onyx", "config.toml")
-
-		conf, err := config.LoadConfig(configPath)
+		conf, err := loadConfig()
 		if err != nil {
 			fmt.Printf("Error loading config: %v\n", err)
 			return
@@ -61,7 +63,8 @@ var rootCmd = &cobra.Command{
 				}
 			}
 
-			if err := ui.StartDashboard(version, targetNode); err != nil {
+			refreshIdentity(conf.Settings, targetNode)
+			if err := ui.StartDashboard(version, targetNode, conf.Settings); err != nil {
 				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
 			}
@@ -71,7 +74,9 @@ var rootCmd = &cobra.Command{
 		// 3. Interactive Menu Mode (Default)
 		for {
 			// Reload config on every loop so new pairings show up immediately
-			conf, _ = config.LoadConfig(configPath)
+			if reloaded, err := loadConfig(); err == nil {
+				conf = reloaded
+			}
 
 			action, node := ui.StartMenu(version, conf)
 
@@ -81,7 +86,8 @@ var rootCmd = &cobra.Command{
 				return
 
 			case ui.ActionConnect:
-				if err := ui.StartDashboard(version, node); err != nil {
+				refreshIdentity(conf.Settings, node)
+				if err := ui.StartDashboard(version, node, conf.Settings); err != nil {
 					fmt.Printf("Dashboard Error: %v\n", err)
 					time.Sleep(2 * time.Second)
 				}
@@ -108,7 +114,7 @@ var rootCmd = &cobra.Command{
 
 				// Run the pairing logic
 				fmt.Println("\nConnecting to engine...")
-				if err := performPairing(result.Address, portInt, result.Token); err != nil {
+				if err := performPairing(result.Address, portInt, result.Token, "", false); err != nil {
 					fmt.Printf("\nPairing Failed: %v\n", err)
 					fmt.Println("(Press Enter to return to menu)")
 					fmt.Scanln()
@@ -130,13 +136,15 @@ var pairCmd = &cobra.Command{
 		targetIP := args[0]
 		token, _ := cmd.Flags().GetString("token")
 		port, _ := cmd.Flags().GetInt("port")
+		separateKey, _ := cmd.Flags().GetBool("separate-key")
+		caFingerprint, _ := cmd.Flags().GetString("ca-fingerprint")
 
 		if token == "" {
 			fmt.Println("Error: A pairing --token is required.")
 			os.Exit(1)
 		}
 
-		if err := performPairing(targetIP, port, token); err != nil {
+		if err := performPairing(targetIP, port, token, caFingerprint, separateKey); err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -145,52 +153,37 @@ var pairCmd = &cobra.Command{
 
 // performPairing handles the core identity generation, handshake, and config persistence.
 // This is used by both the CLI 'pair' command and the TUI Form.
-func performPairing(targetIP string, port int, token string) error {
-	// 1. Setup local paths
-	home, _ := os.UserHomeDir()
-	baseDir := filepath.Join(home, ".config", "onyx")
-	certDir := filepath.Join(baseDir, "certs")
-	configPath := filepath.Join(baseDir, "config.toml")
-
-	if err := os.MkdirAll(certDir, 0700); err != nil {
-		return fmt.Errorf("failed to create config directory: %w", err)
+// Each engine gets its own certificate under nodes/<id>/. The private key is shared across
+// engines unless separateKey is set, in which case a dedicated key is created for this engine.
+// With caFingerprint, as given out with invitations, the engine is authenticated by its CA
+// instead of by comparing verification codes with an operator on the engine console.
+func performPairing(targetIP string, port int, token, caFingerprint string, separateKey bool) error {
+	// 1. Load the config first so a re-paired engine keeps its node ID
+	conf, err := loadConfig()
+	if err != nil {
+		fmt.Printf("Warning: Failed to load config for update: %v\n", err)
+		conf = &config.AdminConfig{}
 	}
 
-	keyPath := filepath.Join(certDir, "client.key")
-	certPath := filepath.Join(certDir, "client.crt")
-
-	// 2. Generate or load local identity
+	// 2. Generate or load local identity. The shared key may be held by the agent.
+	sharedKeyPath := config.SharedKeyPath()
 	var priv ed25519.PrivateKey
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		fmt.Println("Generating new local identity...")
-		_, newPriv, err := ed25519.GenerateKey(rand.Reader)
-		if err != nil {
+	var signer stdcrypto.Signer
+	if separateKey {
+		fmt.Println("Generating a dedicated identity for this engine...")
+		if _, priv, err = ed25519.GenerateKey(rand.Reader); err != nil {
 			return fmt.Errorf("failed to generate identity: %w", err)
 		}
-		priv = newPriv
-
-		privPEM, err := crypto.EncodePrivateKey(priv)
-		if err != nil {
-			return fmt.Errorf("failed to encode private key: %w", err)
-		}
-
-		if err := crypto.SavePEM(keyPath, privPEM); err != nil {
-			return fmt.Errorf("failed to save private key: %w", err)
-		}
-	} else {
-		fmt.Println("Loading existing identity...")
-		loadedPriv, err := crypto.LoadPrivateKey(keyPath)
-		if err != nil {
-			return fmt.Errorf("failed to load private key: %w", err)
-		}
-		priv = loadedPriv
+		signer = priv
+	} else if signer, err = loadOrCreateKey(sharedKeyPath); err != nil {
+		return err
 	}
 
 	// 3. Create CSR
 	hostname, _ := os.Hostname()
 	commonName := fmt.Sprintf("admin@%s", hostname)
 
-	csrPEM, err := crypto.GenerateCSR(priv, commonName)
+	csrPEM, err := crypto.GenerateCSR(signer, commonName)
 	if err != nil {
 		return fmt.Errorf("failed to create CSR: %w", err)
 	}
@@ -199,42 +192,210 @@ func performPairing(targetIP string, port int, token string) error {
 	targetAddr := fmt.Sprintf("%s:%d", targetIP, port)
 	fmt.Printf("Initiating secure handshake with %s...\n", targetAddr)
 
-	signedCert, err := crypto.PerformHandshake(targetAddr, token, csrPEM)
+	signedCert, caCert, code, err := crypto.PerformHandshake(targetAddr, token, caFingerprint, csrPEM, func(code string) {
+		if caFingerprint == "" {
+			fmt.Printf("\nVerification code: %s\n", code)
+			fmt.Println("Confirm on the engine console that it shows the same code...")
+		}
+	})
 	if err != nil {
-		return fmt.Errorf("handshake failed: %w", err)
+		return fmt.Errorf("handshake failed: %w", explainPairingError(err))
+	}
+
+	// The engine operator has accepted; nothing is saved here until this side agrees too.
+	// An engine vouched for by the invitation's CA fingerprint needs no code comparison.
+	if caFingerprint == "" {
+		fmt.Printf("Did the engine console show %s? (y/N): ", code)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.TrimSpace(strings.ToLower(answer)) != "y" {
+			return fmt.Errorf("verification code not confirmed; nothing was saved")
+		}
 	}
 
-	// 5. Save the signed certificate
-	if err := os.WriteFile(certPath, signedCert, 0644); err != nil {
+	// 5. Save the certificate, the pinned CA and any dedicated key in the node's own directory
+	node := conf.AddNode("Onyx Engine", targetIP, port)
+	nodeDir := config.NodeDir(node.ID)
+	if err := os.MkdirAll(nodeDir, 0700); err != nil {
+		return fmt.Errorf("failed to create node directory: %w", err)
+	}
+
+	node.CertFile = filepath.Join(nodeDir, "client.crt")
+	if err := os.WriteFile(node.CertFile, signedCert, 0644); err != nil {
 		return fmt.Errorf("failed to save certificate: %w", err)
 	}
 
+	node.CAFile = filepath.Join(nodeDir, "ca.crt")
+	if err := os.WriteFile(node.CAFile, caCert, 0644); err != nil {
+		return fmt.Errorf("failed to save engine CA: %w", err)
+	}
+
+	node.KeyFile = sharedKeyPath
+	if separateKey {
+		node.KeyFile = filepath.Join(nodeDir, "client.key")
+		if err := saveKey(node.KeyFile, priv); err != nil {
+			return err
+		}
+	}
+
 	// 6. PERSISTENCE: Save the server to config.toml
-	conf, err := config.LoadConfig(configPath)
+	if err := conf.SaveConfig(config.DefaultPath()); err != nil {
+		return fmt.Errorf("failed to save server to config: %w", err)
+	}
+
+	role := "owner"
+	if cert, err := crypto.ParseCertificate(signedCert); err == nil && crypto.CertificateRole(cert) != "" {
+		role = crypto.CertificateRole(cert)
+	}
+	fmt.Printf("[✓] Pairing complete! Identity authorized with the %s role.\n", role)
+	return nil
+}
+
+// loadOrCreateKey loads the Ed25519 key at path, generating and saving one if it does not exist yet.
+// An encrypted key is used through the agent.
+func loadOrCreateKey(path string) (stdcrypto.Signer, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		fmt.Println("Generating new local identity...")
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate identity: %w", err)
+		}
+		return priv, saveKey(path, priv)
+	}
+
+	fmt.Println("Loading existing identity...")
+	signer, err := crypto.LoadSigner(path)
 	if err != nil {
-		fmt.Printf("Warning: Failed to load config for update: %v\n", err)
-		conf = &config.AdminConfig{}
+		return nil, fmt.Errorf("failed to load private key: %w", err)
 	}
+	return signer, nil
+}
 
-	// AddNode handles duplication checks automatically
-	conf.AddNode("Onyx Engine", targetIP, port)
+// saveKey writes a private key with owner-only permissions, creating its directory if needed.
+func saveKey(path string, priv ed25519.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
 
-	if err := conf.SaveConfig(configPath); err != nil {
-		return fmt.Errorf("failed to save server to config: %w", err)
+	privPEM, err := crypto.EncodePrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
 	}
 
-	fmt.Println("[✓] Pairing complete! Identity authorized.")
+	if err := crypto.SavePEM(path, privPEM); err != nil {
+		return fmt.Errorf("failed to save private key: %w", err)
+	}
 	return nil
 }
 
+// loadConfig reads config.toml and upgrades installs that predate per-node identities.
+func loadConfig() (*config.AdminConfig, error) {
+	conf, err := config.LoadConfig(config.DefaultPath())
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := conf.Migrate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate config: %w", err)
+	}
+	if changed {
+		if err := conf.SaveConfig(config.DefaultPath()); err != nil {
+			return nil, fmt.Errorf("failed to save migrated config: %w", err)
+		}
+		fmt.Println("Migrated paired engines to per-engine identities.")
+	}
+
+	return conf, nil
+}
+
+// explainPairingError adds operator guidance to structured pairing failures.
+func explainPairingError(err error) error {
+	var perr *pairing.Error
+	if !errors.As(err, &perr) {
+		return err
+	}
+
+	switch perr.Code {
+	case pairing.ErrBadToken:
+		return fmt.Errorf("%w (check the token printed by 'sudo onyx --pair')", err)
+	case pairing.ErrExpired:
+		return fmt.Errorf("%w (start a new window with 'sudo onyx --pair')", err)
+	case pairing.ErrLockedOut:
+		return fmt.Errorf("%w (too many failed attempts; start a new window on the engine)", err)
+	case pairing.ErrUnsupportedVersion:
+		return fmt.Errorf("%w (engine speaks versions %v; upgrade the older side)", err, perr.SupportedVersions)
+	case pairing.ErrRejected:
+		return fmt.Errorf("%w (the codes did not match on the engine console)", err)
+	}
+	return err
+}
+
 func main() {
 	// Global Flags
 	rootCmd.PersistentFlags().IntP("port", "p", 2305, "Target port")
 
 	// Pair specific flags
 	pairCmd.Flags().StringP("token", "t", "", "One-time pairing token")
+	pairCmd.Flags().Bool("separate-key", false, "Use a dedicated private key for this engine instead of the shared one")
+	pairCmd.Flags().String("ca-fingerprint", "", "Engine CA fingerprint from an invitation; replaces the verification code check")
+
+	clientsCmd.PersistentFlags().String("node", "", "Engine to manage (ID, name or address); optional if only one is paired")
+	clientsCmd.AddCommand(clientsListCmd, clientsRenameCmd, clientsRevokeCmd)
+	clientsRevokeCmd.Flags().Bool("all", false, "Revoke every console paired with the engine, this one included")
+
+	renewCmd.Flags().String("node", "", "Engine to renew the certificate for (ID, name or address); optional if only one is paired")
+
+	agentCmd.Flags().Duration("lifetime", 8*time.Hour, "How long the agent keeps keys unlocked")
+	keyCmd.AddCommand(keyEncryptCmd, keyDecryptCmd)
+
+	auditCmd.Flags().String("node", "", "Engine to query (ID, name or address); optional if only one is paired")
+	auditCmd.Flags().String("since", "", "Only entries after this time (24h, 2006-01-02 or RFC 3339)")
+	auditCmd.Flags().String("until", "", "Only entries before this time (24h, 2006-01-02 or RFC 3339)")
+	auditCmd.Flags().String("actor", "", "Only entries by this client (fingerprint prefix or name, or \"local\")")
+	auditCmd.Flags().String("action", "", "Only this action or action prefix (e.g. login, reload, client)")
+	auditCmd.Flags().Int("limit", 0, "Show at most this many of the newest matching entries")
+	auditCmd.Flags().Bool("json", false, "Print the report as JSON")
+
+	inviteCmd.Flags().String("node", "", "Engine to invite to (ID, name or address); optional if only one is paired")
+	inviteCmd.Flags().String("role", string(api.RoleViewer), "Role granted to the colleague (viewer, operator, owner)")
+	inviteCmd.Flags().Duration("ttl", time.Hour, "How long the invitation can be redeemed")
+
+	changesCmd.PersistentFlags().String("node", "", "Engine to review (ID, name or address); optional if only one is paired")
+	changesCmd.AddCommand(changesListCmd, changesApproveCmd, changesRejectCmd)
+
+	sitesCmd.PersistentFlags().String("node", "", "Engine to manage (ID, name or address); optional if only one is paired")
+	for _, c := range []*cobra.Command{sitesAddCmd, sitesUpdateCmd} {
+		c.Flags().StringSlice("upstream", nil, "Backend as host:port; repeat for several")
+		c.Flags().String("waf", "off", "WAF mode with the OWASP Core Rule Set: off, detect or block")
+		c.Flags().StringSlice("allow", nil, "Client IP or CIDR allowed in; repeat for several (default everyone)")
+		c.Flags().String("lb-policy", "random", "How to pick an upstream: random, round_robin, least_conn, ip_hash, cookie or first")
+		c.Flags().Int("retries", 0, "Further attempts on other upstreams when a request fails")
+		c.Flags().String("try-duration", "", "How long to keep retrying a failed request (e.g. 5s)")
+		c.Flags().String("health-path", "", "Path polled on every upstream by active health checks (e.g. /healthz)")
+		c.Flags().String("health-interval", "", "Time between active health checks (default 30s)")
+		c.Flags().String("health-timeout", "", "Timeout of each active health check (default 5s)")
+		c.Flags().Int("health-status", 0, "Status a healthy upstream answers with (default any 2xx)")
+		c.Flags().Int("max-fails", 0, "Failed requests that take an upstream out of rotation (enables passive checks)")
+		c.Flags().String("fail-duration", "", "How long a failed request counts against an upstream (default 30s)")
+		c.Flags().IntSlice("unhealthy-status", nil, "Response status that counts as a failure; repeat for several")
+	}
+	sitesAddCmd.MarkFlagRequired("upstream")
+	sitesCmd.AddCommand(sitesListCmd, sitesAddCmd, sitesUpdateCmd, sitesRemoveCmd)
+
+	configCmd.PersistentFlags().String("node", "", "Engine to inspect (ID, name or address); optional if only one is paired")
+	configValidateCmd.Flags().Bool("json", false, "Print the diagnostics and resulting config as JSON")
+	configValidateCmd.Flags().Bool("print-config", false, "Print the JSON config the engine would load")
+	configCmd.AddCommand(configHistoryCmd, configDiffCmd, configRollbackCmd, configValidateCmd)
+
+	for _, c := range []*cobra.Command{planCmd, applyCmd} {
+		c.Flags().StringP("file", "f", "", "Desired-state TOML file listing the engine's sites")
+		c.Flags().String("node", "", "Engine to converge (ID, name or address); defaults to the file's node")
+		c.MarkFlagRequired("file")
+	}
+	applyCmd.Flags().String("if-match", "", "Refuse unless the live sites still have this state, as printed by plan")
 
-	rootCmd.AddCommand(pairCmd)
+	rootCmd.AddCommand(pairCmd, clientsCmd, renewCmd, keyCmd, agentCmd, auditCmd, inviteCmd, changesCmd, sitesCmd, configCmd, planCmd, applyCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
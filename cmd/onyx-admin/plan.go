@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"onyx/internal/api"
+	"onyx/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan -f <file.toml>",
+	Short: "Show what applying a desired-state file would change on an engine",
+	Long: `The file lists every managed site the engine should serve, with its upstreams, WAF mode,
+allowed client ranges, load balancing and health checks. Sites on the engine that the file
+leaves out would be removed. Nothing is changed; run 'onyx-admin apply' with the printed
+--if-match to carry out exactly this plan.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := makePlan(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		p.print()
+		if len(p.entries) > 0 {
+			fmt.Printf("\nTo apply exactly this plan: onyx-admin apply -f %s --node %s --if-match '%s'\n", p.file, p.node.Name, p.etag)
+		}
+	},
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply -f <file.toml>",
+	Short: "Converge an engine's managed sites on a desired-state file",
+	Long: `The engine's sites are replaced in one step, so it never serves half of the file. With
+--if-match, the engine refuses if its sites changed since 'onyx-admin plan' printed that
+value. Removing sites needs a second owner when the approval policy is enabled.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ifMatch, _ := cmd.Flags().GetString("if-match")
+
+		p, err := makePlan(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		// 1. Refuse early if the engine moved on since the plan that was reviewed
+		if ifMatch != "" && ifMatch != p.etag {
+			fmt.Printf("Error: the sites on %s changed since the plan was made (now %s); run 'onyx-admin plan' again\n", p.node.Name, p.etag)
+			os.Exit(1)
+		}
+
+		p.print()
+		if len(p.entries) == 0 {
+			return
+		}
+
+		// 2. Apply the whole set, guarded by the state the plan was computed from
+		if ifMatch == "" {
+			ifMatch = p.etag
+		}
+		sites, err := p.client.SyncSites(p.desired, ifMatch)
+		if reportPending(err, p.node.Name) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("\n[✓] %s now serves the %d site(s) in %s.\n", p.node.Name, len(sites), p.file)
+	},
+}
+
+// sitePlan is what applying a desired-state file would change on one engine.
+type sitePlan struct {
+	client  *api.Client
+	node    *config.Node
+	file    string
+	etag    string // ETag of the live sites the plan was computed from
+	desired []api.SiteRequest
+	entries []planEntry
+}
+
+// planEntry is one site the plan adds (+), changes (~) or removes (-).
+type planEntry struct {
+	op         byte
+	host       string
+	have, want *api.SiteRequest // Live and desired settings
+}
+
+// makePlan loads the file named by -f and compares it with the live sites of the engine.
+func makePlan(cmd *cobra.Command) (*sitePlan, error) {
+	file, _ := cmd.Flags().GetString("file")
+	state, err := config.LoadDesiredState(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read desired state: %w", err)
+	}
+
+	// The file may name its engine; --node still wins
+	if !cmd.Flags().Changed("node") && state.Node != "" {
+		cmd.Flags().Set("node", state.Node)
+	}
+	client, node, err := connectNode(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	live, etag, err := client.SitesState()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sitePlan{client: client, node: node, file: file, etag: etag}
+	if err := p.compare(state.Sites, live); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compare records the sites of the file and what would change to bring the live sites to them.
+func (p *sitePlan) compare(sites []config.DesiredSite, live []api.Site) error {
+	for _, s := range sites {
+		p.desired = append(p.desired, desiredSite(s))
+	}
+	wanted := make(map[string]*api.SiteRequest, len(p.desired))
+	for i := range p.desired {
+		if _, dup := wanted[p.desired[i].Host]; dup {
+			return fmt.Errorf("%s lists %s more than once", p.file, p.desired[i].Host)
+		}
+		wanted[p.desired[i].Host] = &p.desired[i]
+	}
+
+	current := make(map[string]*api.SiteRequest, len(live))
+	for _, s := range live {
+		current[s.Host] = &api.SiteRequest{
+			Host:          s.Host,
+			Upstreams:     s.Upstreams,
+			WAF:           s.WAF,
+			Allow:         s.Allow,
+			LoadBalancing: s.LoadBalancing,
+			HealthChecks:  s.HealthChecks,
+		}
+	}
+
+	hosts := make([]string, 0, len(wanted)+len(current))
+	for host := range wanted {
+		hosts = append(hosts, host)
+	}
+	for host := range current {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+
+	for _, host := range slices.Compact(hosts) {
+		have, want := current[host], wanted[host]
+		switch {
+		case have == nil:
+			p.entries = append(p.entries, planEntry{op: '+', host: host, want: want})
+		case want == nil:
+			p.entries = append(p.entries, planEntry{op: '-', host: host, have: have})
+		case !sameSettings(*have, *want):
+			p.entries = append(p.entries, planEntry{op: '~', host: host, have: have, want: want})
+		}
+	}
+	return nil
+}
+
+// print shows the plan the way a reviewer reads it: one block per site, then a count.
+func (p *sitePlan) print() {
+	if len(p.entries) == 0 {
+		fmt.Printf("No changes. The sites on %s match %s.\n", p.node.Name, p.file)
+		return
+	}
+
+	fmt.Printf("Plan for %s (%s), live state %s:\n\n", p.node.Name, p.node.Address, p.etag)
+	var add, change, remove int
+	for _, e := range p.entries {
+		fmt.Printf("  %c %s\n", e.op, e.host)
+		switch e.op {
+		case '+':
+			add++
+			planField("upstreams", "", strings.Join(e.want.Upstreams, ", "))
+			planField("waf", "", wafLabel(e.want.WAF))
+			planField("allow", "", allowLabel(e.want.Allow))
+			planField("balancing", "", balancingLabel(e.want.LoadBalancing))
+			planField("health", "", healthLabel(e.want.HealthChecks))
+		case '~':
+			change++
+			planField("upstreams", strings.Join(e.have.Upstreams, ", "), strings.Join(e.want.Upstreams, ", "))
+			planField("waf", wafLabel(e.have.WAF), wafLabel(e.want.WAF))
+			planField("allow", allowLabel(e.have.Allow), allowLabel(e.want.Allow))
+			planField("balancing", balancingLabel(e.have.LoadBalancing), balancingLabel(e.want.LoadBalancing))
+			planField("health", healthLabel(e.have.HealthChecks), healthLabel(e.want.HealthChecks))
+		case '-':
+			remove++
+		}
+	}
+	fmt.Printf("\nPlan: %d to add, %d to change, %d to remove.\n", add, change, remove)
+}
+
+// planField prints one setting of a planned site; for a change, only if it differs.
+func planField(name, have, want string) {
+	switch {
+	case have == "":
+		fmt.Printf("      %-10s %s\n", name, want)
+	case have != want:
+		fmt.Printf("      %-10s %s -> %s\n", name, have, want)
+	}
+}
+
+// desiredSite spells a site from the file the way the engine stores it, so that equivalent
+// settings such as "10.0.0.1" and "10.0.0.1/32" do not show up as changes.
+func desiredSite(s config.DesiredSite) api.SiteRequest {
+	req := api.SiteRequest{
+		Host:      s.Host,
+		Upstreams: slices.Clone(s.Upstreams),
+		WAF:       s.WAF,
+		Allow:     slices.Clone(s.Allow),
+		LoadBalancing: api.LoadBalancing{
+			Policy:      s.LoadBalancing.Policy,
+			Retries:     s.LoadBalancing.Retries,
+			TryDuration: s.LoadBalancing.TryDuration,
+		},
+		HealthChecks: api.HealthChecks{
+			Path:            s.HealthChecks.Path,
+			Interval:        s.HealthChecks.Interval,
+			Timeout:         s.HealthChecks.Timeout,
+			ExpectStatus:    s.HealthChecks.ExpectStatus,
+			MaxFails:        s.HealthChecks.MaxFails,
+			FailDuration:    s.HealthChecks.FailDuration,
+			UnhealthyStatus: s.HealthChecks.UnhealthyStatus,
+		},
+	}
+	api.NormalizeSite(&req)
+	return req
+}
+
+func sameSettings(a, b api.SiteRequest) bool {
+	return slices.Equal(a.Upstreams, b.Upstreams) && a.WAF == b.WAF && slices.Equal(a.Allow, b.Allow) &&
+		a.LoadBalancing == b.LoadBalancing && sameHealthChecks(a.HealthChecks, b.HealthChecks)
+}
+
+func sameHealthChecks(a, b api.HealthChecks) bool {
+	return a.Path == b.Path && a.Interval == b.Interval && a.Timeout == b.Timeout && a.ExpectStatus == b.ExpectStatus &&
+		a.MaxFails == b.MaxFails && a.FailDuration == b.FailDuration && slices.Equal(a.UnhealthyStatus, b.UnhealthyStatus)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"onyx/internal/api"
+	"onyx/internal/config"
+	"onyx/internal/engine"
+)
+
+// loadState parses a desired-state file with the given contents.
+func loadState(t *testing.T, contents string) *config.DesiredState {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "edge.toml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := config.LoadDesiredState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// planAgainst compares a desired-state file with live sites.
+func planAgainst(t *testing.T, contents string, live []api.Site) *sitePlan {
+	t.Helper()
+	p := &sitePlan{node: &config.Node{Name: "edge-1", Address: "192.0.2.10"}, file: "edge.toml", etag: `"5f1d"`}
+	if err := p.compare(loadState(t, contents).Sites, live); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+func TestPlanCompare(t *testing.T) {
+	app := api.Site{Host: "app.example.com", Upstreams: []string{"10.0.0.5:8080"}, WAF: api.WAFDetect, Allow: []string{"10.0.0.0/8"}}
+
+	tests := []struct {
+		name string
+		live []api.Site
+		file string
+		want []string // Plan entries as op and host
+	}{
+		{
+			name: "unchanged",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "detect"
+				allow = ["10.0.0.0/8"]`,
+		},
+		{
+			name: "site added",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "detect"
+				allow = ["10.0.0.0/8"]
+				[[site]]
+				host = "new.example.com"
+				upstreams = ["10.0.0.8:8080"]`,
+			want: []string{"+ new.example.com"},
+		},
+		{
+			name: "site removed",
+			live: []api.Site{app, {Host: "old.example.com", Upstreams: []string{"10.0.0.9:8080"}}},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "detect"
+				allow = ["10.0.0.0/8"]`,
+			want: []string{"- old.example.com"},
+		},
+		{
+			name: "every site removed",
+			live: []api.Site{app},
+			want: []string{"- app.example.com"},
+		},
+		{
+			name: "upstreams changed",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080", "10.0.0.6:8080"]
+				waf = "detect"
+				allow = ["10.0.0.0/8"]`,
+			want: []string{"~ app.example.com"},
+		},
+		{
+			name: "WAF mode changed",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "block"
+				allow = ["10.0.0.0/8"]`,
+			want: []string{"~ app.example.com"},
+		},
+		{
+			name: "WAF turned off",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "off"
+				allow = ["10.0.0.0/8"]`,
+			want: []string{"~ app.example.com"},
+		},
+		{
+			name: "access rule added",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "detect"
+				allow = ["10.0.0.0/8", "192.168.1.10"]`,
+			want: []string{"~ app.example.com"},
+		},
+		{
+			name: "access rules removed",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "detect"`,
+			want: []string{"~ app.example.com"},
+		},
+		{
+			name: "load balancing changed",
+			live: []api.Site{app},
+			file: `[[site]]
+				host = "app.example.com"
+				upstreams = ["10.0.0.5:8080"]
+				waf = "detect"
+				allow = ["10.0.0.0/8"]
+				[site.load_balancing]
+				policy = "least_conn"`,
+			want: []string{"~ app.example.com"},
+		},
+		{
+			name: "equivalent spellings",
+			live: []api.Site{{
+				Host: "app.example.com", Upstreams: []string{"10.0.0.5:8080"}, Allow: []string{"10.0.0.1/32", "2001:db8::/32"},
+				LoadBalancing: api.LoadBalancing{TryDuration: "1m0s"}, HealthChecks: api.HealthChecks{Path: "/healthz", Interval: "30s"},
+			}},
+			file: `[[site]]
+				host = "App.Example.com."
+				upstreams = [" 10.0.0.5:8080"]
+				waf = "OFF"
+				allow = ["10.0.0.1", "2001:DB8::1/32"]
+				[site.load_balancing]
+				policy = "Random"
+				try_duration = "60s"
+				[site.health_checks]
+				path = "/healthz "
+				interval = "30000ms"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := planAgainst(t, tt.file, tt.live)
+			var got []string
+			for _, e := range p.entries {
+				got = append(got, string(e.op)+" "+e.host)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got plan %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanRefusesDuplicateHosts(t *testing.T) {
+	p := &sitePlan{file: "edge.toml"}
+	err := p.compare(loadState(t, `
+		[[site]]
+		host = "app.example.com"
+		upstreams = ["10.0.0.5:8080"]
+		[[site]]
+		host = "APP.example.com."
+		upstreams = ["10.0.0.6:8080"]`).Sites, nil)
+	if err == nil || !strings.Contains(err.Error(), "lists app.example.com more than once") {
+		t.Errorf("got %v, want the duplicate refused", err)
+	}
+}
+
+func TestPlanPrint(t *testing.T) {
+	live := []api.Site{
+		{Host: "app.example.com", Upstreams: []string{"10.0.0.5:8080"}, WAF: api.WAFDetect, Allow: []string{"10.0.0.0/8"}},
+		{Host: "old.example.com", Upstreams: []string{"10.0.0.9:8080"}},
+		{Host: "static.example.com", Upstreams: []string{"10.0.0.7:8080"}},
+	}
+	p := planAgainst(t, `
+		[[site]]
+		host = "app.example.com"
+		upstreams = ["10.0.0.5:8080"]
+		waf = "block"
+		allow = ["10.0.0.0/8", "192.168.1.10"]
+
+		[[site]]
+		host = "new.example.com"
+		upstreams = ["10.0.0.8:8080", "10.0.0.9:8080"]
+		waf = "detect"
+		[site.load_balancing]
+		policy = "round_robin"
+		retries = 2
+		[site.health_checks]
+		path = "/healthz"
+		max_fails = 3
+
+		[[site]]
+		host = "static.example.com"
+		upstreams = ["10.0.0.7:8080"]`, live)
+
+	want := `Plan for edge-1 (192.0.2.10), live state "5f1d":
+
+  ~ app.example.com
+      waf        detect -> block
+      allow      10.0.0.0/8 -> 10.0.0.0/8, 192.168.1.10/32
+  + new.example.com
+      upstreams  10.0.0.8:8080, 10.0.0.9:8080
+      waf        detect
+      allow      everyone
+      balancing  round_robin, 2 retries
+      health     GET /healthz; down after 3 fails
+  - old.example.com
+
+Plan: 1 to add, 1 to change, 1 to remove.
+`
+	if got := captureStdout(t, p.print); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	clean := planAgainst(t, "", nil)
+	if got := captureStdout(t, clean.print); got != "No changes. The sites on edge-1 match edge.toml.\n" {
+		t.Errorf("empty plan printed %q", got)
+	}
+}
+
+func TestPlanCleanAfterApply(t *testing.T) {
+	// Settings spelled the way people write them, which the engine stores in its own spelling
+	const file = `
+		[[site]]
+		host = "App.Example.com."
+		upstreams = [" 10.0.0.5:8080", "10.0.0.6:8080"]
+		waf = "Block"
+		allow = ["10.0.0.1", "192.168.1.7/24", "2001:db8::1"]
+		[site.load_balancing]
+		policy = "Least_Conn"
+		retries = 2
+		try_duration = "5000ms"
+		[site.health_checks]
+		path = " /healthz"
+		interval = "60s"
+		timeout = "2s"
+		max_fails = 3
+		fail_duration = "90s"
+		unhealthy_status = [502, 503]
+
+		[[site]]
+		host = "*.example.com"
+		upstreams = ["backend.internal:9000"]
+		waf = "off"
+		[site.load_balancing]
+		policy = "random"`
+
+	// Apply the plan through the engine's site store, as PUT /sites does
+	p := planAgainst(t, file, nil)
+	if len(p.entries) != 2 {
+		t.Fatalf("got %d entries against an empty engine, want 2", len(p.entries))
+	}
+	store, err := engine.OpenSiteStore(filepath.Join(t.TempDir(), "sites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sites []api.Site
+	for _, req := range p.desired {
+		sites = append(sites, api.Site{
+			Host: req.Host, Upstreams: req.Upstreams, WAF: req.WAF, Allow: req.Allow,
+			LoadBalancing: req.LoadBalancing, HealthChecks: req.HealthChecks,
+		})
+	}
+	if _, err := store.Sync(sites, "", "local", func([]api.Site) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The live sites reach onyx-admin as JSON
+	data, err := json.Marshal(store.List())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var live []api.Site
+	if err := json.Unmarshal(data, &live); err != nil {
+		t.Fatal(err)
+	}
+
+	if again := planAgainst(t, file, live); len(again.entries) != 0 {
+		for _, e := range again.entries {
+			t.Errorf("plan after apply still has %c %s: have %+v, want %+v", e.op, e.host, e.have, e.want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/config"
+	"onyx/internal/crypto"
+
+	"github.com/spf13/cobra"
+)
+
+var renewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Renew this console's certificate for a paired engine now",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, node, err := lookupNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := renewNode(node); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// refreshIdentity keeps the node's certificate usable before connecting: it renews it close to
+// expiry and moves it to the engine's new CA during a CA rotation.
+func refreshIdentity(settings config.GlobalSettings, node *config.Node) {
+	renewIfDue(settings, node)
+	followRotation(node)
+}
+
+// renewIfDue renews the node's certificate when it expires within the configured window.
+// Failures are reported but not fatal: the current certificate is still valid.
+func renewIfDue(settings config.GlobalSettings, node *config.Node) {
+	window := settings.RenewWindow()
+	if window <= 0 || node.CertFile == "" {
+		return
+	}
+
+	expiry, err := node.CertExpiry()
+	if err != nil || time.Until(expiry) > window {
+		return
+	}
+	if time.Now().After(expiry) {
+		fmt.Printf("Certificate for %s expired on %s; re-pair it with 'onyx-admin pair'.\n", node.Name, expiry.Local().Format("2006-01-02"))
+		return
+	}
+
+	fmt.Printf("Certificate for %s expires on %s, renewing...\n", node.Name, expiry.Local().Format("2006-01-02"))
+	if err := renewNode(node); err != nil {
+		fmt.Printf("Warning: renewal failed, the current certificate stays in use: %v\n", err)
+	}
+}
+
+// followRotation re-issues the node's certificate under the engine's new CA while a rotation is
+// in progress, and unpins the previous CA once the rotation is over. Failures are reported but
+// not fatal: the previous CA is trusted until it retires.
+func followRotation(node *config.Node) {
+	if node.CertFile == "" {
+		return
+	}
+	current, err := os.ReadFile(node.CertFile)
+	if err != nil {
+		return
+	}
+	cert, err := crypto.ParseCertificate(current)
+	if err != nil {
+		return
+	}
+
+	// Connection problems are left for the command that follows to report
+	httpClient, err := crypto.NewMTLSClient(node.CertFile, node.KeyFile, node.CAFile)
+	if err != nil {
+		return
+	}
+	status, err := api.NewClient(httpClient, fmt.Sprintf("%s:%d", node.Address, node.Port)).Status()
+	if err != nil {
+		return
+	}
+
+	rot := status.Authority.Rotation
+	if rot == nil {
+		unpinRetiredCA(node, status.Authority.Fingerprint)
+		return
+	}
+	if hex.EncodeToString(cert.AuthorityKeyId) == status.Authority.KeyID {
+		return
+	}
+
+	retires := rot.RetiresAt.Local().Format("2006-01-02")
+	fmt.Printf("The engine CA of %s is being rotated and the previous one retires on %s; moving this console to the new CA...\n", node.Name, retires)
+	if err := renewNode(node); err != nil {
+		fmt.Printf("Warning: re-issue failed, the current certificate is accepted until %s: %v\n", retires, err)
+	}
+}
+
+// unpinRetiredCA drops CAs other than the engine's current one from the node's pinned bundle
+// once a rotation is over, so a retired CA is no longer trusted for the engine's identity.
+// The bundle is left alone if it does not hold the current CA.
+func unpinRetiredCA(node *config.Node, fingerprint string) {
+	pinned, err := os.ReadFile(node.CAFile)
+	if err != nil {
+		return
+	}
+
+	var keep []byte
+	count := 0
+	for rest := pinned; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		count++
+		if ca, err := x509.ParseCertificate(block.Bytes); err == nil && crypto.Fingerprint(ca) == fingerprint {
+			keep = pem.EncodeToMemory(block)
+		}
+	}
+	if count < 2 || keep == nil {
+		return
+	}
+
+	if err := restoreFile(node.CAFile, keep); err != nil {
+		fmt.Printf("Warning: failed to unpin the retired engine CA for %s: %v\n", node.Name, err)
+		return
+	}
+	fmt.Printf("[✓] Unpinned the retired engine CA for %s.\n", node.Name)
+}
+
+// renewNode requests a replacement certificate over the node's current mTLS identity.
+// Nodes on the shared key keep it, as do keys protected by a passphrase; other nodes with a
+// dedicated key get a fresh one.
+func renewNode(node *config.Node) error {
+	// 1. Pick the key the new certificate will certify
+	signer, err := crypto.LoadSigner(node.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load private key: %w", err)
+	}
+
+	var priv ed25519.PrivateKey
+	rotate := node.KeyFile != config.SharedKeyPath() && !crypto.IsEncryptedKey(node.KeyFile)
+	if rotate {
+		if _, priv, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return fmt.Errorf("failed to generate identity: %w", err)
+		}
+		signer = priv
+	}
+
+	// 2. Ask for the new certificate under the same name
+	current, err := os.ReadFile(node.CertFile)
+	if err != nil {
+		return fmt.Errorf("failed to read current certificate: %w", err)
+	}
+	cert, err := crypto.ParseCertificate(current)
+	if err != nil {
+		return err
+	}
+
+	csrPEM, err := crypto.GenerateCSR(signer, cert.Subject.CommonName)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	httpClient, err := crypto.NewMTLSClient(node.CertFile, node.KeyFile, node.CAFile)
+	if err != nil {
+		return err
+	}
+	res, err := api.NewClient(httpClient, fmt.Sprintf("%s:%d", node.Address, node.Port)).Renew(csrPEM)
+	if err != nil {
+		return fmt.Errorf("renewal failed: %w", err)
+	}
+
+	// 3. Make sure the engine certified our key under the CA bundle it returned. The answer came
+	//    over a connection verified against the pinned CA, so after a CA rotation the bundle
+	//    holding the new CA is pinned in its place.
+	caPEM, err := os.ReadFile(node.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read pinned engine CA: %w", err)
+	}
+	bundle := []byte(res.CACertificate)
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("engine returned an invalid CA certificate")
+	}
+
+	renewed, err := crypto.ParseCertificate([]byte(res.Certificate))
+	if err != nil {
+		return err
+	}
+	if pub, ok := renewed.PublicKey.(ed25519.PublicKey); !ok || !pub.Equal(signer.Public()) {
+		return fmt.Errorf("renewed certificate does not match the requested key")
+	}
+	if _, err := renewed.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		return fmt.Errorf("renewed certificate is not issued by the engine CA: %w", err)
+	}
+
+	// 4. Pin the CA bundle first. The old certificate keeps working until the new one is used,
+	//    and the new pin still holds the previous CA during a rotation, so an interrupted swap
+	//    can be finished by renewing again.
+	if !bytes.Equal(bytes.TrimSpace(caPEM), bytes.TrimSpace(bundle)) {
+		if err := os.WriteFile(node.CAFile+".new", bundle, 0644); err != nil {
+			return fmt.Errorf("failed to save engine CA: %w", err)
+		}
+		if err := os.Rename(node.CAFile+".new", node.CAFile); err != nil {
+			return fmt.Errorf("failed to pin the new engine CA: %w", err)
+		}
+		fmt.Printf("[✓] Pinned the new engine CA for %s.\n", node.Name)
+	}
+
+	// 5. Stage the certificate and key, then install the certificate followed by its key. If the
+	//    key cannot follow, the previous certificate is put back, so the console is never left
+	//    with a mismatched pair and renewing again starts from a working identity.
+	certTmp, keyTmp := node.CertFile+".new", node.KeyFile+".new"
+	if err := os.WriteFile(certTmp, []byte(res.Certificate), 0644); err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+	if rotate {
+		if err := saveKey(keyTmp, priv); err != nil {
+			os.Remove(certTmp)
+			return err
+		}
+	}
+
+	if err := os.Rename(certTmp, node.CertFile); err != nil {
+		os.Remove(certTmp)
+		os.Remove(keyTmp)
+		return fmt.Errorf("failed to install certificate: %w", err)
+	}
+	if rotate {
+		if err := os.Rename(keyTmp, node.KeyFile); err != nil {
+			os.Remove(keyTmp)
+			if restoreErr := restoreFile(node.CertFile, current); restoreErr != nil {
+				return fmt.Errorf("failed to install new key (%v) and to restore the previous certificate: %w", err, restoreErr)
+			}
+			return fmt.Errorf("failed to install new key, kept the previous certificate: %w", err)
+		}
+	}
+
+	fmt.Printf("[✓] Certificate for %s renewed, valid until %s.\n", node.Name, renewed.NotAfter.Local().Format("2006-01-02"))
+	return nil
+}
+
+// restoreFile writes data to path through a rename, so path is never left half-written.
+func restoreFile(path string, data []byte) error {
+	tmp := path + ".old"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
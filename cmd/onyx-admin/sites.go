@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"onyx/internal/api"
+
+	"github.com/spf13/cobra"
+)
+
+var sitesCmd = &cobra.Command{
+	Use:   "sites",
+	Short: "Manage the reverse-proxy sites an engine serves",
+	Long: `Sites added here are kept by the engine next to its Caddyfile and applied to the running
+proxy immediately, without a reload. Hosts already configured in the Caddyfile cannot be
+managed this way. Listing requires the viewer role; changes require operator.`,
+}
+
+var sitesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the managed sites",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		sites, err := client.ListSites()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(sites) == 0 {
+			fmt.Printf("No managed sites on %s.\n", node.Name)
+			return
+		}
+
+		fmt.Printf("Sites managed on %s (%s):\n\n", node.Name, node.Address)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tUPSTREAMS\tBALANCING\tWAF\tALLOW\tUPDATED\tBY")
+		for _, s := range sites {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Host, strings.Join(s.Upstreams, ", "), balancingLabel(s.LoadBalancing), wafLabel(s.WAF), allowLabel(s.Allow),
+				s.UpdatedAt.Local().Format("2006-01-02 15:04"), shortFingerprint(s.UpdatedBy))
+		}
+		tw.Flush()
+	},
+}
+
+var sitesAddCmd = &cobra.Command{
+	Use:   "add <host>",
+	Short: "Proxy a new host to one or more upstreams",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := api.SiteRequest{Host: args[0]}
+		siteFlags(cmd, &req)
+
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		site, err := client.AddSite(req)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] %s is now served by %s, proxying to %s.\n", site.Host, node.Name, strings.Join(site.Upstreams, ", "))
+	},
+}
+
+var sitesUpdateCmd = &cobra.Command{
+	Use:   "update <host>",
+	Short: "Change the settings of a managed site",
+	Long: `Only the settings given as flags change; the others keep their current values.
+Pass --allow "" to let everyone in again, --health-path "" or --max-fails 0 to turn
+health checks off.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		current, err := client.GetSite(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		req := api.SiteRequest{
+			Upstreams:     current.Upstreams,
+			WAF:           current.WAF,
+			Allow:         current.Allow,
+			LoadBalancing: current.LoadBalancing,
+			HealthChecks:  current.HealthChecks,
+		}
+		siteFlags(cmd, &req)
+
+		site, err := client.UpdateSite(current.Host, req)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] %s on %s now proxies to %s (WAF %s, allowing %s).\n", site.Host, node.Name,
+			strings.Join(site.Upstreams, ", "), wafLabel(site.WAF), allowLabel(site.Allow))
+		fmt.Printf("    Load balancing: %s. Health checks: %s.\n", balancingLabel(site.LoadBalancing), healthLabel(site.HealthChecks))
+	},
+}
+
+var sitesRemoveCmd = &cobra.Command{
+	Use:   "remove <host>",
+	Short: "Stop serving a managed site",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, node, err := connectNode(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		site, err := client.RemoveSite(args[0])
+		if reportPending(err, node.Name) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] %s is no longer served by %s.\n", site.Host, node.Name)
+	},
+}
+
+// siteFlags copies the site settings given as flags into req, leaving the others alone.
+func siteFlags(cmd *cobra.Command, req *api.SiteRequest) {
+	f := cmd.Flags()
+	if f.Changed("upstream") {
+		req.Upstreams, _ = f.GetStringSlice("upstream")
+	}
+	if f.Changed("waf") {
+		req.WAF, _ = f.GetString("waf")
+	}
+	if f.Changed("allow") {
+		req.Allow, _ = f.GetStringSlice("allow")
+	}
+
+	lb, hc := &req.LoadBalancing, &req.HealthChecks
+	if f.Changed("lb-policy") {
+		lb.Policy, _ = f.GetString("lb-policy")
+	}
+	if f.Changed("retries") {
+		lb.Retries, _ = f.GetInt("retries")
+	}
+	if f.Changed("try-duration") {
+		lb.TryDuration, _ = f.GetString("try-duration")
+	}
+	if f.Changed("health-path") {
+		hc.Path, _ = f.GetString("health-path")
+	}
+	if f.Changed("health-interval") {
+		hc.Interval, _ = f.GetString("health-interval")
+	}
+	if f.Changed("health-timeout") {
+		hc.Timeout, _ = f.GetString("health-timeout")
+	}
+	if f.Changed("health-status") {
+		hc.ExpectStatus, _ = f.GetInt("health-status")
+	}
+	if f.Changed("max-fails") {
+		hc.MaxFails, _ = f.GetInt("max-fails")
+	}
+	if f.Changed("fail-duration") {
+		hc.FailDuration, _ = f.GetString("fail-duration")
+	}
+	if f.Changed("unhealthy-status") {
+		hc.UnhealthyStatus, _ = f.GetIntSlice("unhealthy-status")
+	}
+
+	// Turning a check off drops the settings that only mean something with it on
+	if f.Changed("health-path") && hc.Path == "" {
+		hc.Interval, hc.Timeout, hc.ExpectStatus = "", "", 0
+	}
+	if f.Changed("max-fails") && hc.MaxFails == 0 {
+		hc.FailDuration, hc.UnhealthyStatus = "", nil
+	}
+}
+
+// balancingLabel describes a site's load balancing for humans.
+func balancingLabel(lb api.LoadBalancing) string {
+	label := lb.Policy
+	if label == api.LBRandom {
+		label = "random"
+	}
+	if lb.Retries > 0 {
+		label += fmt.Sprintf(", %d retries", lb.Retries)
+	}
+	if lb.TryDuration != "" {
+		label += ", retrying for " + lb.TryDuration
+	}
+	return label
+}
+
+// healthLabel describes a site's health checks for humans.
+func healthLabel(hc api.HealthChecks) string {
+	var checks []string
+	if hc.Path != "" {
+		active := "GET " + hc.Path
+		if hc.Interval != "" {
+			active += " every " + hc.Interval
+		}
+		if hc.ExpectStatus != 0 {
+			active += fmt.Sprintf(" expecting %d", hc.ExpectStatus)
+		}
+		checks = append(checks, active)
+	}
+	if hc.MaxFails > 0 {
+		passive := fmt.Sprintf("down after %d fails", hc.MaxFails)
+		if hc.FailDuration != "" {
+			passive += " in " + hc.FailDuration
+		}
+		if len(hc.UnhealthyStatus) > 0 {
+			passive += fmt.Sprintf(" (counting %s)", strings.Trim(fmt.Sprint(hc.UnhealthyStatus), "[]"))
+		}
+		checks = append(checks, passive)
+	}
+	if len(checks) == 0 {
+		return "off"
+	}
+	return strings.Join(checks, "; ")
+}
+
+// wafLabel describes a site's WAF mode for humans.
+func wafLabel(mode string) string {
+	if mode == api.WAFOff {
+		return "off"
+	}
+	return mode
+}
+
+// allowLabel describes a site's allowed client ranges for humans.
+func allowLabel(allow []string) string {
+	if len(allow) == 0 {
+		return "everyone"
+	}
+	return strings.Join(allow, ", ")
+}
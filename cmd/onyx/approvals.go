@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/engine"
+
+	"github.com/spf13/cobra"
+)
+
+var approvalsCmd = &cobra.Command{
+	Use:   "approvals",
+	Short: "Require a second owner to approve destructive control-plane actions",
+	Long: `With the policy enabled, revoking a console, rotating the CA or removing a site through the
+control plane only proposes the change. It is carried out once a different owner approves it with
+'onyx-admin changes approve' within the window. Commands run on this host are not affected.`,
+}
+
+var approvalsStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether two-person approval is required",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		policy, err := engine.LoadApprovalPolicy(engine.ApprovalPolicyPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		printApprovalPolicy(policy)
+	},
+}
+
+var approvalsEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Require a second owner's approval for destructive control-plane actions",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		window, _ := cmd.Flags().GetDuration("window")
+		setApprovalPolicy(api.ApprovalPolicy{Enabled: true, Window: window.String()})
+	},
+}
+
+var approvalsDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Let any owner carry out destructive actions alone",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		policy, err := engine.LoadApprovalPolicy(engine.ApprovalPolicyPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		policy.Enabled = false
+		setApprovalPolicy(policy)
+	},
+}
+
+// setApprovalPolicy saves policy, which the engine reads on every guarded request, and audits the change.
+func setApprovalPolicy(policy api.ApprovalPolicy) {
+	err := engine.SaveApprovalPolicy(engine.ApprovalPolicyPath, policy)
+
+	entry := api.AuditEntry{Actor: "local", Role: api.RoleOwner, Action: "approval.policy", Target: "disabled"}
+	if policy.Enabled {
+		entry.Target = "enabled, window " + policy.Window
+	}
+	if err != nil {
+		entry.Result, entry.Detail = api.AuditFailed, err.Error()
+	}
+	if audit, openErr := engine.OpenAuditLog(engine.AuditPath); openErr != nil {
+		fmt.Printf("Warning: this change could not be audited: %v\n", openErr)
+	} else {
+		audit.Record(entry)
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("[✓] Approval policy saved.")
+	printApprovalPolicy(policy)
+}
+
+func printApprovalPolicy(p api.ApprovalPolicy) {
+	if !p.Enabled {
+		fmt.Println("Two-person approval: disabled")
+		return
+	}
+	window, _ := time.ParseDuration(p.Window)
+	fmt.Println("Two-person approval: enabled")
+	fmt.Printf("Approval window:     %s\n", window)
+	fmt.Println("Applies to:          client revocation, CA rotation and site removal through the control plane")
+}
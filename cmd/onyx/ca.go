@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/engine"
+
+	"github.com/spf13/cobra"
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Inspect and rotate the certificate authority admin consoles trust",
+}
+
+var caStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the engine CA and any rotation in progress",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := authorityStatus()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		printAuthority(status)
+	},
+}
+
+var caRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the engine CA, trusting the previous one for an overlap period",
+	Long: `Creates a new CA that issues every certificate from now on. The previous CA stays trusted,
+and keeps signing the engine's server certificate, until the overlap ends. Consoles that
+connect in the meantime are moved to the new CA automatically; the previous CA is then
+retired without further action.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		overlap, _ := cmd.Flags().GetDuration("overlap")
+		if overlap <= 0 {
+			fmt.Println("Error: --overlap must be positive")
+			os.Exit(1)
+		}
+
+		status, err := rotateAuthority(overlap)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("[✓] Engine CA rotated.")
+		printAuthority(status)
+	},
+}
+
+// authorityStatus asks the running engine for its CA status, or reads it from disk when stopped.
+func authorityStatus() (*api.CAStatus, error) {
+	if engineRunning() {
+		status, err := api.NewLocalClient(socketPath).Status()
+		if err != nil {
+			return nil, err
+		}
+		return &status.Authority, nil
+	}
+
+	ca, err := engine.LoadOrCreateAuthority(engine.AuthDir)
+	if err != nil {
+		return nil, err
+	}
+	reg, _, err := engine.OpenClients(ca)
+	if err != nil {
+		return nil, err
+	}
+	status, err := engine.DescribeAuthority(ca, reg)
+	return &status, err
+}
+
+// rotateAuthority rotates through the running engine so it switches immediately, or on disk
+// when the engine is stopped, re-signing the CRL under the new CA.
+func rotateAuthority(overlap time.Duration) (*api.CAStatus, error) {
+	if engineRunning() {
+		return api.NewLocalClient(socketPath).RotateCA(overlap)
+	}
+
+	ca, err := engine.RotateAuthority(engine.AuthDir, overlap)
+	auditLocal("ca.rotate", "overlap "+overlap.String(), err)
+	if err != nil {
+		return nil, err
+	}
+	reg, crl, err := engine.OpenClients(ca)
+	if err != nil {
+		return nil, err
+	}
+	if err := crl.SetAuthority(ca); err != nil {
+		return nil, err
+	}
+	status, err := engine.DescribeAuthority(ca, reg)
+	return &status, err
+}
+
+func printAuthority(s *api.CAStatus) {
+	fmt.Printf("CA fingerprint:  SHA256:%s\n", s.Fingerprint)
+	fmt.Printf("Key ID:          %s\n", s.KeyID)
+	fmt.Printf("Expires:         %s\n", formatTime(s.ExpiresAt))
+
+	rot := s.Rotation
+	if rot == nil {
+		fmt.Println("Rotation:        none in progress")
+		return
+	}
+	fmt.Printf("Rotation:        started %s\n", formatTime(rot.StartedAt))
+	fmt.Printf("Previous CA:     SHA256:%s\n", rot.PreviousFingerprint)
+	fmt.Printf("Retires:         %s\n", formatTime(rot.RetiresAt))
+	fmt.Printf("Still on it:     %d active console(s)\n", rot.ClientsOnPrevious)
+	if rot.ClientsOnPrevious > 0 {
+		fmt.Println("\nConsoles move over the next time they connect; any left at retirement must pair again.")
+	}
+}
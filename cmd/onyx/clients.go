@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/engine"
+
+	"github.com/spf13/cobra"
+)
+
+// clientStore is the part of the client registry the CLI needs. It is served by the running
+// engine over the local socket, or by the registry on disk when the engine is stopped.
+type clientStore interface {
+	List() ([]api.ClientInfo, error)
+	Get(fingerprint string) (*api.ClientInfo, error)
+	Rename(fingerprint, name string) (*api.ClientInfo, error)
+	Revoke(fingerprint string) (*api.ClientInfo, error)
+}
+
+// engineClients adapts the engine API to clientStore.
+type engineClients struct {
+	c *api.Client
+}
+
+func (e engineClients) List() ([]api.ClientInfo, error) {
+	return e.c.ListClients()
+}
+
+func (e engineClients) Get(fp string) (*api.ClientInfo, error) {
+	return e.c.GetClient(fp)
+}
+
+func (e engineClients) Rename(fp, name string) (*api.ClientInfo, error) {
+	return e.c.RenameClient(fp, name)
+}
+
+func (e engineClients) Revoke(fp string) (*api.ClientInfo, error) {
+	return e.c.RevokeClient(fp)
+}
+
+// openClients prefers the running engine so changes apply immediately, and falls back to
+// editing the registry directly when nothing is listening on the socket.
+func openClients() clientStore {
+	if engineRunning() {
+		return engineClients{api.NewLocalClient(socketPath)}
+	}
+
+	ca, err := engine.LoadOrCreateAuthority(engine.AuthDir)
+	if err != nil {
+		fmt.Printf("Error: engine is not running and its CA could not be loaded: %v\n", err)
+		os.Exit(1)
+	}
+
+	reg, _, err := engine.OpenClients(ca)
+	if err != nil {
+		fmt.Printf("Error: engine is not running and the client registry could not be opened: %v\n", err)
+		os.Exit(1)
+	}
+	return offlineClients{reg}
+}
+
+// offlineClients edits the registry on disk and audits each change, as the engine would.
+type offlineClients struct {
+	*engine.Registry
+}
+
+func (o offlineClients) Rename(fp, name string) (*api.ClientInfo, error) {
+	info, err := o.Registry.Rename(fp, name)
+	auditLocal("client.rename", clientTarget(fp, info), err)
+	return info, err
+}
+
+func (o offlineClients) Revoke(fp string) (*api.ClientInfo, error) {
+	info, err := o.Registry.Revoke(fp)
+	auditLocal("client.revoke", clientTarget(fp, info), err)
+	return info, err
+}
+
+func clientTarget(ref string, info *api.ClientInfo) string {
+	if info != nil {
+		return info.Fingerprint
+	}
+	return ref
+}
+
+// auditLocal records a change made on disk while the engine was stopped.
+func auditLocal(action, target string, err error) {
+	audit, openErr := engine.OpenAuditLog(engine.AuditPath)
+	if openErr != nil {
+		fmt.Printf("Warning: this change could not be audited: %v\n", openErr)
+		return
+	}
+
+	entry := api.AuditEntry{Actor: "local", Role: api.RoleOwner, Action: action, Target: target, Detail: "engine stopped"}
+	if err != nil {
+		entry.Result, entry.Detail = api.AuditFailed, "engine stopped: "+err.Error()
+	}
+	audit.Record(entry)
+}
+
+// engineRunning reports whether an engine answers on the local control socket.
+func engineRunning() bool {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+var clientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "Manage the admin consoles paired with this engine",
+}
+
+var clientsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List paired admin consoles",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		clients, err := openClients().List()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(clients) == 0 {
+			fmt.Println("No admin consoles are paired. Use 'onyx --pair' to add one.")
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FINGERPRINT\tNAME\tROLE\tISSUED\tEXPIRES\tLAST USED\tSTATUS")
+		for _, c := range clients {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				c.Fingerprint[:16], c.Name, c.Role,
+				formatDate(c.IssuedAt), formatDate(c.ExpiresAt), formatDate(c.LastUsed), c.Status())
+		}
+		tw.Flush()
+	},
+}
+
+var clientsShowCmd = &cobra.Command{
+	Use:   "show <fingerprint>",
+	Short: "Show the details of one admin console",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := openClients().Get(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Fingerprint:  SHA256:%s\n", c.Fingerprint)
+		fmt.Printf("Name:         %s\n", c.Name)
+		fmt.Printf("Common name:  %s\n", c.CommonName)
+		fmt.Printf("Role:         %s\n", c.Role)
+		fmt.Printf("Serial:       %s\n", c.Serial)
+		fmt.Printf("Issued:       %s\n", formatTime(c.IssuedAt))
+		fmt.Printf("Expires:      %s\n", formatTime(c.ExpiresAt))
+		fmt.Printf("Last used:    %s\n", formatTime(c.LastUsed))
+		fmt.Printf("Status:       %s\n", c.Status())
+		if c.InvitedBy != "" {
+			fmt.Printf("Invited by:   %s\n", c.InvitedBy)
+		}
+		if c.RenewedFrom != "" {
+			fmt.Printf("Renewed from: %s\n", c.RenewedFrom)
+		}
+		if c.ReplacedBy != "" {
+			fmt.Printf("Replaced by:  %s\n", c.ReplacedBy)
+		}
+		if c.Revoked {
+			fmt.Printf("Revoked:      %s\n", formatTime(c.RevokedAt))
+		}
+	},
+}
+
+var clientsRenameCmd = &cobra.Command{
+	Use:   "rename <fingerprint> <name>",
+	Short: "Give an admin console a recognisable name",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := openClients().Rename(args[0], args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] Client %s is now named %q.\n", c.Fingerprint[:16], c.Name)
+	},
+}
+
+var clientsRevokeCmd = &cobra.Command{
+	Use:   "revoke <fingerprint>",
+	Short: "Permanently withdraw an admin console's access",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := openClients().Revoke(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[✓] Client %s (%s) has been revoked.\n", c.Name, c.Fingerprint[:16])
+	},
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02")
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05 MST")
+}
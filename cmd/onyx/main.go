@@ -4,19 +4,27 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strings"
 
 	_ "github.com/caddy-dns/ovh"
 	_ "github.com/caddyserver/caddy/v2/modules/standard"
 	_ "github.com/corazawaf/coraza-caddy/v2"
 
+	"onyx/internal/api"
 	"onyx/internal/engine"
 
 	"github.com/spf13/cobra"
 )
 
 var pairMode bool
+var pairingOpts = engine.DefaultPairingOptions()
+var tokenFile string
+var pairRole string
+var caddyfilePath string
+var socketPath string
+var controlAddr string
 var version = "dev" // Default for local builds without tags
 
 var rootCmd = &cobra.Command{
@@ -26,32 +34,188 @@ var rootCmd = &cobra.Command{
 access to internal services using Mutual TLS (mTLS).`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if pairMode {
-			runPairing()
+			runPairing(cmd)
 			return
 		}
 
-		// Normal engine startup would go here
-		fmt.Println("Onyx Engine starting")
+		for _, name := range []string{"bind", "port", "window", "clients", "token-file", "json", "accept-sas", "role"} {
+			if cmd.Flags().Changed(name) {
+				fmt.Fprintf(os.Stderr, "Error: --%s only applies with --pair\n", name)
+				os.Exit(1)
+			}
+		}
+
+		runEngine()
+	},
+}
+
+// runEngine starts the data plane and blocks until the process is signalled to stop.
+func runEngine() {
+	fmt.Printf("Onyx Engine %s starting\n", version)
+
+	e := engine.New(engine.Options{
+		Version:     version,
+		Caddyfile:   caddyfilePath,
+		SocketPath:  socketPath,
+		ControlAddr: controlAddr,
+	})
+
+	if err := e.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// validateConfigCmd provisions a config read from stdin on behalf of a running engine's
+// validation endpoint.
+var validateConfigCmd = &cobra.Command{
+	Use:    engine.ValidateCommand,
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(engine.RunValidator(os.Stdin, os.Stdout))
+	},
+}
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Validate the Caddyfile and hot-swap it into the running engine",
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := api.NewLocalClient(socketPath).Reload()
+		if err != nil {
+			fmt.Printf("Error: could not reach the engine: %v\n", err)
+			os.Exit(1)
+		}
+
+		if !res.Success {
+			fmt.Printf("Reload failed: %s\n", res.Error)
+			os.Exit(1)
+		}
+		fmt.Println("[✓] Configuration reloaded.")
 	},
 }
 
-// runPairing handles the secure bootstrapping of a new admin client.
-func runPairing() {
-	token, err := engine.GeneratePairingToken()
+// Exit codes of `onyx --pair`, so provisioning tools can tell outcomes apart.
+const (
+	exitPairingError   = 1 // Bad flags, unreadable token, listener failure
+	exitPairingExpired = 2 // The window expired before every client paired
+	exitPairingClosed  = 3 // The window was closed early (lockout or rejection)
+)
+
+// runPairing handles the secure bootstrapping of a new admin client. While the engine runs, its
+// control plane holds the window, unless a listener of its own was asked for with --bind or --port.
+func runPairing(cmd *cobra.Command) {
+	if pairingOpts.MaxClients < 1 || pairingOpts.Window <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: --clients must be at least 1 and --window must be positive")
+		os.Exit(exitPairingError)
+	}
+
+	role, err := api.ParseRole(pairRole)
 	if err != nil {
-		log.Fatalf("Failed to generate secure token: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: --role: %v\n", err)
+		os.Exit(exitPairingError)
+	}
+	pairingOpts.Role = role
+
+	if pairingOpts.JSON && !pairingOpts.AcceptSAS {
+		fmt.Fprintln(os.Stderr, "Error: --json cannot confirm verification codes; add --accept-sas to pair without an operator comparing them")
+		os.Exit(exitPairingError)
+	}
+	if pairingOpts.AcceptSAS && !pairingOpts.JSON {
+		fmt.Fprintln(os.Stderr, "Error: --accept-sas only applies with --json; interactive pairing always asks the operator")
+		os.Exit(exitPairingError)
 	}
 
-	fmt.Println("--------------------------------------------------")
-	fmt.Println("ONYX BOOTSTRAP MODE")
-	fmt.Println("--------------------------------------------------")
-	fmt.Println("Use this mode to pair a new admin console via SSH.")
+	hosted := engineRunning() && !cmd.Flags().Changed("bind") && !cmd.Flags().Changed("port")
 
-	engine.StartPairingMode(token)
+	var ca *engine.Authority
+	if !hosted {
+		if ca, err = engine.LoadOrCreateAuthority(engine.AuthDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load engine CA: %v\n", err)
+			os.Exit(exitPairingError)
+		}
+	}
+
+	token, err := pairingToken()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to obtain pairing token: %v\n", err)
+		os.Exit(exitPairingError)
+	}
+
+	if !pairingOpts.JSON {
+		fmt.Println("--------------------------------------------------")
+		fmt.Println("ONYX BOOTSTRAP MODE")
+		fmt.Println("--------------------------------------------------")
+		fmt.Println("Use this mode to pair a new admin console via SSH.")
+		if hosted {
+			fmt.Println("The running engine accepts the token on its control plane.")
+		}
+	}
+
+	var outcome engine.PairingOutcome
+	if hosted {
+		outcome, err = engine.HostPairingMode(api.NewLocalClient(socketPath), token, pairingOpts, os.Stdin, os.Stdout, os.Stderr)
+	} else {
+		outcome, err = engine.StartPairingMode(token, ca, pairingOpts, engine.DefaultPairingPaths(), os.Stdin, os.Stdout, os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitPairingError)
+	}
+
+	switch outcome {
+	case engine.PairingExpired:
+		os.Exit(exitPairingExpired)
+	case engine.PairingClosed:
+		os.Exit(exitPairingClosed)
+	}
+}
+
+// pairingToken returns the token given with --token-file ("-" for stdin), or a freshly generated one.
+func pairingToken() (string, error) {
+	if tokenFile == "" {
+		return engine.GeneratePairingToken()
+	}
+
+	var data []byte
+	var err error
+	if tokenFile == "-" {
+		data, err = io.ReadAll(io.LimitReader(os.Stdin, 1024))
+	} else {
+		data, err = os.ReadFile(tokenFile)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if len(token) < 8 {
+		return "", fmt.Errorf("token must be at least 8 characters")
+	}
+	return token, nil
 }
 
 func main() {
 	rootCmd.Flags().BoolVarP(&pairMode, "pair", "p", false, "Enable temporary pairing mode for new admin consoles")
+	rootCmd.Flags().StringVar(&pairingOpts.BindAddr, "bind", "", "Pairing: address to listen on instead of the running engine's control plane (default all interfaces)")
+	rootCmd.Flags().IntVar(&pairingOpts.Port, "port", pairingOpts.Port, "Pairing: port to listen on instead of the running engine's control plane")
+	rootCmd.Flags().DurationVar(&pairingOpts.Window, "window", pairingOpts.Window, "Pairing: how long the window stays open")
+	rootCmd.Flags().IntVar(&pairingOpts.MaxClients, "clients", pairingOpts.MaxClients, "Pairing: number of admins that may pair with the token")
+	rootCmd.Flags().StringVar(&tokenFile, "token-file", "", "Pairing: read the token from a file ('-' for stdin) instead of generating one")
+	rootCmd.Flags().StringVar(&pairRole, "role", string(pairingOpts.Role), "Pairing: role granted to admins paired with this token (viewer, operator, owner)")
+	rootCmd.Flags().BoolVar(&pairingOpts.JSON, "json", false, "Pairing: non-interactive; print the token, expiry and verification codes as JSON (needs --accept-sas)")
+	rootCmd.Flags().BoolVar(&pairingOpts.AcceptSAS, "accept-sas", false, "Pairing: with --json, accept verification codes without an operator comparing them")
+	rootCmd.PersistentFlags().StringVarP(&caddyfilePath, "config", "c", engine.DefaultCaddyfile, "Path to the Caddyfile")
+	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", engine.DefaultSocket, "Path to the engine control socket")
+
+	rootCmd.Flags().StringVar(&controlAddr, "listen", engine.DefaultControlAddr, "Address of the mTLS control plane")
+
+	clientsCmd.AddCommand(clientsListCmd, clientsShowCmd, clientsRenameCmd, clientsRevokeCmd)
+	caRotateCmd.Flags().Duration("overlap", engine.DefaultRotationOverlap, "How long the previous CA stays trusted")
+	caCmd.AddCommand(caStatusCmd, caRotateCmd)
+	approvalsEnableCmd.Flags().Duration("window", engine.DefaultApprovalWindow, "How long a proposed change waits for a second owner")
+	approvalsCmd.AddCommand(approvalsStatusCmd, approvalsEnableCmd, approvalsDisableCmd)
+	rootCmd.AddCommand(reloadCmd, clientsCmd, caCmd, approvalsCmd, validateConfigCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
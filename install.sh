@@ -73,6 +73,8 @@ chmod 750 "$CONFIG_DIR"
 if [ ! -f "$CONFIG_DIR/Caddyfile" ]; then
     curl -sSL -o "$CONFIG_DIR/Caddyfile" "https://raw.githubusercontent.com/$REPO/main/exampleCaddyfile"
 fi
+# The engine only reads the Caddyfile; rollbacks are saved under /var/lib/onyx instead
+chmod 640 "$CONFIG_DIR/Caddyfile"
 
 # Logs/State: onyx owns it
 chown -R onyx:onyx "/var/lib/onyx"
@@ -0,0 +1,233 @@
+// Package agent implements the onyx-admin key agent. Like ssh-agent, it holds decrypted private
+// keys in memory for a limited time and signs on behalf of onyx-admin over a unix socket that
+// only the owning user can reach, so passphrase-protected keys never touch disk in the clear.
+package agent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SocketEnv overrides the agent socket location, for both the agent and its clients.
+const SocketEnv = "ONYX_AGENT_SOCK"
+
+// maxMessage bounds a single request; a TLS 1.3 handshake transcript signature input is tiny.
+const maxMessage = 64 << 10
+
+// request is a single call to the agent. Each connection carries one request and one response.
+type request struct {
+	Op   string `json:"op"`             // "list" or "sign"
+	Key  string `json:"key,omitempty"`  // Base64 public key selecting the signing key
+	Data string `json:"data,omitempty"` // Base64 message to sign
+}
+
+type response struct {
+	Keys      []string `json:"keys,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// DefaultSocket returns where the agent listens: $ONYX_AGENT_SOCK, else a per-user path under
+// $XDG_RUNTIME_DIR, else a per-user directory in the system temp dir.
+func DefaultSocket() string {
+	if path := os.Getenv(SocketEnv); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "onyx-admin", "agent.sock")
+	}
+	return filepath.Join(os.TempDir(), "onyx-admin-"+strconv.Itoa(os.Getuid()), "agent.sock")
+}
+
+// Serve holds keys on a unix socket at path until ctx ends, then wipes them and returns.
+// The caller bounds the agent's lifetime through ctx. Only processes running as the same
+// user may connect.
+func Serve(ctx context.Context, path string, keys []ed25519.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create agent directory: %w", err)
+	}
+
+	// Refuse to replace a socket that another agent is still serving
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("an agent is already listening on %s", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to open agent socket: %w", err)
+	}
+	defer os.Remove(path)
+
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict agent socket: %w", err)
+	}
+
+	a := &agent{keys: make(map[string]ed25519.PrivateKey)}
+	for _, k := range keys {
+		a.keys[encodeKey(k.Public().(ed25519.PublicKey))] = k
+	}
+
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			a.wipe()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go a.handle(conn.(*net.UnixConn))
+	}
+}
+
+type agent struct {
+	mu   sync.Mutex
+	keys map[string]ed25519.PrivateKey
+}
+
+func (a *agent) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := checkPeer(conn); err != nil {
+		log.Printf("Rejected agent connection: %v", err)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(io.LimitReader(conn, maxMessage)).Decode(&req); err != nil {
+		return
+	}
+
+	json.NewEncoder(conn).Encode(a.serve(req))
+}
+
+func (a *agent) serve(req request) response {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch req.Op {
+	case "list":
+		var res response
+		for pub := range a.keys {
+			res.Keys = append(res.Keys, pub)
+		}
+		return res
+
+	case "sign":
+		priv, ok := a.keys[req.Key]
+		if !ok {
+			return response{Error: "key not held by this agent"}
+		}
+		data, err := base64.StdEncoding.DecodeString(req.Data)
+		if err != nil {
+			return response{Error: "malformed data"}
+		}
+		return response{Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))}
+	}
+
+	return response{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+}
+
+// wipe overwrites every key held by the agent.
+func (a *agent) wipe() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for pub, k := range a.keys {
+		clear(k)
+		delete(a.keys, pub)
+	}
+}
+
+// Signer signs with a key held by the agent. It satisfies crypto.Signer, so it can stand in for
+// the private key of a tls.Certificate.
+type Signer struct {
+	socket string
+	pub    ed25519.PublicKey
+}
+
+// NewSigner returns a signer for pub if the agent at socket holds the matching key.
+func NewSigner(socket string, pub ed25519.PublicKey) (*Signer, error) {
+	res, err := call(socket, request{Op: "list"})
+	if err != nil {
+		return nil, err
+	}
+
+	want := encodeKey(pub)
+	for _, k := range res.Keys {
+		if k == want {
+			return &Signer{socket: socket, pub: pub}, nil
+		}
+	}
+	return nil, fmt.Errorf("the agent does not hold this key; restart 'onyx-admin agent'")
+}
+
+// Public returns the public key of the agent-held key.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign asks the agent to sign message. Ed25519 signs the message itself, so opts must not
+// request a pre-hash.
+func (s *Signer) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts != nil && opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("agent keys only support pure Ed25519 signatures")
+	}
+
+	res, err := call(s.socket, request{
+		Op:   "sign",
+		Key:  encodeKey(s.pub),
+		Data: base64.StdEncoding.EncodeToString(message),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Signature)
+}
+
+// call sends one request to the agent and returns its response.
+func call(socket string, req request) (*response, error) {
+	conn, err := net.DialTimeout("unix", socket, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("no onyx-admin agent is running (start one with 'onyx-admin agent'): %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var res response
+	if err := json.NewDecoder(io.LimitReader(conn, maxMessage)).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid response from agent: %w", err)
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("agent: %s", res.Error)
+	}
+	return &res, nil
+}
+
+func encodeKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
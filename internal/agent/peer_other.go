@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// checkPeer refuses every connection on platforms where the agent cannot learn who is
+// connecting, so the socket's permissions are never the only guard on the keys.
+func checkPeer(conn *net.UnixConn) error {
+	return fmt.Errorf("the key agent is not supported on %s", runtime.GOOS)
+}
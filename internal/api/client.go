@@ -0,0 +1,410 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Client is a thin JSON client for the engine API.
+type Client struct {
+	http    *http.Client
+	baseURL string
+}
+
+// NewClient creates a client for a remote engine reachable at address ("host:port").
+// The http.Client is expected to carry the mTLS configuration for that engine.
+func NewClient(httpClient *http.Client, address string) *Client {
+	return &Client{
+		http:    httpClient,
+		baseURL: "https://" + address,
+	}
+}
+
+// NewLocalClient creates a client that talks to the engine over its local unix socket.
+// This is used by the `onyx` CLI on the engine host itself.
+func NewLocalClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return &Client{
+		http:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		baseURL: "http://onyx",
+	}
+}
+
+// Status fetches the engine health summary.
+func (c *Client) Status() (*Status, error) {
+	var res Status
+	if err := c.do(http.MethodGet, "/status", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Reload asks the engine to re-read and apply its Caddyfile.
+func (c *Client) Reload() (*ReloadResult, error) {
+	var res ReloadResult
+	if err := c.do(http.MethodPost, "/reload", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Renew exchanges the client's current certificate for a new one issued for csr.
+func (c *Client) Renew(csr []byte) (*RenewResponse, error) {
+	var res RenewResponse
+	if err := c.do(http.MethodPost, "/renew", RenewRequest{CSR: string(csr)}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListClients returns every admin client paired with the engine, including revoked ones.
+func (c *Client) ListClients() ([]ClientInfo, error) {
+	var res []ClientInfo
+	if err := c.do(http.MethodGet, "/clients", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetClient returns one client by fingerprint or unique fingerprint prefix.
+func (c *Client) GetClient(fingerprint string) (*ClientInfo, error) {
+	var res ClientInfo
+	if err := c.do(http.MethodGet, "/clients/"+url.PathEscape(fingerprint), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RenameClient changes the display name of a client.
+func (c *Client) RenameClient(fingerprint, name string) (*ClientInfo, error) {
+	var res ClientInfo
+	if err := c.do(http.MethodPatch, "/clients/"+url.PathEscape(fingerprint), RenameRequest{Name: name}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RevokeClient permanently withdraws a client's access to the engine.
+func (c *Client) RevokeClient(fingerprint string) (*ClientInfo, error) {
+	var res ClientInfo
+	if err := c.do(http.MethodPost, "/clients/"+url.PathEscape(fingerprint)+"/revoke", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RevokeAllClients withdraws the access of every client, including the caller, and returns them.
+func (c *Client) RevokeAllClients() ([]ClientInfo, error) {
+	var res []ClientInfo
+	if err := c.do(http.MethodPost, "/clients/revoke", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RotateCA replaces the engine CA, keeping the previous one trusted for overlap.
+func (c *Client) RotateCA(overlap time.Duration) (*CAStatus, error) {
+	var res CAStatus
+	if err := c.do(http.MethodPost, "/ca/rotate", RotateRequest{Overlap: overlap.String()}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Invite mints a one-time enrolment token for role, redeemable until ttl has passed.
+func (c *Client) Invite(role Role, ttl time.Duration) (*Invitation, error) {
+	var res Invitation
+	if err := c.do(http.MethodPost, "/invites", InviteRequest{Role: role, TTL: ttl.String()}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// OpenPairingWindow has the engine hold a pairing window on its control plane and calls event
+// for every event it streams, until the window closes. Closing the connection closes the window.
+func (c *Client) OpenPairingWindow(window PairingWindowRequest, event func(PairingEvent)) error {
+	data, err := json.Marshal(window)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/"+Version+"/pairing", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// The stream lasts as long as the window, past the client's usual timeout
+	streaming := *c.http
+	streaming.Timeout = 0
+	resp, err := streaming.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev PairingEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("engine ended the pairing window without closing it")
+			}
+			return fmt.Errorf("lost the pairing window: %w", err)
+		}
+		event(ev)
+		if ev.Type == PairingEventClosed {
+			return nil
+		}
+	}
+}
+
+// ConfirmPairing answers a "confirm" event of the pairing window id.
+func (c *Client) ConfirmPairing(id string, answer PairingConfirmation) error {
+	return c.do(http.MethodPost, "/pairing/"+url.PathEscape(id)+"/confirm", answer, nil)
+}
+
+// ListChanges returns the approval policy and the changes waiting for a second owner.
+func (c *Client) ListChanges() (*ChangeList, error) {
+	var res ChangeList
+	if err := c.do(http.MethodGet, "/changes", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ApproveChange approves and carries out a pending change proposed by another owner.
+func (c *Client) ApproveChange(id string) (*PendingChange, error) {
+	var res PendingChange
+	if err := c.do(http.MethodPost, "/changes/"+url.PathEscape(id)+"/approve", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RejectChange discards a pending change.
+func (c *Client) RejectChange(id string) (*PendingChange, error) {
+	var res PendingChange
+	if err := c.do(http.MethodPost, "/changes/"+url.PathEscape(id)+"/reject", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListSites returns the sites managed through the control plane.
+func (c *Client) ListSites() ([]Site, error) {
+	var res []Site
+	if err := c.do(http.MethodGet, "/sites", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetSite returns one managed site by host.
+func (c *Client) GetSite(host string) (*Site, error) {
+	var res Site
+	if err := c.do(http.MethodGet, "/sites/"+url.PathEscape(host), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AddSite creates the site described by req.
+func (c *Client) AddSite(req SiteRequest) (*Site, error) {
+	var res Site
+	if err := c.do(http.MethodPost, "/sites", req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UpdateSite replaces the settings of an existing site with req.
+func (c *Client) UpdateSite(host string, req SiteRequest) (*Site, error) {
+	req.Host = ""
+	var res Site
+	if err := c.do(http.MethodPut, "/sites/"+url.PathEscape(host), req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RemoveSite deletes a site; the engine stops serving it immediately.
+func (c *Client) RemoveSite(host string) (*Site, error) {
+	var res Site
+	if err := c.do(http.MethodDelete, "/sites/"+url.PathEscape(host), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SitesState returns the managed sites together with their ETag, which SyncSites can require
+// to be unchanged.
+func (c *Client) SitesState() ([]Site, string, error) {
+	var res []Site
+	header, err := c.send(http.MethodGet, "/sites", nil, nil, &res)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, header.Get("ETag"), nil
+}
+
+// SyncSites replaces every managed site with sites. With ifMatch set, the engine refuses if
+// its sites no longer have that ETag.
+func (c *Client) SyncSites(sites []SiteRequest, ifMatch string) ([]Site, error) {
+	header := http.Header{}
+	if ifMatch != "" {
+		header.Set("If-Match", ifMatch)
+	}
+	var res []Site
+	if _, err := c.send(http.MethodPut, "/sites", header, sites, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ConfigHistory lists the configurations the engine applied, newest first, without their contents.
+func (c *Client) ConfigHistory() ([]ConfigSnapshot, error) {
+	var res []ConfigSnapshot
+	if err := c.do(http.MethodGet, "/config/history", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ConfigSnapshot returns one configuration from the history, including its Caddyfile and sites.
+func (c *Client) ConfigSnapshot(id int) (*ConfigSnapshot, error) {
+	var res ConfigSnapshot
+	if err := c.do(http.MethodGet, "/config/history/"+strconv.Itoa(id), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RollbackConfig re-applies a configuration from the history and returns the snapshot it created.
+func (c *Client) RollbackConfig(id int) (*ConfigSnapshot, error) {
+	var res ConfigSnapshot
+	if err := c.do(http.MethodPost, "/config/history/"+strconv.Itoa(id)+"/rollback", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ValidateConfig asks the engine to check a Caddyfile with its own modules, without applying it.
+func (c *Client) ValidateConfig(filename string, caddyfile []byte) (*ValidateResult, error) {
+	var res ValidateResult
+	if err := c.do(http.MethodPost, "/config/validate", ValidateRequest{Filename: filename, Caddyfile: string(caddyfile)}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Audit returns the audit entries selected by q, oldest first.
+func (c *Client) Audit(q AuditQuery) (*AuditReport, error) {
+	params := url.Values{}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		params.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Actor != "" {
+		params.Set("actor", q.Actor)
+	}
+	if q.Action != "" {
+		params.Set("action", q.Action)
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	path := "/audit"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	var res AuditReport
+	if err := c.do(http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// do sends a JSON request to the versioned API and decodes the JSON response into out.
+func (c *Client) do(method, path string, in, out any) error {
+	_, err := c.send(method, path, nil, in, out)
+	return err
+}
+
+// send is do with extra request headers, returning the response headers.
+func (c *Client) send(method, path string, header http.Header, in, out any) (http.Header, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+"/"+Version+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// 202 means the engine queued the action for a second owner instead of doing it
+	if resp.StatusCode == http.StatusAccepted {
+		var pending ApprovalPendingError
+		if err := json.NewDecoder(resp.Body).Decode(&pending.Change); err != nil {
+			return nil, fmt.Errorf("engine queued the request but returned an unreadable change: %w", err)
+		}
+		return nil, &pending
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, statusError(resp)
+	}
+
+	if out == nil {
+		return resp.Header, nil
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// statusError describes a response the engine answered with an error status.
+func statusError(resp *http.Response) error {
+	var apiErr ErrorResponse
+	if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+		return fmt.Errorf("engine returned %s: %s", resp.Status, apiErr.Error)
+	}
+	return fmt.Errorf("engine returned %s", resp.Status)
+}
@@ -0,0 +1,40 @@
+package api
+
+import "fmt"
+
+// Role is the level of access the engine grants an admin client.
+// Roles are ordered: each one includes everything the roles below it may do.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // Read-only: status, dashboards, listings
+	RoleOperator Role = "operator" // Viewer, plus changes to the proxy configuration
+	RoleOwner    Role = "owner"    // Operator, plus managing other admins and the engine's identity
+)
+
+// Roles lists every role from least to most privileged.
+var Roles = []Role{RoleViewer, RoleOperator, RoleOwner}
+
+// ParseRole validates a role name.
+func ParseRole(s string) (Role, error) {
+	for _, r := range Roles {
+		if string(r) == s {
+			return r, nil
+		}
+	}
+	return "", fmt.Errorf("unknown role %q (expected viewer, operator or owner)", s)
+}
+
+// Allows reports whether r grants at least the access of required.
+func (r Role) Allows(required Role) bool {
+	return r.rank() >= required.rank()
+}
+
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if role == r {
+			return i
+		}
+	}
+	return -1
+}
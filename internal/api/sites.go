@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// NormalizeSite spells a site's settings the way the engine stores them, so that equivalent
+// requests such as "10.0.0.1" and "10.0.0.1/32" compare equal. Values that do not parse are
+// only trimmed and left for the engine to refuse.
+func NormalizeSite(req *SiteRequest) {
+	req.Host = NormalizeHost(req.Host)
+	req.WAF = NormalizeWAF(req.WAF)
+	for i, u := range req.Upstreams {
+		req.Upstreams[i] = strings.TrimSpace(u)
+	}
+	for i, a := range req.Allow {
+		if prefix, ok := NormalizeRange(a); ok {
+			a = prefix
+		}
+		req.Allow[i] = strings.TrimSpace(a)
+	}
+	req.LoadBalancing.Normalize()
+	req.HealthChecks.Normalize()
+}
+
+// NormalizeHost lowercases a hostname and drops a trailing dot.
+func NormalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// NormalizeWAF lowercases a WAF mode, spelling "off" as WAFOff.
+func NormalizeWAF(mode string) string {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "off" {
+		return WAFOff
+	}
+	return mode
+}
+
+// NormalizeRange spells an allowed client IP or CIDR as a masked range, so a single address
+// and its /32 or /128 look the same. It reports false if s is neither.
+func NormalizeRange(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return s, false
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked().String(), true
+}
+
+// Normalize lowercases the policy, spelling "random" as LBRandom, and canonicalises the try duration.
+func (lb *LoadBalancing) Normalize() {
+	lb.Policy = strings.ToLower(strings.TrimSpace(lb.Policy))
+	if lb.Policy == "random" {
+		lb.Policy = LBRandom
+	}
+	lb.TryDuration = CanonicalDuration(lb.TryDuration)
+}
+
+// Normalize trims the path and canonicalises the durations.
+func (hc *HealthChecks) Normalize() {
+	hc.Path = strings.TrimSpace(hc.Path)
+	hc.Interval = CanonicalDuration(hc.Interval)
+	hc.Timeout = CanonicalDuration(hc.Timeout)
+	hc.FailDuration = CanonicalDuration(hc.FailDuration)
+}
+
+// CanonicalDuration spells a Go duration the way time.Duration prints it, such as "1m0s" for
+// "60s". Anything else is only trimmed.
+func CanonicalDuration(s string) string {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.String()
+	}
+	return s
+}
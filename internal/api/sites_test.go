@@ -0,0 +1,95 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeSite(t *testing.T) {
+	tests := []struct {
+		name      string
+		req, want SiteRequest
+	}{
+		{
+			name: "already normal",
+			req:  SiteRequest{Host: "app.example.com", Upstreams: []string{"10.0.0.5:8080"}, WAF: WAFBlock, Allow: []string{"10.0.0.0/8"}},
+			want: SiteRequest{Host: "app.example.com", Upstreams: []string{"10.0.0.5:8080"}, WAF: WAFBlock, Allow: []string{"10.0.0.0/8"}},
+		},
+		{
+			name: "host",
+			req:  SiteRequest{Host: " App.Example.COM. "},
+			want: SiteRequest{Host: "app.example.com"},
+		},
+		{
+			name: "upstreams",
+			req:  SiteRequest{Upstreams: []string{" 10.0.0.5:8080", "backend.internal:9000\t"}},
+			want: SiteRequest{Upstreams: []string{"10.0.0.5:8080", "backend.internal:9000"}},
+		},
+		{
+			name: "WAF off",
+			req:  SiteRequest{WAF: " OFF"},
+			want: SiteRequest{WAF: WAFOff},
+		},
+		{
+			name: "WAF mode",
+			req:  SiteRequest{WAF: "Detect"},
+			want: SiteRequest{WAF: WAFDetect},
+		},
+		{
+			name: "unknown WAF mode",
+			req:  SiteRequest{WAF: "Paranoid "},
+			want: SiteRequest{WAF: "paranoid"},
+		},
+		{
+			name: "allowed addresses and ranges",
+			req:  SiteRequest{Allow: []string{"10.0.0.1", " 192.168.1.7/24", "2001:DB8::1", "2001:db8::/32", "10.0.0.1/32"}},
+			want: SiteRequest{Allow: []string{"10.0.0.1/32", "192.168.1.0/24", "2001:db8::1/128", "2001:db8::/32", "10.0.0.1/32"}},
+		},
+		{
+			name: "unparsable range",
+			req:  SiteRequest{Allow: []string{" 10.0.0.0/33 ", "office"}},
+			want: SiteRequest{Allow: []string{"10.0.0.0/33", "office"}},
+		},
+		{
+			name: "load balancing",
+			req:  SiteRequest{LoadBalancing: LoadBalancing{Policy: " Least_Conn", Retries: 2, TryDuration: "5000ms"}},
+			want: SiteRequest{LoadBalancing: LoadBalancing{Policy: LBLeastConn, Retries: 2, TryDuration: "5s"}},
+		},
+		{
+			name: "random selection",
+			req:  SiteRequest{LoadBalancing: LoadBalancing{Policy: "RANDOM"}},
+			want: SiteRequest{LoadBalancing: LoadBalancing{Policy: LBRandom}},
+		},
+		{
+			name: "health checks",
+			req: SiteRequest{HealthChecks: HealthChecks{
+				Path: " /healthz ", Interval: "60s", Timeout: "1500ms", ExpectStatus: 204,
+				MaxFails: 3, FailDuration: "90s", UnhealthyStatus: []int{502, 503},
+			}},
+			want: SiteRequest{HealthChecks: HealthChecks{
+				Path: "/healthz", Interval: "1m0s", Timeout: "1.5s", ExpectStatus: 204,
+				MaxFails: 3, FailDuration: "1m30s", UnhealthyStatus: []int{502, 503},
+			}},
+		},
+		{
+			name: "unparsable durations",
+			req:  SiteRequest{LoadBalancing: LoadBalancing{TryDuration: " soon"}, HealthChecks: HealthChecks{Interval: "10 s", FailDuration: "1d"}},
+			want: SiteRequest{LoadBalancing: LoadBalancing{TryDuration: "soon"}, HealthChecks: HealthChecks{Interval: "10 s", FailDuration: "1d"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			NormalizeSite(&tt.req)
+			if !reflect.DeepEqual(tt.req, tt.want) {
+				t.Errorf("got %+v, want %+v", tt.req, tt.want)
+			}
+
+			// Normalising twice changes nothing
+			again := tt.req
+			NormalizeSite(&again)
+			if !reflect.DeepEqual(again, tt.want) {
+				t.Errorf("second pass changed it to %+v", again)
+			}
+		})
+	}
+}
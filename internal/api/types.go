@@ -0,0 +1,363 @@
+// Package api defines the wire types shared by the Onyx engine and its clients,
+// along with a small HTTP client for talking to the engine's API.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Version is the path prefix of the current API revision.
+const Version = "v1"
+
+// ErrorResponse is the body returned with any non-2xx status.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// ReloadResult reports the outcome of a proxy config reload.
+type ReloadResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Status is the engine health summary returned by GET /v1/status.
+type Status struct {
+	Version   string      `json:"version"`
+	Hostname  string      `json:"hostname"`
+	StartedAt time.Time   `json:"started_at"`
+	Proxy     ProxyStatus `json:"proxy"`
+	Authority CAStatus    `json:"authority"`
+}
+
+// ProxyStatus describes the embedded Caddy data plane.
+type ProxyStatus struct {
+	Healthy   bool             `json:"healthy"`
+	Summary   string           `json:"summary"`
+	Error     string           `json:"error,omitempty"`
+	Caddyfile string           `json:"caddyfile"`
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"` // Every reverse-proxy backend, in config order
+}
+
+// UpstreamHealth is the live state of one backend of a reverse proxy, from the Caddyfile or
+// a managed site.
+type UpstreamHealth struct {
+	Site     string `json:"site"`     // Hosts the proxying route answers on; empty for a catch-all
+	Address  string `json:"address"`  // Backend as "host:port"
+	Healthy  bool   `json:"healthy"`  // False while a health check has taken it out of rotation
+	Requests int    `json:"requests"` // Requests in flight
+	Fails    int    `json:"fails"`    // Recent failures counted by passive health checks
+}
+
+// CAStatus describes the engine CA that issues and verifies admin certificates.
+type CAStatus struct {
+	Fingerprint string      `json:"fingerprint"`
+	KeyID       string      `json:"key_id"` // Hex subject key ID, the authority key ID of every certificate it issues
+	ExpiresAt   time.Time   `json:"expires_at"`
+	Rotation    *CARotation `json:"rotation,omitempty"`
+}
+
+// CARotation describes a CA rotation in progress. Until RetiresAt the previous CA is still
+// trusted and still signs the engine's server certificate.
+type CARotation struct {
+	PreviousFingerprint string    `json:"previous_fingerprint"`
+	StartedAt           time.Time `json:"started_at"`
+	RetiresAt           time.Time `json:"retires_at"`
+	ClientsOnPrevious   int       `json:"clients_on_previous"` // Active clients that have not moved to the new CA yet
+}
+
+// RotateRequest is the body of POST /v1/ca/rotate.
+type RotateRequest struct {
+	Overlap string `json:"overlap"` // How long the previous CA stays trusted, as a Go duration such as "720h"
+}
+
+// InviteRequest is the body of POST /v1/invites.
+type InviteRequest struct {
+	Role Role   `json:"role"`
+	TTL  string `json:"ttl"` // How long the token can be redeemed, as a Go duration such as "1h"
+}
+
+// Invitation is a one-time enrolment token minted by an owner. It is redeemed with the normal
+// pairing flow on the control plane port, authenticated by CAFingerprint instead of an operator.
+type Invitation struct {
+	ID            string    `json:"id"`
+	Token         string    `json:"token"`
+	Role          Role      `json:"role"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CAFingerprint string    `json:"ca_fingerprint"` // CA that issues the engine's server certificate
+}
+
+// PairingWindowRequest is the body of POST /v1/pairing, which has a running engine hold a
+// pairing window on its control plane for `onyx --pair`. Only the local socket may open one.
+type PairingWindowRequest struct {
+	Token      string `json:"token"`
+	Role       Role   `json:"role"`
+	MaxClients int    `json:"max_clients"`
+	Window     string `json:"window"`               // How long the window stays open, as a Go duration such as "5m"
+	AcceptSAS  bool   `json:"accept_sas,omitempty"` // Accept verification codes without asking
+}
+
+// Events streamed as JSON lines in answer to POST /v1/pairing, until the window closes.
+const (
+	PairingEventOpen    = "open"    // The control plane accepts the token
+	PairingEventLog     = "log"     // An attempt or warning for the operator's console
+	PairingEventConfirm = "confirm" // The operator must compare Code; answer it on /v1/pairing/{id}/confirm
+	PairingEventCode    = "code"    // Code was accepted without asking, with AcceptSAS
+	PairingEventPaired  = "paired"  // A console paired
+	PairingEventClosed  = "closed"  // The window is over; Outcome says how
+)
+
+// PairingEvent is one line of the stream answering POST /v1/pairing.
+type PairingEvent struct {
+	Type          string    `json:"type"`
+	ID            string    `json:"id,omitempty"` // The window, on "open"
+	Listen        string    `json:"listen,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at,omitzero"`
+	CAFingerprint string    `json:"ca_fingerprint,omitempty"` // CA that issues the engine's server certificate
+	Request       int       `json:"request,omitempty"`        // Which confirmation an answer is for
+	Remote        string    `json:"remote,omitempty"`
+	Code          string    `json:"code,omitempty"`
+	Message       string    `json:"message,omitempty"` // Log line, paired client, or why the window closed early
+	Outcome       string    `json:"outcome,omitempty"` // On "closed": "succeeded", "expired" or "closed"
+}
+
+// PairingConfirmation is the body of POST /v1/pairing/{id}/confirm.
+type PairingConfirmation struct {
+	Request int  `json:"request"`
+	Accept  bool `json:"accept"`
+}
+
+// ClientInfo describes an admin console paired with the engine.
+// Clients are identified by the SHA-256 fingerprint of their certificate, never by a name they chose.
+type ClientInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Name        string    `json:"name"`
+	CommonName  string    `json:"common_name"`
+	Role        Role      `json:"role"`
+	Serial      string    `json:"serial"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	LastUsed    time.Time `json:"last_used,omitzero"`
+	Revoked     bool      `json:"revoked"`
+	RevokedAt   time.Time `json:"revoked_at,omitzero"`
+	RenewedFrom string    `json:"renewed_from,omitempty"` // Fingerprint of the certificate this one replaced
+	ReplacedBy  string    `json:"replaced_by,omitempty"`  // Fingerprint of the certificate issued on renewal
+	InvitedBy   string    `json:"invited_by,omitempty"`   // Fingerprint of the admin whose invitation it redeemed
+}
+
+// Status summarises whether a client can still connect: active, expired, renewed or revoked.
+func (c ClientInfo) Status() string {
+	switch {
+	case c.Revoked && c.ReplacedBy != "":
+		return "renewed"
+	case c.Revoked:
+		return "revoked"
+	case time.Now().After(c.ExpiresAt):
+		return "expired"
+	}
+	return "active"
+}
+
+// RenewRequest is the body of POST /v1/renew, authenticated by the certificate being renewed.
+type RenewRequest struct {
+	CSR string `json:"csr"`
+}
+
+// RenewResponse carries the replacement certificate. The old certificate keeps working until the
+// new one is first used, so a lost response never locks the client out.
+type RenewResponse struct {
+	Certificate   string     `json:"certificate"`
+	CACertificate string     `json:"ca_certificate"`
+	Client        ClientInfo `json:"client"`
+}
+
+// RenameRequest is the body of PATCH /v1/clients/{fingerprint}.
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+// Results recorded in the audit log.
+const (
+	AuditOK     = "ok"
+	AuditDenied = "denied"
+	AuditFailed = "failed"
+)
+
+// AuditEntry is one record of the engine's audit log. Every entry carries the hash of the one
+// before it, so removing or editing an entry breaks the chain from that point on.
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"` // Client certificate fingerprint, "local" for the engine host, "engine" for automatic actions, empty before authentication
+	ActorName string    `json:"actor_name,omitempty"`
+	Role      Role      `json:"role,omitempty"`
+	Remote    string    `json:"remote,omitempty"` // Source address of network requests
+	Action    string    `json:"action"`           // Such as "login", "reload" or "client.revoke"
+	Target    string    `json:"target,omitempty"`
+	Result    string    `json:"result"` // AuditOK, AuditDenied or AuditFailed
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"` // Hash of the previous entry, empty for the first
+	Hash      string    `json:"hash"`
+}
+
+// AuditQuery selects audit entries. Zero fields match everything.
+type AuditQuery struct {
+	Since  time.Time
+	Until  time.Time
+	Actor  string // Fingerprint prefix or client name
+	Action string // Exact action, or a prefix such as "client" for every "client.*" action
+	Limit  int    // Keep only the newest entries
+}
+
+// AuditReport is the result of GET /v1/audit. The whole chain is verified on every query.
+type AuditReport struct {
+	Verified bool         `json:"verified"`
+	Error    string       `json:"error,omitempty"` // First break in the chain
+	Entries  []AuditEntry `json:"entries"`
+}
+
+// States of a change that needs two-person approval.
+const (
+	ChangePending  = "pending"
+	ChangeExecuted = "executed"
+	ChangeFailed   = "failed" // Approved, but the action itself failed
+	ChangeRejected = "rejected"
+)
+
+// PendingChange is a destructive action proposed by one owner that a second, different owner
+// must approve before ExpiresAt for the engine to carry it out.
+type PendingChange struct {
+	ID             string          `json:"id"`
+	Action         string          `json:"action"` // Such as "client.revoke" or "ca.rotate"
+	Target         string          `json:"target,omitempty"`
+	Params         json.RawMessage `json:"params,omitempty"`
+	ProposedBy     string          `json:"proposed_by"` // Fingerprint of the proposing owner
+	ProposedByName string          `json:"proposed_by_name,omitempty"`
+	ProposedAt     time.Time       `json:"proposed_at"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+	Status         string          `json:"status"`
+	DecidedBy      string          `json:"decided_by,omitempty"`
+	DecidedByName  string          `json:"decided_by_name,omitempty"`
+	DecidedAt      time.Time       `json:"decided_at,omitzero"`
+	Error          string          `json:"error,omitempty"`
+	Result         json.RawMessage `json:"result,omitempty"` // Response the action would have returned directly
+}
+
+// ApprovalPolicy decides which callers need a second owner for destructive actions.
+type ApprovalPolicy struct {
+	Enabled bool   `json:"enabled"`
+	Window  string `json:"window"` // How long a proposal waits for approval, as a Go duration
+}
+
+// ChangeList is the result of GET /v1/changes.
+type ChangeList struct {
+	Policy  ApprovalPolicy  `json:"policy"`
+	Changes []PendingChange `json:"changes"`
+}
+
+// ApprovalPendingError is returned by Client methods whose action was queued for approval
+// by a second owner instead of being carried out.
+type ApprovalPendingError struct {
+	Change PendingChange
+}
+
+func (e *ApprovalPendingError) Error() string {
+	return fmt.Sprintf("%s is waiting for approval by a second owner (change %s, expires %s)",
+		e.Change.Action, e.Change.ID, e.Change.ExpiresAt.Local().Format("2006-01-02 15:04"))
+}
+
+// WAF modes of a managed site, which runs the Coraza WAF with the OWASP Core Rule Set.
+const (
+	WAFOff    = ""
+	WAFDetect = "detect" // Log requests the rules flag, but let them through
+	WAFBlock  = "block"  // Refuse requests the rules flag
+)
+
+// Load-balancing policies for a site with several upstreams.
+const (
+	LBRandom     = ""            // Any available upstream, chosen at random
+	LBRoundRobin = "round_robin" // Each upstream in turn
+	LBLeastConn  = "least_conn"  // The upstream with the fewest requests in flight
+	LBIPHash     = "ip_hash"     // The same upstream for the same client IP
+	LBCookie     = "cookie"      // The same upstream for the same browser, tracked in a cookie
+	LBFirst      = "first"       // The first available upstream in the list, as a failover
+)
+
+// LoadBalancing chooses among a site's upstreams and retries requests that fail on one.
+type LoadBalancing struct {
+	Policy      string `json:"policy,omitempty"`       // One of the LB policies; empty picks at random
+	Retries     int    `json:"retries,omitempty"`      // Further attempts on other upstreams after a failure
+	TryDuration string `json:"try_duration,omitempty"` // How long to keep retrying, as a Go duration such as "5s"
+}
+
+// HealthChecks takes failing upstreams out of rotation until they recover. Active checks poll
+// every upstream and are off unless Path is set; passive checks watch real traffic and are off
+// unless MaxFails is set. Durations are Go durations such as "10s".
+type HealthChecks struct {
+	Path         string `json:"path,omitempty"`          // Polled with GET, e.g. "/healthz"
+	Interval     string `json:"interval,omitempty"`      // Between polls; default 30s
+	Timeout      string `json:"timeout,omitempty"`       // For each poll; default 5s
+	ExpectStatus int    `json:"expect_status,omitempty"` // Status of a healthy answer; default any 2xx
+
+	MaxFails        int    `json:"max_fails,omitempty"`        // Failures within FailDuration that take an upstream out
+	FailDuration    string `json:"fail_duration,omitempty"`    // How long a failure counts; default 30s
+	UnhealthyStatus []int  `json:"unhealthy_status,omitempty"` // Response codes that count as failures, besides errors
+}
+
+// Site is a reverse-proxy site managed through the control plane. Sites are kept in Onyx's own
+// store rather than the Caddyfile, and merged into the Caddy config the engine loads.
+type Site struct {
+	Host          string        `json:"host"`            // Hostname the site answers on, e.g. "app.example.com" or "*.example.com"
+	Upstreams     []string      `json:"upstreams"`       // Backends as "host:port"
+	WAF           string        `json:"waf,omitempty"`   // WAF mode; empty leaves the WAF off
+	Allow         []string      `json:"allow,omitempty"` // Client IP ranges allowed in; empty allows everyone
+	LoadBalancing LoadBalancing `json:"load_balancing,omitzero"`
+	HealthChecks  HealthChecks  `json:"health_checks,omitzero"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	UpdatedBy     string        `json:"updated_by,omitempty"` // Fingerprint of the admin who last changed it, or "local"
+}
+
+// SiteRequest creates a site, or replaces its settings when sent to the site's own path.
+type SiteRequest struct {
+	Host          string        `json:"host,omitempty"`
+	Upstreams     []string      `json:"upstreams"`
+	WAF           string        `json:"waf,omitempty"`
+	Allow         []string      `json:"allow,omitempty"`
+	LoadBalancing LoadBalancing `json:"load_balancing,omitzero"`
+	HealthChecks  HealthChecks  `json:"health_checks,omitzero"`
+}
+
+// ConfigSnapshot is a configuration the engine applied, as kept in its history.
+type ConfigSnapshot struct {
+	ID            int       `json:"id"`
+	Hash          string    `json:"hash"` // SHA-256 of the Caddyfile and the managed sites
+	AppliedAt     time.Time `json:"applied_at"`
+	AppliedBy     string    `json:"applied_by"` // Fingerprint of the admin, "local" or "engine"
+	AppliedByName string    `json:"applied_by_name,omitempty"`
+	Source        string    `json:"source"`              // What applied it, such as "reload" or "site.create"
+	Caddyfile     string    `json:"caddyfile,omitempty"` // Left out of history listings
+	Sites         []Site    `json:"sites,omitempty"`
+}
+
+// ValidateRequest uploads a Caddyfile for the engine to check without applying it.
+type ValidateRequest struct {
+	Filename  string `json:"filename"` // Name used in diagnostics, usually the local path
+	Caddyfile string `json:"caddyfile"`
+}
+
+// Diagnostic is a problem found while validating a Caddyfile.
+type Diagnostic struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"` // 0 when the problem is not tied to a line
+	Directive string `json:"directive,omitempty"`
+	Message   string `json:"message"`
+}
+
+// ValidateResult is the outcome of adapting and provisioning an uploaded Caddyfile.
+type ValidateResult struct {
+	Valid    bool            `json:"valid"`
+	Errors   []Diagnostic    `json:"errors"`
+	Warnings []Diagnostic    `json:"warnings"`
+	Config   json.RawMessage `json:"config,omitempty"` // The JSON config the engine would load, with managed sites; owners only
+}
@@ -2,6 +2,11 @@
 package config
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -19,25 +24,87 @@ type AdminConfig struct {
 type GlobalSettings struct {
 	DefaultPort int    `toml:"default_port"`
 	Theme       string `toml:"theme"`
+
+	// RenewWithinDays is how close to expiry a client certificate is renewed automatically.
+	// Zero disables automatic renewal; certificates are still flagged in the menu and dashboard.
+	RenewWithinDays int `toml:"renew_within_days"`
+}
+
+// RenewWindow returns RenewWithinDays as a duration.
+func (s GlobalSettings) RenewWindow() time.Duration {
+	return time.Duration(s.RenewWithinDays) * 24 * time.Hour
+}
+
+// expiryWarning is how close to expiry a certificate is flagged when automatic renewal is off.
+const expiryWarning = 30 * 24 * time.Hour
+
+// WarnWindow returns how close to expiry a certificate should be flagged to the user.
+func (s GlobalSettings) WarnWindow() time.Duration {
+	return max(s.RenewWindow(), expiryWarning)
 }
 
 // Node represents a paired Onyx engine.
+// Each node has its own client certificate, so pairing one engine never affects another.
 type Node struct {
+	ID       string    `toml:"id"` // Stable identifier; names the node's directory under Dir()/nodes
 	Name     string    `toml:"name"`
 	Address  string    `toml:"address"` // IP or Hostname
 	Port     int       `toml:"port"`
+	CertFile string    `toml:"cert_file"` // Client certificate issued by this engine
+	KeyFile  string    `toml:"key_file"`  // Private key for CertFile; may be shared with other nodes
+	CAFile   string    `toml:"ca_file"`   // Engine CA pinned at pairing time
 	AddedAt  time.Time `toml:"added_at"`
 	LastSeen time.Time `toml:"last_seen"`
 }
 
+// CertExpiry returns when the node's client certificate expires.
+func (n *Node) CertExpiry() (time.Time, error) {
+	data, err := os.ReadFile(n.CertFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("%s does not contain a PEM certificate", n.CertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// Dir returns the onyx-admin configuration directory (~/.config/onyx).
+func Dir() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "onyx")
+}
+
+// DefaultPath returns the location of config.toml.
+func DefaultPath() string {
+	return filepath.Join(Dir(), "config.toml")
+}
+
+// SharedKeyPath returns the default private key used for nodes without a key of their own.
+func SharedKeyPath() string {
+	return filepath.Join(Dir(), "certs", "client.key")
+}
+
+// NodeDir returns the directory holding the certificates of the node with the given ID.
+func NodeDir(id string) string {
+	return filepath.Join(Dir(), "nodes", id)
+}
+
 // LoadConfig reads the TOML configuration from the specified path.
 // If the file is missing, it returns a default configuration suitable for a fresh start.
 func LoadConfig(path string) (*AdminConfig, error) {
 	// Default state
 	conf := &AdminConfig{
 		Settings: GlobalSettings{
-			DefaultPort: 2305,
-			Theme:       "default",
+			DefaultPort:     2305,
+			Theme:           "default",
+			RenewWithinDays: 30,
 		},
 		Nodes: []Node{},
 	}
@@ -69,22 +136,66 @@ func (c *AdminConfig) SaveConfig(path string) error {
 }
 
 // AddNode safely appends or updates a node in the configuration.
-func (c *AdminConfig) AddNode(name, address string, port int) {
+// It returns a pointer to the stored node so callers can fill in further details.
+func (c *AdminConfig) AddNode(name, address string, port int) *Node {
 	// Check for existing node to update
 	for i, n := range c.Nodes {
 		if n.Address == address && n.Port == port {
 			c.Nodes[i].LastSeen = time.Now()
 			c.Nodes[i].Name = name // Update name if changed
-			return
+			return &c.Nodes[i]
 		}
 	}
 
 	// Append new node
 	c.Nodes = append(c.Nodes, Node{
+		ID:       NewNodeID(),
 		Name:     name,
 		Address:  address,
 		Port:     port,
 		AddedAt:  time.Now(),
 		LastSeen: time.Now(),
 	})
+	return &c.Nodes[len(c.Nodes)-1]
+}
+
+// FindNode returns the node with the given ID, or nil if there is none.
+func (c *AdminConfig) FindNode(id string) *Node {
+	for i := range c.Nodes {
+		if c.Nodes[i].ID == id {
+			return &c.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// LookupNode finds a node by ID, name or address. Names and addresses must be unambiguous.
+func (c *AdminConfig) LookupNode(ref string) (*Node, error) {
+	if n := c.FindNode(ref); n != nil {
+		return n, nil
+	}
+
+	var match *Node
+	for i := range c.Nodes {
+		n := &c.Nodes[i]
+		if n.Name != ref && n.Address != ref && fmt.Sprintf("%s:%d", n.Address, n.Port) != ref {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("%q matches more than one engine; use its ID instead", ref)
+		}
+		match = n
+	}
+
+	if match == nil {
+		return nil, fmt.Errorf("no paired engine matches %q", ref)
+	}
+	return match, nil
+}
+
+// NewNodeID generates a random identifier for a newly paired node.
+func NewNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DesiredState describes the managed sites an engine should serve, kept in a TOML file under
+// version control and converged with `onyx-admin plan` and `onyx-admin apply`:
+//
+//	node = "edge-1"
+//
+//	[[site]]
+//	host      = "app.example.com"
+//	upstreams = ["10.0.0.5:8080", "10.0.0.6:8080"]
+//	waf       = "block"
+//	allow     = ["10.0.0.0/8"]
+//
+//	[site.load_balancing]
+//	policy  = "least_conn"
+//	retries = 2
+//
+//	[site.health_checks]
+//	path      = "/healthz"
+//	max_fails = 3
+//
+// Sites on the engine that the file does not list are removed when it is applied.
+type DesiredState struct {
+	Node  string        `toml:"node"` // Engine the file describes; --node takes precedence
+	Sites []DesiredSite `toml:"site"`
+}
+
+// DesiredSite is one site in a DesiredState.
+type DesiredSite struct {
+	Host      string   `toml:"host"`
+	Upstreams []string `toml:"upstreams"`
+	WAF       string   `toml:"waf"`   // "off", "detect" or "block"; empty leaves the WAF off
+	Allow     []string `toml:"allow"` // Client IP ranges allowed in; empty allows everyone
+
+	LoadBalancing DesiredLoadBalancing `toml:"load_balancing"`
+	HealthChecks  DesiredHealthChecks  `toml:"health_checks"`
+}
+
+// DesiredLoadBalancing chooses among a site's upstreams and retries failed requests.
+type DesiredLoadBalancing struct {
+	Policy      string `toml:"policy"` // random, round_robin, least_conn, ip_hash, cookie or first
+	Retries     int    `toml:"retries"`
+	TryDuration string `toml:"try_duration"` // Such as "5s"
+}
+
+// DesiredHealthChecks takes failing upstreams out of rotation. Active checks are on when Path
+// is set, passive checks when MaxFails is.
+type DesiredHealthChecks struct {
+	Path         string `toml:"path"`
+	Interval     string `toml:"interval"`
+	Timeout      string `toml:"timeout"`
+	ExpectStatus int    `toml:"expect_status"`
+
+	MaxFails        int    `toml:"max_fails"`
+	FailDuration    string `toml:"fail_duration"`
+	UnhealthyStatus []int  `toml:"unhealthy_status"`
+}
+
+// LoadDesiredState reads a desired-state file. Unknown keys are rejected, so a misspelt
+// setting is not silently dropped from the plan.
+func LoadDesiredState(path string) (*DesiredState, error) {
+	var state DesiredState
+	md, err := toml.DecodeFile(path, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return nil, fmt.Errorf("%s: unknown setting(s) %s", path, strings.Join(keys, ", "))
+	}
+
+	for i, site := range state.Sites {
+		if site.Host == "" {
+			return nil, fmt.Errorf("%s: site #%d has no host", path, i+1)
+		}
+	}
+	return &state, nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Migrate upgrades configurations written before nodes had their own identities.
+// Older consoles kept a single certs/client.crt that was overwritten by every pairing,
+// so it can only belong to the node whose pinned CA issued it. That node inherits the
+// certificate; the shared certs/client.key stays in place as the default key.
+// It reports whether anything changed, in which case the caller should save the config.
+func (c *AdminConfig) Migrate() (bool, error) {
+	changed := false
+	legacyCert := filepath.Join(Dir(), "certs", "client.crt")
+
+	for i := range c.Nodes {
+		n := &c.Nodes[i]
+		if n.ID != "" {
+			continue
+		}
+
+		n.ID = NewNodeID()
+		changed = true
+
+		dir := NodeDir(n.ID)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return changed, fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+
+		// Move the pinned CA next to the node's other files
+		if n.CAFile != "" {
+			caPath := filepath.Join(dir, "ca.crt")
+			if err := os.Rename(n.CAFile, caPath); err == nil {
+				n.CAFile = caPath
+			}
+		}
+
+		if n.CertFile == "" && issuedBy(legacyCert, n.CAFile) {
+			certPath := filepath.Join(dir, "client.crt")
+			data, err := os.ReadFile(legacyCert)
+			if err != nil {
+				return changed, err
+			}
+			if err := os.WriteFile(certPath, data, 0644); err != nil {
+				return changed, err
+			}
+			n.CertFile = certPath
+			n.KeyFile = SharedKeyPath()
+		}
+	}
+
+	return changed, nil
+}
+
+// issuedBy reports whether the certificate at certPath chains to the CA at caPath.
+func issuedBy(certPath, caPath string) bool {
+	if caPath == "" {
+		return false
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return false
+	}
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return false
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return false
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
@@ -3,19 +3,29 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math/big"
 	"time"
 )
 
+// EngineServerName is the DNS name carried by every engine server certificate.
+// Admin consoles verify the engine against this name and their pinned CA, not the dialed address.
+const EngineServerName = "engine.onyx.internal"
+
 // GenerateCSR creates a Certificate Signing Request (CSR) for a client.
 // This is sent to the server during the pairing process to request a signed certificate.
-func GenerateCSR(priv ed25519.PrivateKey, commonName string) ([]byte, error) {
+// The key may be any Ed25519 signer, including one held by the onyx-admin agent.
+func GenerateCSR(priv crypto.Signer, commonName string) ([]byte, error) {
 	subj := pkix.Name{
 		CommonName:   commonName,
 		Organization: []string{"Onyx Admin"},
@@ -39,9 +49,44 @@ func GenerateCSR(priv ed25519.PrivateKey, commonName string) ([]byte, error) {
 	return pem.EncodeToMemory(csrBlock), nil
 }
 
-// SignCSR takes a raw PEM-encoded CSR and returns a signed X.509 Certificate.
+// CreateCA generates a self-signed certificate authority for the given Ed25519 key.
+// The CA is used by an engine to issue and later verify its admin client certificates.
+func CreateCA(priv ed25519.PrivateKey, commonName string, validity time.Duration) ([]byte, error) {
+	pub := priv.Public().(ed25519.PublicKey)
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"Onyx"},
+		},
+		NotBefore:             time.Now().Add(-time.Minute), // Tolerate small clock skew
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          subjectKeyID(pub),
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), nil
+}
+
+// SignCSR takes a raw PEM-encoded CSR and returns an X.509 Certificate issued by the given CA.
 // The certificate is valid for 1 year and is strictly limited to Client Authentication.
-func SignCSR(csrPEM []byte, caPriv ed25519.PrivateKey) ([]byte, error) {
+// Only the CommonName is taken from the CSR; the role is chosen by the issuer and bound into the
+// subject's OrganizationalUnit, so a client cannot grant itself more access.
+func SignCSR(csrPEM []byte, caCert *x509.Certificate, caPriv ed25519.PrivateKey, role string) ([]byte, error) {
 	block, _ := pem.Decode(csrPEM)
 	if block == nil || block.Type != "CERTIFICATE REQUEST" {
 		return nil, fmt.Errorf("invalid CSR PEM")
@@ -52,20 +97,45 @@ func SignCSR(csrPEM []byte, caPriv ed25519.PrivateKey) ([]byte, error) {
 		return nil, fmt.Errorf("failed to parse CSR: %w", err)
 	}
 
+	// The requester must prove possession of the key it wants certified
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %w", err)
+	}
+
+	pub, ok := csr.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("CSR must use an ed25519 key")
+	}
+
 	// Create a certificate template based on the CSR
-	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	notAfter := time.Now().AddDate(1, 0, 0) // Valid for 1 year
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
 	template := x509.Certificate{
-		SerialNumber:          serialNumber,
-		Subject:               csr.Subject,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0), // Valid for 1 year
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:         csr.Subject.CommonName,
+			Organization:       []string{"Onyx Admin"},
+			OrganizationalUnit: []string{role},
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		SubjectKeyId:          subjectKeyID(pub),
+		AuthorityKeyId:        caCert.SubjectKeyId,
 	}
 
-	// The server signs the certificate with its own private key
-	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, csr.PublicKey, caPriv)
+	// The CA is the real issuer, so the result chains to the engine's trust anchor
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, pub, caPriv)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign certificate: %w", err)
 	}
@@ -78,6 +148,108 @@ func SignCSR(csrPEM []byte, caPriv ed25519.PrivateKey) ([]byte, error) {
 	return pem.EncodeToMemory(certBlock), nil
 }
 
+// IssueServerCert creates a fresh Ed25519 key and a server certificate for it, issued by the given CA.
+// The certificate always carries EngineServerName so clients can verify it against their pinned CA
+// regardless of the address they used to reach the engine.
+func IssueServerCert(caCert *x509.Certificate, caPriv ed25519.PrivateKey, validity time.Duration) (tls.Certificate, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate server key: %w", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   EngineServerName,
+			Organization: []string{"Onyx"},
+		},
+		DNSNames:              []string{EngineServerName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		SubjectKeyId:          subjectKeyID(pub),
+		AuthorityKeyId:        caCert.SubjectKeyId,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, pub, caPriv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to sign server certificate: %w", err)
+	}
+
+	// The CA travels with the certificate so clients holding only its fingerprint can check it
+	return tls.Certificate{Certificate: [][]byte{certBytes, caCert.Raw}, PrivateKey: priv}, nil
+}
+
+// CertificateRole returns the role bound into a client certificate by SignCSR.
+// Certificates issued before roles existed carry none and yield "".
+func CertificateRole(cert *x509.Certificate) string {
+	if len(cert.Subject.OrganizationalUnit) != 1 {
+		return ""
+	}
+	return cert.Subject.OrganizationalUnit[0]
+}
+
+// CreateCRL signs a revocation list for the given CA. Numbers must increase with every new list
+// so verifiers can tell a current list from a replayed older one.
+func CreateCRL(caCert *x509.Certificate, caPriv ed25519.PrivateKey, number *big.Int, entries []x509.RevocationListEntry) ([]byte, error) {
+	template := x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                caCert.NotAfter, // The engine is its own only verifier and re-reads the list on change
+		RevokedCertificateEntries: entries,
+	}
+
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, &template, caCert, caPriv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign revocation list: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlBytes}), nil
+}
+
+// ParseCRL decodes a PEM-encoded revocation list and checks that it was signed by caCert.
+func ParseCRL(crlPEM []byte, caCert *x509.Certificate) (*x509.RevocationList, error) {
+	block, _ := pem.Decode(crlPEM)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, fmt.Errorf("failed to decode PEM block containing revocation list")
+	}
+
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse revocation list: %w", err)
+	}
+
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("revocation list is not signed by the engine CA: %w", err)
+	}
+
+	return crl, nil
+}
+
+// Fingerprint returns the hex-encoded SHA-256 digest of a certificate's DER encoding.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// subjectKeyID derives a key identifier from the public key, as in RFC 5280 section 4.2.1.2.
+func subjectKeyID(pub ed25519.PublicKey) []byte {
+	sum := sha1.Sum(pub)
+	return sum[:]
+}
+
 // ParseCertificate converts PEM-encoded certificate data into an x509 Certificate object.
 func ParseCertificate(certPEM []byte) (*x509.Certificate, error) {
 	block, _ := pem.Decode(certPEM)
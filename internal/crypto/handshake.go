@@ -2,43 +2,216 @@ package crypto
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
+
+	"onyx/internal/pairing"
 )
 
-// PerformHandshake exchanges the CSR and Token for a signed certificate.
+// pairingTimeout leaves room for the engine operator to compare and confirm the verification code.
+const pairingTimeout = 2 * time.Minute
+
+// PerformHandshake exchanges the CSR and Token for a signed certificate and the engine's CA certificate,
+// using the versioned protocol defined in package pairing.
 // address should be in the format "ip:port" (e.g., "10.0.0.1:2305").
-func PerformHandshake(address, token string, csr []byte) ([]byte, error) {
-	// 1. Prepare the request
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/pair", address), bytes.NewReader(csr))
+// onCode is called with the session's short authentication string as soon as both nonces are known,
+// so it can be shown while the engine operator compares it. The same code is returned for a final confirmation.
+// If caFingerprint is set, as it is for invitations, the engine must present a certificate issued by
+// the CA with that SHA-256 fingerprint before the token is sent, which authenticates it without
+// an operator comparing codes.
+func PerformHandshake(address, token, caFingerprint string, csr []byte, onCode func(code string)) (cert, caCert []byte, code string, err error) {
+	// 1. Commit to a nonce before the engine picks its own, so neither side can steer the code
+	nonce, err := NewNonce()
 	if err != nil {
-		return nil, err
+		return nil, nil, "", err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/x-pem-file")
+	// 2. Create a client for a TLS session we cannot verify yet, since there is no trust anchor.
+	// The engine is authenticated by the operator comparing the verification code on both ends
+	// and, afterwards, by checking that its certificate chains to the CA it hands us. Both rounds
+	// must travel over this one session, which the code is derived from.
+	var peer tls.ConnectionState
+	dialed := false
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+	}
+
+	transport := &http.Transport{
+		MaxConnsPerHost: 1,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if dialed {
+				return nil, fmt.Errorf("engine closed the pairing session before it completed")
+			}
+
+			d := &tls.Dialer{Config: tlsConfig}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			state := conn.(*tls.Conn).ConnectionState()
+			if caFingerprint != "" {
+				if err := verifyEngineIssuer(state, caFingerprint); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+
+			peer, dialed = state, true
+			return conn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
 
-	// 2. Create a client that skips TLS verification (since we are bootstrapping trust)
-	// or uses plain HTTP if that's how your pairing endpoint is currently set up.
-	// Note: Your current pairing server uses standard HTTP for the initial handshake.
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Transport: transport,
+		Timeout:   pairingTimeout,
+	}
+
+	// 3. Send the token, the CSR and the commitment
+	res, err := postPairing(client, address, pairing.Request{
+		Versions:   pairing.SupportedVersions,
+		Token:      token,
+		CSR:        string(csr),
+		Commitment: Commitment(nonce),
+	})
+	if err != nil {
+		return nil, nil, "", err
 	}
 
-	// 3. Send the request
+	// 4. A pairing window answers with its own nonce. Derive the code, then reveal ours and wait
+	// while the engine operator compares it. Only an invitation is redeemed without a code.
+	switch {
+	case res.Nonce != "":
+		engineNonce, err := hex.DecodeString(res.Nonce)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("engine returned a malformed nonce")
+		}
+		if code, err = ShortAuthString(peer, nonce, engineNonce); err != nil {
+			return nil, nil, "", err
+		}
+		if onCode != nil {
+			onCode(code)
+		}
+
+		res, err = postPairing(client, address, pairing.Request{
+			Versions: pairing.SupportedVersions,
+			Token:    token,
+			Nonce:    hex.EncodeToString(nonce),
+		})
+		if err != nil {
+			return nil, nil, "", err
+		}
+	case caFingerprint == "":
+		return nil, nil, "", fmt.Errorf("engine issued a certificate without a verification code; an invitation must be redeemed with its CA fingerprint")
+	}
+
+	// 5. Validate the issued certificate and the CA to pin
+	if _, err := ParseCertificate([]byte(res.Certificate)); err != nil {
+		return nil, nil, "", fmt.Errorf("engine returned an invalid certificate: %w", err)
+	}
+	cert, caCert = []byte(res.Certificate), []byte(res.CACertificate)
+
+	// 6. The engine we talked to must be the one vouched for by the CA we are about to pin
+	if err := verifyPairingPeer(peer, caCert); err != nil {
+		return nil, nil, "", err
+	}
+
+	return cert, caCert, code, nil
+}
+
+// postPairing sends one round of the pairing protocol and decodes the engine's answer.
+// Failures carry a structured *pairing.Error for callers to inspect.
+func postPairing(client *http.Client, address string, preq pairing.Request) (*pairing.Response, error) {
+	body, err := json.Marshal(preq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s%s", address, pairing.Path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", pairing.ContentType)
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// 4. Handle response
+	var res pairing.Response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("engine returned %s with an unreadable body: %w", resp.Status, err)
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("server returned %s: %s", resp.Status, string(body))
+		return nil, fmt.Errorf("engine returned %s", resp.Status)
+	}
+	if !slices.Contains(pairing.SupportedVersions, res.Version) {
+		return nil, fmt.Errorf("engine answered with unsupported protocol version %d", res.Version)
+	}
+	return &res, nil
+}
+
+// verifyEngineIssuer checks that the engine's certificate was issued by the CA it sent along
+// with it, and that this CA has the expected fingerprint.
+func verifyEngineIssuer(peer tls.ConnectionState, fingerprint string) error {
+	want := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(fingerprint, "SHA256:"), ":", ""))
+
+	if len(peer.PeerCertificates) < 2 {
+		return fmt.Errorf("engine did not present its CA; it may be too old to accept invitations")
+	}
+	leaf := peer.PeerCertificates[0]
+	for _, ca := range peer.PeerCertificates[1:] {
+		if Fingerprint(ca) != want {
+			continue
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			DNSName:   EngineServerName,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return fmt.Errorf("engine certificate is not issued by the expected CA: %w", err)
+		}
+		return nil
 	}
+	return fmt.Errorf("engine CA does not match fingerprint %s; the connection may be intercepted", fingerprint)
+}
 
-	return io.ReadAll(resp.Body)
+// verifyPairingPeer checks that the pairing session was served by a certificate issued by caPEM.
+func verifyPairingPeer(peer tls.ConnectionState, caPEM []byte) error {
+	if len(peer.PeerCertificates) == 0 {
+		return fmt.Errorf("engine did not present a certificate")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("engine returned an invalid CA certificate")
+	}
+
+	_, err := peer.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:     roots,
+		DNSName:   EngineServerName,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("engine certificate does not match the CA it returned: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"onyx/internal/agent"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// encryptedKeyType is the PEM type of a passphrase-protected private key.
+const encryptedKeyType = "ONYX ENCRYPTED PRIVATE KEY"
+
+// Argon2id parameters for new keys, following the RFC 9106 second recommended option.
+// They are stored alongside each key, so they can be raised later without breaking old files.
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+
+	// Limits on the parameters accepted from a key file
+	maxKDFTime   = 16
+	maxKDFMemory = 1024 * 1024 // KiB
+)
+
+// ErrKeyEncrypted is returned by LoadPrivateKey for a passphrase-protected key.
+var ErrKeyEncrypted = errors.New("private key is encrypted")
+
+// ErrBadPassphrase is returned when a key cannot be decrypted with the given passphrase.
+var ErrBadPassphrase = errors.New("incorrect passphrase")
+
+// EncryptPrivateKey protects an Ed25519 key with a passphrase. The key is stretched with Argon2id
+// and the PKCS#8 encoding sealed with XChaCha20-Poly1305. The public key is stored in the clear so
+// the key can be matched to its certificate, and used through the agent, without the passphrase.
+func EncryptPrivateKey(priv ed25519.PrivateKey, passphrase []byte) ([]byte, error) {
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	salt := make([]byte, 16)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"KDF":        "argon2id",
+		"KDF-Params": fmt.Sprintf("%d,%d,%d", kdfTime, kdfMemory, kdfThreads),
+		"Salt":       base64.StdEncoding.EncodeToString(salt),
+		"Cipher":     "xchacha20-poly1305",
+		"Nonce":      base64.StdEncoding.EncodeToString(nonce),
+		"Public-Key": base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, kdfTime, kdfMemory, kdfThreads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	// The public key is bound as associated data, so it cannot be swapped for another one
+	sealed := aead.Seal(nil, nonce, pkcs8Key, priv.Public().(ed25519.PublicKey))
+
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedKeyType, Headers: headers, Bytes: sealed}), nil
+}
+
+// DecryptPrivateKey opens a key written by EncryptPrivateKey.
+func DecryptPrivateKey(data, passphrase []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, fmt.Errorf("failed to decode PEM block containing encrypted private key")
+	}
+	if block.Headers["KDF"] != "argon2id" || block.Headers["Cipher"] != "xchacha20-poly1305" {
+		return nil, fmt.Errorf("unsupported key encryption %s/%s", block.Headers["KDF"], block.Headers["Cipher"])
+	}
+
+	var t, m uint32
+	var p uint8
+	if _, err := fmt.Sscanf(block.Headers["KDF-Params"], "%d,%d,%d", &t, &m, &p); err != nil {
+		return nil, fmt.Errorf("invalid KDF parameters: %w", err)
+	}
+	// The parameters come from the file, so bound what opening it may cost
+	if t < 1 || t > maxKDFTime || p < 1 || m < 8*uint32(p) || m > maxKDFMemory {
+		return nil, fmt.Errorf("KDF parameters %q are out of range", block.Headers["KDF-Params"])
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	pub, err := encryptedPublicKey(block)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, t, m, p, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	pkcs8Key, err := aead.Open(nil, nonce, block.Bytes, pub)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 private key")
+	}
+	return priv, nil
+}
+
+// LoadSigner returns a signer for the key at filename. Plain keys are loaded directly;
+// passphrase-protected keys are used through the running onyx-admin agent, so they are
+// never decrypted by the calling process.
+func LoadSigner(filename string) (crypto.Signer, error) {
+	priv, err := LoadPrivateKey(filename)
+	if !errors.Is(err, ErrKeyEncrypted) {
+		return priv, err
+	}
+
+	pub, err := PublicKeyFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return agent.NewSigner(agent.DefaultSocket(), pub)
+}
+
+// IsEncryptedKey reports whether the key file at filename is passphrase-protected.
+func IsEncryptedKey(filename string) bool {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyType
+}
+
+// PublicKeyFromFile returns the public half of a key file, encrypted or not, without a passphrase.
+func PublicKeyFromFile(filename string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block != nil && block.Type == encryptedKeyType {
+		return encryptedPublicKey(block)
+	}
+
+	priv, err := LoadPrivateKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	return priv.Public().(ed25519.PublicKey), nil
+}
+
+func encryptedPublicKey(block *pem.Block) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(block.Headers["Public-Key"])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key in encrypted key header")
+	}
+	return ed25519.PublicKey(pub), nil
+}
@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newEncryptedKey returns a fresh key and its encryption under passphrase.
+func newEncryptedKey(t *testing.T, passphrase string) (ed25519.PrivateKey, []byte) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncryptPrivateKey(priv, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, data
+}
+
+// withHeader returns the encrypted key data with one PEM header replaced.
+func withHeader(t *testing.T, data []byte, name, value string) []byte {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("not a PEM block")
+	}
+	block.Headers[name] = value
+	return pem.EncodeToMemory(block)
+}
+
+func TestEncryptPrivateKeyRoundTrip(t *testing.T) {
+	priv, data := newEncryptedKey(t, "correct horse battery staple")
+
+	if strings.Contains(string(data), base64.StdEncoding.EncodeToString(priv.Seed())) {
+		t.Fatal("the private key is stored in the clear")
+	}
+
+	got, err := DecryptPrivateKey(data, []byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.Equal(got) {
+		t.Error("decrypted key differs from the original")
+	}
+
+	block, _ := pem.Decode(data)
+	pub, err := encryptedPublicKey(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(priv.Public()) {
+		t.Error("the clear public key does not match the private key")
+	}
+}
+
+func TestDecryptPrivateKeyRejects(t *testing.T) {
+	_, data := newEncryptedKey(t, "correct horse battery staple")
+	other, _ := newEncryptedKey(t, "correct horse battery staple")
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		want       error  // Sentinel the error must match, if any
+		message    string // Part of the error message, if any
+	}{
+		{"wrong passphrase", data, "Tr0ub4dor&3", ErrBadPassphrase, ""},
+		{"empty passphrase", data, "", ErrBadPassphrase, ""},
+		{"swapped public key", withHeader(t, data, "Public-Key", base64.StdEncoding.EncodeToString(other.Public().(ed25519.PublicKey))), "correct horse battery staple", ErrBadPassphrase, ""},
+		{"truncated public key", withHeader(t, data, "Public-Key", "AAAA"), "correct horse battery staple", nil, "invalid public key"},
+		{"unknown cipher", withHeader(t, data, "Cipher", "aes-256-gcm"), "correct horse battery staple", nil, "unsupported key encryption"},
+		{"malformed KDF parameters", withHeader(t, data, "KDF-Params", "3;65536;4"), "correct horse battery staple", nil, "invalid KDF parameters"},
+		{"bad nonce", withHeader(t, data, "Nonce", "AAAA"), "correct horse battery staple", nil, "invalid nonce"},
+		{"plain PEM", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), "", nil, "failed to decode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecryptPrivateKey(tt.data, []byte(tt.passphrase))
+			if err == nil {
+				t.Fatal("decryption succeeded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if tt.message != "" && !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("got %v, want an error containing %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestDecryptPrivateKeyBoundsKDFParams(t *testing.T) {
+	_, data := newEncryptedKey(t, "correct horse battery staple")
+
+	// Argon2 would need up to 4 TiB or run for hours with these, so an error that comes back at
+	// once shows they were refused before it ran
+	for _, params := range []string{
+		"3,4294967295,4", // Memory beyond maxKDFMemory
+		"4294967295,65536,4",
+		"0,65536,4",
+		"3,65536,0",
+		"3,16,4", // Less than 8 KiB per thread
+	} {
+		t.Run(params, func(t *testing.T) {
+			_, err := DecryptPrivateKey(withHeader(t, data, "KDF-Params", params), []byte("correct horse battery staple"))
+			if err == nil || !strings.Contains(err.Error(), "out of range") {
+				t.Errorf("got %v, want the parameters refused as out of range", err)
+			}
+		})
+	}
+}
@@ -48,6 +48,7 @@ func SavePEM(filename string, data []byte) error {
 }
 
 // LoadPrivateKey reads a PEM-encoded Ed25519 private key from disk.
+// Passphrase-protected keys yield ErrKeyEncrypted; use DecryptPrivateKey or LoadSigner for those.
 func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -55,6 +56,9 @@ func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
 	}
 
 	block, _ := pem.Decode(data)
+	if block != nil && block.Type == encryptedKeyType {
+		return nil, ErrKeyEncrypted
+	}
 	if block == nil || block.Type != "PRIVATE KEY" {
 		return nil, fmt.Errorf("failed to decode PEM block containing private key")
 	}
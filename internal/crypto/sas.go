@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// sasLabel binds the exported keying material to the pairing use case (RFC 5705 / RFC 8446 section 7.5).
+const sasLabel = "EXPORTER-onyx-pairing-sas"
+
+// sessionLabel derives the value that ties the two rounds of a pairing to one TLS session.
+const sessionLabel = "EXPORTER-onyx-pairing-session"
+
+// commitmentPrefix separates nonce commitments from any other use of SHA-256 over a nonce.
+const commitmentPrefix = "onyx-pairing-commitment\x00"
+
+// NonceSize is the length of the nonces both ends contribute to the verification code.
+const NonceSize = 32
+
+// NewNonce returns a fresh random nonce for a pairing.
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// Commitment returns the hex-encoded commitment to nonce that onyx-admin sends before it
+// learns the engine's nonce.
+func Commitment(nonce []byte) string {
+	sum := sha256.Sum256(append([]byte(commitmentPrefix), nonce...))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyCommitment reports whether nonce is the one committed to.
+func VerifyCommitment(commitment string, nonce []byte) bool {
+	return subtle.ConstantTimeCompare([]byte(Commitment(nonce)), []byte(commitment)) == 1
+}
+
+// SessionBinding returns a value unique to a TLS session, which the engine uses to find the
+// first round of a pairing when the second arrives. It is derived like the verification code
+// but under its own label, so it reveals nothing about the code.
+func SessionBinding(cs tls.ConnectionState) (string, error) {
+	ekm, err := cs.ExportKeyingMaterial(sessionLabel, nil, 16)
+	if err != nil {
+		return "", fmt.Errorf("failed to bind pairing to the session: %w", err)
+	}
+	return hex.EncodeToString(ekm), nil
+}
+
+// ShortAuthString derives a six-digit code (e.g. "482 913") from a TLS session and the nonces of
+// both ends. Both ends of the same session compute the same code; a man-in-the-middle terminating
+// two separate sessions would show different codes on each side.
+//
+// onyx-admin commits to its nonce before the engine sends its own and reveals it only afterwards,
+// so whoever sits in the middle must fix everything under its control before the last input to
+// either code is known. Without that, it could grind its TLS key share until both codes agree.
+func ShortAuthString(cs tls.ConnectionState, adminNonce, engineNonce []byte) (string, error) {
+	if len(adminNonce) != NonceSize || len(engineNonce) != NonceSize {
+		return "", fmt.Errorf("failed to derive verification code: nonces must be %d bytes", NonceSize)
+	}
+
+	ekm, err := cs.ExportKeyingMaterial(sasLabel, append(append([]byte{}, adminNonce...), engineNonce...), 8)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive verification code: %w", err)
+	}
+
+	n := binary.BigEndian.Uint64(ekm) % 1000000
+	return fmt.Sprintf("%03d %03d", n/1000, n%1000), nil
+}
@@ -3,39 +3,58 @@
 package crypto
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
 	"time"
 )
 
-// NewMTLSClient creates an HTTP client configured with the user's Onyx certificates.
-// This client is used for all administrative communication with remote engines.
-func NewMTLSClient() (*http.Client, error) {
-	home, _ := os.UserHomeDir()
-	certDir := filepath.Join(home, ".config", "onyx", "certs")
-
-	certFile := filepath.Join(certDir, "client.crt")
-	keyFile := filepath.Join(certDir, "client.key")
-
+// NewMTLSClient creates an HTTP client that authenticates to one engine with the identity
+// issued by that engine. The engine must present a certificate issued by the CA pinned in
+// caFile during pairing. Every paired engine gets its own client.
+func NewMTLSClient(certFile, keyFile, caFile string) (*http.Client, error) {
 	// 1. Load the client's certificate and private key
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if certFile == "" {
+		return nil, fmt.Errorf("no client certificate for this node; re-pair it with 'onyx-admin pair'")
+	}
+
+	cert, err := loadClientCertificate(certFile, keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load client identity: %w", err)
 	}
 
-	// 2. Setup the TLS configuration
-	// In a production v1, we would also verify the Server's CA here.
+	// 2. Load the engine CA pinned at pairing time
+	if caFile == "" {
+		return nil, fmt.Errorf("no pinned engine CA for this node; re-pair it with 'onyx-admin pair'")
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pinned engine CA: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("pinned engine CA at %s is not a valid certificate", caFile)
+	}
+
+	// 3. Setup the TLS configuration
+	// Engines are verified by their fixed server name, since admins reach them by IP or any hostname.
 	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true, // Temporary: Server is using a self-signed session key
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   EngineServerName,
 	}
 
-	// 3. Create a transport with the TLS config
-	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
+	// 4. Create a transport with the TLS config
+	transport := &pinnedTransport{
+		base:   &http.Transport{TLSClientConfig: tlsConfig},
+		caFile: caFile,
 	}
 
 	return &http.Client{
@@ -43,3 +62,87 @@ func NewMTLSClient() (*http.Client, error) {
 		Timeout:   5 * time.Second,
 	}, nil
 }
+
+// loadClientCertificate pairs a certificate with its key, which may live in the onyx-admin agent.
+func loadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := ParseCertificate(certPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	signer, err := LoadSigner(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	pub, ok := leaf.PublicKey.(ed25519.PublicKey)
+	if !ok || !pub.Equal(signer.Public()) {
+		return tls.Certificate{}, fmt.Errorf("private key %s does not match certificate %s", keyFile, certFile)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  signer,
+		Leaf:        leaf,
+	}, nil
+}
+
+// pinnedTransport turns a certificate that does not chain to the pinned CA into an explicit
+// identity warning. Other verification failures, such as an expired certificate, are passed on
+// as they are.
+type pinnedTransport struct {
+	base   http.RoundTripper
+	caFile string
+}
+
+func (t *pinnedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+
+	var verifyErr *tls.CertificateVerificationError
+	var unknownCA x509.UnknownAuthorityError
+	if err != nil && errors.As(err, &verifyErr) && errors.As(verifyErr.Err, &unknownCA) {
+		return nil, &IdentityChangedError{
+			Address: req.URL.Host,
+			CAFile:  t.caFile,
+			Certs:   verifyErr.UnverifiedCertificates,
+			Err:     verifyErr.Err,
+		}
+	}
+
+	return resp, err
+}
+
+// IdentityChangedError reports an engine whose certificate does not chain to the pinned CA.
+type IdentityChangedError struct {
+	Address string
+	CAFile  string
+	Certs   []*x509.Certificate
+	Err     error
+}
+
+func (e *IdentityChangedError) Error() string {
+	presented := "none"
+	if len(e.Certs) > 0 {
+		presented = "SHA256:" + Fingerprint(e.Certs[0])
+	}
+
+	return fmt.Sprintf(`
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@       WARNING: ENGINE IDENTITY HAS CHANGED!             @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!
+Someone could be impersonating the engine at %s (man-in-the-middle attack).
+It is also possible that the engine was reinstalled and has a new CA.
+The certificate it presented is %s.
+It is not trusted by the CA pinned in %s: %v
+Connection refused. If the change is expected, re-pair this console with 'onyx-admin pair'.`,
+		e.Address, presented, e.CAFile, e.Err)
+}
+
+func (e *IdentityChangedError) Unwrap() error {
+	return e.Err
+}
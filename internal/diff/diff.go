@@ -0,0 +1,96 @@
+// Package diff renders line-based differences between texts, such as two Caddyfiles.
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aryann/difflib"
+)
+
+// contextLines is how many unchanged lines are shown around each change.
+const contextLines = 3
+
+// Unified returns a unified diff from oldText to newText, or "" if they are equal.
+func Unified(oldName, newName, oldText, newText string) string {
+	records := difflib.Diff(splitLines(oldText), splitLines(newText))
+
+	// 1. Find the records worth showing: every change plus its context
+	show := make([]bool, len(records))
+	changed := false
+	for i, r := range records {
+		if r.Delta == difflib.Common {
+			continue
+		}
+		changed = true
+		for j := max(0, i-contextLines); j <= min(len(records)-1, i+contextLines); j++ {
+			show[j] = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	// 2. Emit one hunk per run of shown records, tracking line numbers on both sides
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(records); {
+		if !show[i] {
+			oldLine, newLine = advance(records[i], oldLine, newLine)
+			i++
+			continue
+		}
+
+		var hunk strings.Builder
+		oldStart, newStart, oldCount, newCount := oldLine, newLine, 0, 0
+		for ; i < len(records) && show[i]; i++ {
+			r := records[i]
+			switch r.Delta {
+			case difflib.Common:
+				hunk.WriteString(" " + r.Payload + "\n")
+				oldCount++
+				newCount++
+			case difflib.LeftOnly:
+				hunk.WriteString("-" + r.Payload + "\n")
+				oldCount++
+			case difflib.RightOnly:
+				hunk.WriteString("+" + r.Payload + "\n")
+				newCount++
+			}
+			oldLine, newLine = advance(r, oldLine, newLine)
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n%s", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount), hunk.String())
+	}
+	return b.String()
+}
+
+func advance(r difflib.DiffRecord, oldLine, newLine int) (int, int) {
+	switch r.Delta {
+	case difflib.LeftOnly:
+		return oldLine + 1, newLine
+	case difflib.RightOnly:
+		return oldLine, newLine + 1
+	}
+	return oldLine + 1, newLine + 1
+}
+
+// hunkRange formats a hunk's start and length as in GNU diff, where an empty range starts
+// at the line before it.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
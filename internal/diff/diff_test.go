@@ -0,0 +1,119 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// site renders the n-th site the way `onyx-admin config diff` lists managed sites.
+func site(n int, waf, allow string) string {
+	return fmt.Sprintf("site%02d.example.com -> 10.0.0.%d:8080 (waf %s, allow %s)", n, n, waf, allow)
+}
+
+// sites lists sites from to through, with the WAF off and everyone allowed.
+func sites(from, through int) []string {
+	var lines []string
+	for n := from; n <= through; n++ {
+		lines = append(lines, site(n, "off", "everyone"))
+	}
+	return lines
+}
+
+// text joins lines into a file.
+func text(lines ...[]string) string {
+	var b strings.Builder
+	for _, part := range lines {
+		for _, l := range part {
+			b.WriteString(l + "\n")
+		}
+	}
+	return b.String()
+}
+
+// prefixed marks every line with a hunk prefix.
+func prefixed(prefix string, lines ...string) string {
+	return text(strings.Split(prefix+strings.Join(lines, "\n"+prefix), "\n"))
+}
+
+func TestUnified(t *testing.T) {
+	const header = "--- #1/sites\n+++ #2/sites\n"
+
+	// Expected hunks match GNU diff -u
+	tests := []struct {
+		name     string
+		old, new string
+		want     string // Hunks after the header, or "" for no diff
+	}{
+		{
+			name: "unchanged",
+			old:  text(sites(1, 12)),
+			new:  text(sites(1, 12)),
+		},
+		{
+			name: "both empty",
+		},
+		{
+			name: "site added",
+			old:  text(sites(1, 3)),
+			new:  text(sites(1, 4)),
+			want: "@@ -1,3 +1,4 @@\n" + prefixed(" ", sites(1, 3)...) + prefixed("+", site(4, "off", "everyone")),
+		},
+		{
+			name: "site removed",
+			old:  text(sites(1, 3)),
+			new:  text(sites(2, 3)),
+			want: "@@ -1,3 +1,2 @@\n" + prefixed("-", site(1, "off", "everyone")) + prefixed(" ", sites(2, 3)...),
+		},
+		{
+			name: "WAF mode changed",
+			old:  text(sites(1, 12)),
+			new:  text(sites(1, 5), []string{site(6, "block", "everyone")}, sites(7, 12)),
+			want: "@@ -3,7 +3,7 @@\n" + prefixed(" ", sites(3, 5)...) +
+				prefixed("-", site(6, "off", "everyone")) + prefixed("+", site(6, "block", "everyone")) +
+				prefixed(" ", sites(7, 9)...),
+		},
+		{
+			name: "access rules changed far apart",
+			old:  text(sites(1, 12)),
+			new: text(sites(1, 1), []string{site(2, "off", "10.0.0.0/8")}, sites(3, 10),
+				[]string{site(11, "off", "10.0.0.0/8, 192.168.1.10/32")}, sites(12, 12)),
+			want: "@@ -1,5 +1,5 @@\n" + prefixed(" ", sites(1, 1)...) +
+				prefixed("-", site(2, "off", "everyone")) + prefixed("+", site(2, "off", "10.0.0.0/8")) +
+				prefixed(" ", sites(3, 5)...) +
+				"@@ -8,5 +8,5 @@\n" + prefixed(" ", sites(8, 10)...) +
+				prefixed("-", site(11, "off", "everyone")) + prefixed("+", site(11, "off", "10.0.0.0/8, 192.168.1.10/32")) +
+				prefixed(" ", sites(12, 12)...),
+		},
+		{
+			name: "changes close together share a hunk",
+			old:  text(sites(1, 11)),
+			new:  text(sites(1, 3), []string{site(4, "detect", "everyone")}, sites(5, 10), []string{site(12, "off", "everyone")}),
+			want: "@@ -1,11 +1,11 @@\n" + prefixed(" ", sites(1, 3)...) +
+				prefixed("-", site(4, "off", "everyone")) + prefixed("+", site(4, "detect", "everyone")) +
+				prefixed(" ", sites(5, 10)...) +
+				prefixed("-", site(11, "off", "everyone")) + prefixed("+", site(12, "off", "everyone")),
+		},
+		{
+			name: "from nothing",
+			new:  text(sites(1, 2)),
+			want: "@@ -0,0 +1,2 @@\n" + prefixed("+", sites(1, 2)...),
+		},
+		{
+			name: "to nothing",
+			old:  text(sites(1, 2)),
+			want: "@@ -1,2 +0,0 @@\n" + prefixed("-", sites(1, 2)...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want != "" {
+				want = header + want
+			}
+			if got := Unified("#1/sites", "#2/sites", tt.old, tt.new); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
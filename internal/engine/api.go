@@ -0,0 +1,249 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"onyx/internal/api"
+)
+
+// newAPIHandler builds the versioned engine API served to local and remote clients.
+// Every endpoint declares the least role that may call it.
+func (e *Engine) newAPIHandler() http.Handler {
+	v := "/" + api.Version
+	mux := http.NewServeMux()
+	e.route(mux, "GET "+v+"/status", api.RoleViewer, e.handleStatus)
+	e.route(mux, "POST "+v+"/reload", api.RoleOperator, e.handleReload)
+	e.route(mux, "POST "+v+"/renew", api.RoleViewer, e.handleRenew)
+	e.route(mux, "GET "+v+"/clients", api.RoleViewer, e.handleListClients)
+	e.route(mux, "GET "+v+"/clients/{fingerprint}", api.RoleViewer, e.handleGetClient)
+	e.route(mux, "PATCH "+v+"/clients/{fingerprint}", api.RoleOwner, e.handleRenameClient)
+	e.route(mux, "POST "+v+"/clients/revoke", api.RoleOwner, e.handleRevokeAllClients)
+	e.route(mux, "POST "+v+"/clients/{fingerprint}/revoke", api.RoleOwner, e.handleRevokeClient)
+	e.route(mux, "POST "+v+"/ca/rotate", api.RoleOwner, e.handleRotateCA)
+	e.route(mux, "GET "+v+"/audit", api.RoleOwner, e.handleAudit)
+	e.route(mux, "POST "+v+"/invites", api.RoleOwner, e.handleInvite)
+	e.route(mux, "POST "+v+"/pairing", api.RoleOwner, e.handleOpenPairing)
+	e.route(mux, "POST "+v+"/pairing/{id}/confirm", api.RoleOwner, e.handleConfirmPairing)
+	e.route(mux, "GET "+v+"/sites", api.RoleViewer, e.handleListSites)
+	e.route(mux, "GET "+v+"/sites/{host}", api.RoleViewer, e.handleGetSite)
+	e.route(mux, "POST "+v+"/sites", api.RoleOperator, e.handleCreateSite)
+	e.route(mux, "PUT "+v+"/sites", api.RoleOperator, e.handleSyncSites)
+	e.route(mux, "PUT "+v+"/sites/{host}", api.RoleOperator, e.handleUpdateSite)
+	e.route(mux, "DELETE "+v+"/sites/{host}", api.RoleOperator, e.handleDeleteSite)
+	e.route(mux, "POST "+v+"/config/validate", api.RoleOperator, e.handleValidateConfig)
+	e.route(mux, "GET "+v+"/config/history", api.RoleViewer, e.handleConfigHistory)
+	e.route(mux, "GET "+v+"/config/history/{id}", api.RoleOperator, e.handleConfigSnapshot)
+	e.route(mux, "POST "+v+"/config/history/{id}/rollback", api.RoleOperator, e.handleConfigRollback)
+	e.route(mux, "GET "+v+"/changes", api.RoleOwner, e.handleListChanges)
+	e.route(mux, "POST "+v+"/changes/{id}/approve", api.RoleOwner, e.handleApproveChange)
+	e.route(mux, "POST "+v+"/changes/{id}/reject", api.RoleOwner, e.handleRejectChange)
+	return mux
+}
+
+func (e *Engine) handleStatus(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+
+	status := api.Status{
+		Version:   e.opts.Version,
+		Hostname:  hostname,
+		StartedAt: e.startedAt,
+		Proxy: api.ProxyStatus{
+			Healthy:   true,
+			Summary:   e.proxy.Summary(),
+			Caddyfile: e.opts.Caddyfile,
+			Upstreams: e.proxy.UpstreamHealth(),
+		},
+	}
+	if err := e.proxy.Healthy(); err != nil {
+		status.Proxy.Healthy = false
+		status.Proxy.Error = err.Error()
+	}
+
+	authority, err := DescribeAuthority(e.ca(), e.clients)
+	if err != nil {
+		log.Printf("Failed to describe CA: %v", err)
+	}
+	status.Authority = authority
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (e *Engine) handleReload(w http.ResponseWriter, r *http.Request) {
+	res := api.ReloadResult{Success: true}
+	err := e.Reload("api", callerOf(r))
+	if err != nil {
+		res = api.ReloadResult{Success: false, Error: err.Error()}
+	}
+	e.audit(r, "reload", e.opts.Caddyfile, err)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (e *Engine) handleRenew(w http.ResponseWriter, r *http.Request) {
+	caller := callerOf(r).Client
+	if caller == nil {
+		writeError(w, http.StatusBadRequest, "renewal needs a client certificate; connect over the control plane")
+		return
+	}
+
+	var req api.RenewRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	// The replacement keeps the role of the certificate that authenticated this request.
+	// During a CA rotation it is issued by the new CA, which moves the console over.
+	ca := e.ca()
+	certPEM, err := ca.SignCSR([]byte(req.CSR), caller.Role)
+	if err != nil {
+		e.audit(r, "client.renew", caller.Fingerprint, err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	info, err := e.clients.Renew(caller.Fingerprint, certPEM)
+	if err != nil {
+		e.audit(r, "client.renew", caller.Fingerprint, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	e.audit(r, "client.renew", info.Fingerprint, nil)
+
+	log.Printf("Renewed client %s: %s replaces %s", info.Name, info.Fingerprint[:16], caller.Fingerprint[:16])
+	writeJSON(w, http.StatusOK, api.RenewResponse{
+		Certificate:   string(certPEM),
+		CACertificate: string(ca.Bundle()),
+		Client:        *info,
+	})
+}
+
+func (e *Engine) handleListClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := e.clients.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (e *Engine) handleGetClient(w http.ResponseWriter, r *http.Request) {
+	info, err := e.clients.Get(r.PathValue("fingerprint"))
+	writeClientResult(w, info, err)
+}
+
+func (e *Engine) handleRenameClient(w http.ResponseWriter, r *http.Request) {
+	var req api.RenameRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	info, err := e.clients.Rename(r.PathValue("fingerprint"), req.Name)
+	e.audit(r, "client.rename", auditTarget(r, info), err)
+	writeClientResult(w, info, err)
+}
+
+func (e *Engine) handleRevokeClient(w http.ResponseWriter, r *http.Request) {
+	// A proposal names the console by its full fingerprint, so a prefix can never come to mean
+	// another console by the time it is approved
+	info, err := e.clients.Get(r.PathValue("fingerprint"))
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	e.runGuarded(w, r, "client.revoke", info.Fingerprint, nil)
+}
+
+func (e *Engine) handleRevokeAllClients(w http.ResponseWriter, r *http.Request) {
+	e.runGuarded(w, r, "clients.revoke", "", nil)
+}
+
+func (e *Engine) handleRotateCA(w http.ResponseWriter, r *http.Request) {
+	req := api.RotateRequest{Overlap: DefaultRotationOverlap.String()}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	overlap, err := time.ParseDuration(req.Overlap)
+	if err != nil || overlap <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid overlap %q", req.Overlap))
+		return
+	}
+
+	e.runGuarded(w, r, "ca.rotate", "", api.RotateRequest{Overlap: overlap.String()})
+}
+
+func (e *Engine) handleAudit(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := api.AuditQuery{Actor: params.Get("actor"), Action: params.Get("action")}
+
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s %q, expected RFC 3339", name, v))
+				return
+			}
+			*t = parsed
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", v))
+			return
+		}
+		q.Limit = limit
+	}
+
+	report, err := e.auditLog.Query(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// auditTarget names the client a request acted on: its full fingerprint when it was found,
+// otherwise the reference from the path.
+func auditTarget(r *http.Request, info *api.ClientInfo) string {
+	if info != nil {
+		return info.Fingerprint
+	}
+	return r.PathValue("fingerprint")
+}
+
+// writeClientResult maps registry errors onto HTTP status codes.
+func writeClientResult(w http.ResponseWriter, info *api.ClientInfo, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownClient):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// writeJSON encodes v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// writeError sends a JSON error body with the given status code.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, api.ErrorResponse{Error: msg})
+}
@@ -0,0 +1,486 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+)
+
+// Files of the two-person approval policy and the changes waiting on it.
+const (
+	ApprovalPolicyPath = AuthDir + "/approval.json"
+	ChangesPath        = AuthDir + "/changes.json"
+)
+
+// DefaultApprovalWindow is how long a proposal waits for a second owner unless the policy says otherwise.
+const DefaultApprovalWindow = time.Hour
+
+// Errors returned when deciding on a pending change.
+var (
+	ErrUnknownChange   = errors.New("no such pending change")
+	ErrChangeExpired   = errors.New("the change expired before it was approved")
+	ErrSameApprover    = errors.New("a change must be approved by a different owner than the one who proposed it, and not one it invited or was invited by")
+	ErrProposerRevoked = errors.New("the owner who proposed the change no longer has access")
+)
+
+// LoadApprovalPolicy reads the policy at path. A missing file means approval is not required.
+func LoadApprovalPolicy(path string) (api.ApprovalPolicy, error) {
+	policy := api.ApprovalPolicy{Window: DefaultApprovalWindow.String()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return policy, nil
+	}
+	if err != nil {
+		return policy, fmt.Errorf("failed to read approval policy: %w", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to read approval policy: %w", err)
+	}
+	if _, err := approvalWindow(policy); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+// SaveApprovalPolicy writes policy to path, where the running engine picks it up on the next request.
+func SaveApprovalPolicy(path string, policy api.ApprovalPolicy) error {
+	if _, err := approvalWindow(policy); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0640); err != nil {
+		return fmt.Errorf("failed to save approval policy: %w", err)
+	}
+	chownToEngine(path)
+	return nil
+}
+
+func approvalWindow(policy api.ApprovalPolicy) (time.Duration, error) {
+	window, err := time.ParseDuration(policy.Window)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid approval window %q", policy.Window)
+	}
+	return window, nil
+}
+
+// guardedOp carries out an action that may need a second owner's approval on behalf of by,
+// the caller or the approving owner. The returned target names what was acted on for the
+// audit log, and after, if set, runs once the response has been sent.
+type guardedOp func(e *Engine, by identity, target string, params json.RawMessage) (result any, auditTarget string, after func(), err error)
+
+// guardedOps lists the destructive actions covered by the approval policy, keyed by audit action.
+// Owner invitations are among them, since a second owner could approve anything. The engine has
+// no maintenance mode, so switching to it is not guarded.
+var guardedOps = map[string]guardedOp{
+	"client.revoke":   revokeClientOp,
+	"clients.revoke":  revokeAllClientsOp,
+	"config.rollback": rollbackOp,
+	"ca.rotate":       rotateCAOp,
+	"invite.create":   inviteOp,
+	"site.delete":     deleteSiteOp,
+	"sites.sync":      syncSitesOp,
+}
+
+func revokeClientOp(e *Engine, by identity, ref string, _ json.RawMessage) (any, string, func(), error) {
+	info, err := e.clients.Revoke(ref)
+	if err != nil {
+		return nil, ref, nil, err
+	}
+
+	// New handshakes are refused by the CRL; sessions that are already open are cut off once
+	// the response is out, in case the client revoked itself.
+	after := func() {
+		closed := e.sessions.Close(info.Fingerprint)
+		log.Printf("Revoked client %s (%s) on behalf of %s, closed %d open session(s)", info.Name, info.Fingerprint, by, closed)
+	}
+	return info, info.Fingerprint, after, nil
+}
+
+func revokeAllClientsOp(e *Engine, by identity, _ string, _ json.RawMessage) (any, string, func(), error) {
+	revoked, err := e.clients.RevokeAll()
+	target := fmt.Sprintf("%d client(s)", len(revoked))
+	after := func() {
+		closed := 0
+		for _, info := range revoked {
+			closed += e.sessions.Close(info.Fingerprint)
+		}
+		log.Printf("Revoked %d client(s) on behalf of %s, closed %d open session(s)", len(revoked), by, closed)
+	}
+	if err != nil {
+		// Whatever was revoked before the failure stays revoked and is cut off
+		after()
+		return nil, target, nil, err
+	}
+	if revoked == nil {
+		revoked = []api.ClientInfo{}
+	}
+	return revoked, target, after, nil
+}
+
+func rotateCAOp(e *Engine, by identity, _ string, params json.RawMessage) (any, string, func(), error) {
+	var req api.RotateRequest
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, "", nil, fmt.Errorf("malformed rotation parameters: %w", err)
+	}
+	overlap, err := time.ParseDuration(req.Overlap)
+	if err != nil || overlap <= 0 {
+		return nil, "", nil, fmt.Errorf("invalid overlap %q", req.Overlap)
+	}
+
+	target := "overlap " + overlap.String()
+	ca, err := e.RotateCA(overlap)
+	if err != nil {
+		return nil, target, nil, err
+	}
+	status, err := DescribeAuthority(ca, e.clients)
+	if err != nil {
+		return nil, target, nil, err
+	}
+
+	log.Printf("Rotated the engine CA on behalf of %s; %s is trusted until %s", by, status.Rotation.PreviousFingerprint[:16], status.Rotation.RetiresAt.Format(time.RFC3339))
+	return status, target, nil, nil
+}
+
+// writeOpError maps the errors of guarded operations onto HTTP status codes.
+func writeOpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownClient), errors.Is(err, ErrUnknownSite), errors.Is(err, ErrUnknownSnapshot):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrRotationInProgress), errors.Is(err, ErrSiteExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrSitesStale):
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// runGuarded carries out action for the caller of r, or queues it for a second owner when the
+// approval policy is enabled. The policy binds the control plane only: whoever can use the
+// local socket is root on the host and could edit the policy anyway.
+func (e *Engine) runGuarded(w http.ResponseWriter, r *http.Request, action, target string, params any) {
+	var raw json.RawMessage
+	if params != nil {
+		var err error
+		if raw, err = json.Marshal(params); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	caller := callerOf(r)
+	if caller.Client != nil {
+		policy, err := LoadApprovalPolicy(e.opts.ApprovalPolicy)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if policy.Enabled {
+			window, _ := approvalWindow(policy)
+			change, err := e.changes.Propose(action, target, raw, caller.Client, window)
+			if err != nil {
+				e.audit(r, "change.propose", action+" "+target, err)
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			e.audit(r, "change.propose", change.ID, nil)
+			log.Printf("Change %s (%s %s) proposed by %s, waiting for a second owner", change.ID, action, target, caller)
+			writeJSON(w, http.StatusAccepted, change)
+			return
+		}
+	}
+
+	result, auditTarget, after, err := guardedOps[action](e, caller, target, raw)
+	e.audit(r, action, auditTarget, err)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+	if after != nil {
+		http.NewResponseController(w).Flush()
+		after()
+	}
+}
+
+func (e *Engine) handleListChanges(w http.ResponseWriter, r *http.Request) {
+	policy, err := LoadApprovalPolicy(e.opts.ApprovalPolicy)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, api.ChangeList{Policy: policy, Changes: e.changes.List()})
+}
+
+func (e *Engine) handleApproveChange(w http.ResponseWriter, r *http.Request) {
+	caller := callerOf(r)
+	if caller.Client == nil {
+		writeError(w, http.StatusBadRequest, "approval needs an owner's client certificate; connect over the control plane")
+		return
+	}
+
+	// 1. Take the change off the queue, checking that a different console approves it
+	change, err := e.changes.Take(r.PathValue("id"), func(pending *api.PendingChange) error {
+		if info, err := e.clients.Get(pending.ProposedBy); err != nil || (info.Revoked && info.ReplacedBy == "") {
+			return ErrProposerRevoked
+		}
+		same, err := sameOwner(e.clients, pending.ProposedBy, caller.Client.Fingerprint)
+		if err != nil {
+			return err
+		}
+		if same {
+			return ErrSameApprover
+		}
+		return nil
+	})
+	if err != nil {
+		e.audit(r, "change.approve", r.PathValue("id"), err)
+		switch {
+		case errors.Is(err, ErrUnknownChange):
+			writeError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, ErrChangeExpired):
+			writeError(w, http.StatusGone, err.Error())
+		case errors.Is(err, ErrSameApprover), errors.Is(err, ErrProposerRevoked):
+			writeError(w, http.StatusForbidden, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	entry := caller.auditEntry("change.approve", change.ID)
+	entry.Remote = r.RemoteAddr
+	entry.Detail = fmt.Sprintf("%s %s proposed by %s", change.Action, change.Target, change.ProposedBy)
+	e.auditLog.Record(entry)
+
+	// 2. Carry it out on behalf of the approving owner
+	log.Printf("Change %s (%s %s) proposed by %s approved by %s", change.ID, change.Action, change.Target, change.ProposedByName, caller)
+	result, auditTarget, after, err := guardedOps[change.Action](e, caller, change.Target, change.Params)
+	e.audit(r, change.Action, auditTarget, err)
+
+	change.Status = api.ChangeExecuted
+	change.DecidedBy, change.DecidedByName, change.DecidedAt = caller.Client.Fingerprint, caller.Client.Name, time.Now().UTC()
+	if err != nil {
+		change.Status, change.Error = api.ChangeFailed, err.Error()
+	} else if change.Result, err = json.Marshal(result); err != nil {
+		log.Printf("Failed to encode the result of change %s: %v", change.ID, err)
+	}
+
+	writeJSON(w, http.StatusOK, change)
+	if after != nil {
+		http.NewResponseController(w).Flush()
+		after()
+	}
+}
+
+// sameOwner reports whether the consoles a and b may belong to the same owner: one is a renewal
+// of the other, or one invited the other, directly or through further invitations. An owner
+// could otherwise invite a second identity and approve their own changes with it.
+func sameOwner(clients *Registry, a, b string) (bool, error) {
+	chainA, err := clients.Ancestry(a)
+	if err != nil {
+		return false, err
+	}
+	chainB, err := clients.Ancestry(b)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(chainA, chainB[0]) || slices.Contains(chainB, chainA[0]), nil
+}
+
+func (e *Engine) handleRejectChange(w http.ResponseWriter, r *http.Request) {
+	change, err := e.changes.Take(r.PathValue("id"), nil)
+	if errors.Is(err, ErrChangeExpired) {
+		err = nil // Rejecting an expired change only tidies up
+	}
+	e.audit(r, "change.reject", r.PathValue("id"), err)
+	if errors.Is(err, ErrUnknownChange) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	caller := callerOf(r)
+	change.Status, change.DecidedAt = api.ChangeRejected, time.Now().UTC()
+	change.DecidedBy = "local"
+	if caller.Client != nil {
+		change.DecidedBy, change.DecidedByName = caller.Client.Fingerprint, caller.Client.Name
+	}
+
+	log.Printf("Change %s (%s %s) rejected by %s", change.ID, change.Action, change.Target, caller)
+	writeJSON(w, http.StatusOK, change)
+}
+
+// ChangeQueue holds the changes waiting for a second owner. Only pending changes are kept;
+// what became of each one is in the audit log.
+type ChangeQueue struct {
+	path string
+
+	mu      sync.Mutex
+	pending map[string]*api.PendingChange
+}
+
+// OpenChangeQueue loads the pending changes at path, dropping expired ones.
+func OpenChangeQueue(path string) (*ChangeQueue, error) {
+	q := &ChangeQueue{path: path, pending: make(map[string]*api.PendingChange)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read pending changes: %w", err)
+	}
+	if len(data) > 0 {
+		var list []*api.PendingChange
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to read pending changes: %w", err)
+		}
+		for _, c := range list {
+			if time.Now().Before(c.ExpiresAt) {
+				q.pending[c.ID] = c
+			}
+		}
+	}
+	return q, nil
+}
+
+// Propose queues action on target for approval within window. Proposing an action that is
+// already pending with the same parameters returns the existing change.
+func (q *ChangeQueue) Propose(action, target string, params json.RawMessage, by *api.ClientInfo, window time.Duration) (*api.PendingChange, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range q.pending {
+		if c.Action == action && c.Target == target && sameParams(c.Params, params) && time.Now().Before(c.ExpiresAt) {
+			existing := *c
+			return &existing, nil
+		}
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	c := &api.PendingChange{
+		ID:             hex.EncodeToString(id),
+		Action:         action,
+		Target:         target,
+		Params:         params,
+		ProposedBy:     by.Fingerprint,
+		ProposedByName: by.Name,
+		ProposedAt:     now,
+		ExpiresAt:      now.Add(window),
+		Status:         api.ChangePending,
+	}
+
+	q.pending[c.ID] = c
+	if err := q.save(); err != nil {
+		delete(q.pending, c.ID)
+		return nil, err
+	}
+	proposed := *c
+	return &proposed, nil
+}
+
+// List returns the changes still waiting for approval, oldest first.
+func (q *ChangeQueue) List() []api.PendingChange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]api.PendingChange, 0, len(q.pending))
+	for _, c := range q.pending {
+		if time.Now().Before(c.ExpiresAt) {
+			list = append(list, *c)
+		}
+	}
+	sortChanges(list)
+	return list
+}
+
+// Take removes the change with id from the queue once check, if given, accepts it. An expired
+// change is removed as well, but returned together with ErrChangeExpired.
+func (q *ChangeQueue) Take(id string, check func(*api.PendingChange) error) (*api.PendingChange, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.pending[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownChange, id)
+	}
+	if time.Now().After(c.ExpiresAt) {
+		delete(q.pending, id)
+		if err := q.save(); err != nil {
+			log.Printf("Failed to save pending changes: %v", err)
+		}
+		return c, ErrChangeExpired
+	}
+	if check != nil {
+		if err := check(c); err != nil {
+			return nil, err
+		}
+	}
+
+	delete(q.pending, id)
+	if err := q.save(); err != nil {
+		q.pending[id] = c
+		return nil, err
+	}
+	return c, nil
+}
+
+// save writes the unexpired changes. Callers must hold q.mu.
+func (q *ChangeQueue) save() error {
+	list := make([]api.PendingChange, 0, len(q.pending))
+	for id, c := range q.pending {
+		if time.Now().After(c.ExpiresAt) {
+			delete(q.pending, id)
+			continue
+		}
+		list = append(list, *c)
+	}
+	sortChanges(list)
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(q.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save pending changes: %w", err)
+	}
+	return nil
+}
+
+// sameParams compares the parameters of two changes regardless of how they were indented
+// when the queue was saved.
+func sameParams(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func sortChanges(list []api.PendingChange) {
+	slices.SortFunc(list, func(a, b api.PendingChange) int { return a.ProposedAt.Compare(b.ProposedAt) })
+}
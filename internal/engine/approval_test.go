@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+)
+
+// issueClient has ca certify a fresh key for a console named name.
+func issueClient(t *testing.T, ca *Authority, name string, role api.Role) []byte {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := crypto.GenerateCSR(priv, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ca.SignCSR(csr, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM
+}
+
+// newTestRegistry opens an empty client registry under a fresh CA.
+func newTestRegistry(t *testing.T) (*Authority, *Registry) {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := LoadOrCreateAuthority(filepath.Join(dir, "auth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadRevocationList(ca, filepath.Join(dir, "auth", "ca.crl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := OpenRegistry(filepath.Join(dir, "auth", "clients"), crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, reg
+}
+
+func TestSameOwner(t *testing.T) {
+	ca, reg := newTestRegistry(t)
+	add := func(name, invitedBy string) string {
+		info, err := reg.Add(issueClient(t, ca, name, api.RoleOwner), invitedBy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Fingerprint
+	}
+
+	alice := add("alice", "")
+	bob := add("bob", "")
+	aliceAlt := add("alice-alt", alice)        // Invited by alice
+	aliceAltAlt := add("alice-alt2", aliceAlt) // Invited by alice's second identity
+	carol := add("carol", bob)                 // Invited by bob
+	dave := add("dave", bob)                   // Also invited by bob
+
+	renewed, err := reg.Renew(alice, issueClient(t, ca, "alice", api.RoleOwner))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"itself", alice, alice, true},
+		{"renewal", alice, renewed.Fingerprint, true},
+		{"invited", alice, aliceAlt, true},
+		{"inviter", aliceAlt, alice, true},
+		{"invited through an invitee", aliceAltAlt, alice, true},
+		{"invited by a renewed certificate's lineage", renewed.Fingerprint, aliceAltAlt, true},
+		{"unrelated", alice, bob, false},
+		{"invited by someone else", aliceAlt, carol, false},
+		{"invited by the same owner", carol, dave, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			same, err := sameOwner(reg, tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same != tt.same {
+				t.Errorf("sameOwner = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+
+	"golang.org/x/sys/unix"
+)
+
+// AuditPath is the engine's append-only audit log, one JSON entry per line.
+const AuditPath = StateDir + "/audit.log"
+
+// AuditLog is the hash-chained record of every control-plane action. Both the engine and
+// `onyx` commands run on the host append to it, so writers serialise on a file lock and
+// pick up entries added by other processes before extending the chain. The chain is unkeyed:
+// it exposes edits to part of the log, but a truncated tail or a rewritten log verifies
+// cleanly unless a running writer saw the file shrink.
+type AuditLog struct {
+	path string
+
+	mu     sync.Mutex
+	seq    uint64 // Sequence number of the last entry
+	last   string // Hash of the last entry
+	size   int64  // Bytes of the file already read
+	broken error  // First break found in the chain, nil while it is intact
+}
+
+// OpenAuditLog opens the audit log at path, creating it if needed, and verifies the whole chain.
+// A broken chain is not an error here: it is reported by Verify, and new entries continue
+// from the last one on disk so that the break stays visible.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	chownToEngine(path)
+
+	a := &AuditLog{path: path}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH); err != nil {
+		return nil, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+	if err := a.catchUp(f); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Verify returns the first break in the chain, or nil if every entry links to the one before.
+func (a *AuditLog) Verify() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.broken
+}
+
+// Record appends entry to the log, filling in its time, sequence number and hashes.
+// Failures are logged rather than returned, so auditing never blocks the action itself.
+// Recording to a nil log does nothing.
+func (a *AuditLog) Record(entry api.AuditEntry) {
+	if a == nil {
+		return
+	}
+	if err := a.append(entry); err != nil {
+		log.Printf("Failed to write audit entry %q: %v", entry.Action, err)
+	}
+}
+
+func (a *AuditLog) append(entry api.AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	// 1. Another process may have appended since we last looked
+	if err := a.catchUp(f); err != nil {
+		return err
+	}
+
+	// 2. Link the entry to the current end of the chain
+	entry.Seq = a.seq + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev = a.last
+	entry.Hash = ""
+	if entry.Result == "" {
+		entry.Result = api.AuditOK
+	}
+	hash, err := auditHash(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// 3. Write it in one call, so readers never see half an entry from a live writer
+	n, err := f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	a.seq, a.last, a.size = entry.Seq, entry.Hash, a.size+int64(n)
+	return nil
+}
+
+// Query returns the entries matching q, oldest first, after verifying the whole chain again.
+func (a *AuditLog) Query(q api.AuditQuery) (*api.AuditReport, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH); err != nil {
+		return nil, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	report := &api.AuditReport{Verified: true, Entries: []api.AuditEntry{}}
+	chain := &AuditLog{}
+	err = chain.scan(f, func(e api.AuditEntry) {
+		if auditMatches(e, q) {
+			report.Entries = append(report.Entries, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if chain.broken != nil {
+		report.Verified, report.Error = false, chain.broken.Error()
+	}
+	if q.Limit > 0 && len(report.Entries) > q.Limit {
+		report.Entries = report.Entries[len(report.Entries)-q.Limit:]
+	}
+	return report, nil
+}
+
+// catchUp reads and verifies whatever was appended to f since the last read. Callers must hold
+// a lock on f, and a.mu unless a is not shared yet.
+func (a *AuditLog) catchUp(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == a.size {
+		return nil
+	}
+	if info.Size() < a.size && a.broken == nil {
+		a.broken = fmt.Errorf("audit log shrank from %d to %d bytes", a.size, info.Size())
+	}
+
+	if _, err := f.Seek(min(a.size, info.Size()), io.SeekStart); err != nil {
+		return err
+	}
+	if err := a.scan(f, nil); err != nil {
+		return err
+	}
+	a.size = info.Size()
+	return nil
+}
+
+// scan verifies entries read from r against the chain state in a, advancing it, and passes
+// each entry to fn. A broken link is recorded once; later entries are checked against the
+// entry before them so the rest of the log is still verified.
+func (a *AuditLog) scan(r io.Reader, fn func(api.AuditEntry)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var e api.AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			a.markBroken(fmt.Errorf("unreadable entry after #%d: %w", a.seq, err))
+			continue
+		}
+
+		want, err := auditHash(e)
+		switch {
+		case err != nil:
+			return err
+		case e.Hash != want:
+			a.markBroken(fmt.Errorf("entry #%d was modified: its hash does not match its contents", e.Seq))
+		case e.Seq != a.seq+1 || e.Prev != a.last:
+			a.markBroken(fmt.Errorf("entry #%d does not follow entry #%d: entries were removed or reordered", e.Seq, a.seq))
+		}
+
+		a.seq, a.last = e.Seq, e.Hash
+		if fn != nil {
+			fn(e)
+		}
+	}
+	return sc.Err()
+}
+
+func (a *AuditLog) markBroken(err error) {
+	if a.broken == nil {
+		a.broken = err
+	}
+}
+
+// auditHash is the SHA-256 of the entry's JSON encoding with an empty Hash field. The encoding
+// includes Prev, which chains the entry to its predecessor.
+func auditHash(e api.AuditEntry) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditMatches reports whether e is selected by q.
+func auditMatches(e api.AuditEntry, q api.AuditQuery) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Action != "" && e.Action != q.Action && !strings.HasPrefix(e.Action, q.Action+".") {
+		return false
+	}
+	if q.Actor != "" && !strings.HasPrefix(e.Actor, strings.ToLower(q.Actor)) && !strings.EqualFold(e.ActorName, q.Actor) {
+		return false
+	}
+	return true
+}
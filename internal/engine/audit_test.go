@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"onyx/internal/api"
+)
+
+// recordN appends n entries to a fresh audit log and returns its path.
+func recordN(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		a.Record(api.AuditEntry{Actor: "local", Action: "config.reload", Detail: fmt.Sprintf("reload %d", i+1)})
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatalf("fresh chain does not verify: %v", err)
+	}
+	return path
+}
+
+// rewrite applies fn to the lines of the log at path.
+func rewrite(t *testing.T, path string, fn func(lines [][]byte) [][]byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := fn(bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+	if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// editEntry changes the detail of the i-th line, rehashing it if rehash is set.
+func editEntry(t *testing.T, lines [][]byte, i int, rehash bool) [][]byte {
+	var e api.AuditEntry
+	if err := json.Unmarshal(lines[i], &e); err != nil {
+		t.Fatal(err)
+	}
+	e.Detail = "nothing to see here"
+	if rehash {
+		var err error
+		if e.Hash, err = auditHash(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines[i] = line
+	return lines
+}
+
+func TestAuditChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, lines [][]byte) [][]byte
+		broken string // Part of the reported break, or "" for an intact chain
+	}{
+		{"intact", func(t *testing.T, l [][]byte) [][]byte { return l }, ""},
+		{"edited entry", func(t *testing.T, l [][]byte) [][]byte { return editEntry(t, l, 1, false) }, "entry #2 was modified"},
+		{"edited and rehashed entry", func(t *testing.T, l [][]byte) [][]byte { return editEntry(t, l, 1, true) }, "entry #3 does not follow entry #2"},
+		{"deleted entry", func(t *testing.T, l [][]byte) [][]byte { return append(l[:1], l[2:]...) }, "entry #3 does not follow entry #1"},
+		{"reordered entries", func(t *testing.T, l [][]byte) [][]byte { l[1], l[2] = l[2], l[1]; return l }, "entry #3 does not follow entry #1"},
+		{"garbage line", func(t *testing.T, l [][]byte) [][]byte {
+			return append(l[:2], append([][]byte{[]byte("{oops")}, l[2:]...)...)
+		}, "unreadable entry after #2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := recordN(t, 4)
+			rewrite(t, path, func(lines [][]byte) [][]byte { return tt.tamper(t, lines) })
+
+			// Both a fresh open and a query verify the whole chain
+			a, err := OpenAuditLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := a.Query(api.AuditQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			verr := a.Verify()
+			if tt.broken == "" {
+				if verr != nil || !report.Verified {
+					t.Fatalf("intact chain reported broken: %v, %s", verr, report.Error)
+				}
+				return
+			}
+			if verr == nil || !strings.Contains(verr.Error(), tt.broken) {
+				t.Errorf("Verify = %v, want a break containing %q", verr, tt.broken)
+			}
+			if report.Verified || !strings.Contains(report.Error, tt.broken) {
+				t.Errorf("query reported verified=%v error %q, want a break containing %q", report.Verified, report.Error, tt.broken)
+			}
+		})
+	}
+}
+
+func TestAuditChainDetectsTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		a.Record(api.AuditEntry{Actor: "local", Action: "client.revoke"})
+	}
+
+	rewrite(t, path, func(l [][]byte) [][]byte { return l[:2] })
+
+	// The chain that is left is consistent, but the running writer knows how much it had read
+	a.Record(api.AuditEntry{Actor: "local", Action: "config.reload"})
+	if err := a.Verify(); err == nil || !strings.Contains(err.Error(), "shrank") {
+		t.Errorf("writer did not notice the truncation: %v", err)
+	}
+
+	// The entry it appended still links to the one that was cut, so later readers see the gap
+	report, err := a.Query(api.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Verified || !strings.Contains(report.Error, "entry #4 does not follow entry #2") {
+		t.Errorf("got verified=%v error %q, want the gap before entry #4", report.Verified, report.Error)
+	}
+}
+
+func TestAuditConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Two handles on one file stand in for the engine and an `onyx` command on the host
+	const writers, perWriter = 2, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		a, err := OpenAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				a.Record(api.AuditEntry{Actor: "local", Action: "config.reload", Detail: fmt.Sprintf("writer %d entry %d", w, i)})
+			}
+		}()
+	}
+	wg.Wait()
+
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := a.Query(api.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified {
+		t.Fatalf("interleaved writers broke the chain: %s", report.Error)
+	}
+	if len(report.Entries) != writers*perWriter {
+		t.Fatalf("got %d entries, want %d", len(report.Entries), writers*perWriter)
+	}
+	for i, e := range report.Entries {
+		if e.Seq != uint64(i+1) {
+			t.Fatalf("entry %d has sequence number %d", i, e.Seq)
+		}
+	}
+}
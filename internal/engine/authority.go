@@ -0,0 +1,311 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+)
+
+// caValidity is how long a freshly created engine CA remains valid.
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// serverCertValidity bounds the lifetime of the server certificate issued at each start.
+const serverCertValidity = 90 * 24 * time.Hour
+
+// engineUser is the system account that owns the engine's state on an installed host.
+const engineUser = "onyx"
+
+// Layout of a rotation in progress inside the authority directory.
+const (
+	rotationFile = "rotation.json" // Rotation state while the previous CA is still trusted
+	previousDir  = "previous"      // Key and certificate of the CA being rotated out
+)
+
+// ErrRotationInProgress is returned when a CA rotation is requested while the previous one is
+// still in its overlap period.
+var ErrRotationInProgress = errors.New("a CA rotation is already in progress")
+
+// Authority is the engine's persistent certificate authority.
+// It issues admin client certificates and is the trust anchor the control plane verifies them against.
+// An Authority is never modified once loaded; rotation produces a new one.
+type Authority struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	key     ed25519.PrivateKey
+
+	// Previous is the CA being rotated out. Until the rotation retires it, it is still trusted and
+	// still issues the engine's server certificates, so consoles that only pin it keep working.
+	Previous *Authority
+	Rotation *Rotation
+}
+
+// Rotation records when a CA rotation started and when the previous CA stops being trusted.
+type Rotation struct {
+	StartedAt time.Time `json:"started_at"`
+	RetiresAt time.Time `json:"retires_at"`
+}
+
+// LoadOrCreateAuthority loads the CA from dir, creating a new key and self-signed certificate on first start.
+// A rotation whose overlap period has ended is completed here by retiring the previous CA.
+func LoadOrCreateAuthority(dir string) (*Authority, error) {
+	a, err := loadAuthority(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rot, err := loadRotation(dir)
+	if err != nil || rot == nil {
+		return a, err
+	}
+
+	if time.Now().After(rot.RetiresAt) {
+		if err := retirePrevious(dir); err != nil {
+			return nil, err
+		}
+		log.Printf("Retired the previous engine CA; its overlap period ended at %s", rot.RetiresAt.Format(time.RFC3339))
+		return a, nil
+	}
+
+	prev, err := loadAuthority(filepath.Join(dir, previousDir), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA being rotated out: %w", err)
+	}
+	a.Previous, a.Rotation = prev, rot
+	return a, nil
+}
+
+// RotateAuthority replaces the CA in dir with a new one. The old CA stays trusted, and keeps
+// issuing the server certificate, for the overlap period so consoles can move to the new one.
+func RotateAuthority(dir string, overlap time.Duration) (*Authority, error) {
+	if overlap <= 0 {
+		return nil, fmt.Errorf("overlap must be positive")
+	}
+
+	current, err := LoadOrCreateAuthority(dir)
+	if err != nil {
+		return nil, err
+	}
+	if current.Rotation != nil {
+		return nil, fmt.Errorf("%w until %s", ErrRotationInProgress, current.Rotation.RetiresAt.Format(time.RFC3339))
+	}
+
+	// 1. Record the rotation first, so an interrupted rotation is still recognised on the next load
+	now := time.Now().UTC()
+	state, err := json.MarshalIndent(Rotation{StartedAt: now, RetiresAt: now.Add(overlap)}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, rotationFile), state, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save rotation state: %w", err)
+	}
+
+	// 2. Move the current CA aside
+	prevPath := filepath.Join(dir, previousDir)
+	if err := os.RemoveAll(prevPath); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(prevPath, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", prevPath, err)
+	}
+	chownToEngine(prevPath)
+	for _, name := range []string{"ca.key", "ca.crt"} {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(prevPath, name)); err != nil {
+			return nil, fmt.Errorf("failed to move the current CA aside: %w", err)
+		}
+	}
+
+	// 3. Create its successor
+	if err := createAuthority(dir, filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Rotated the engine CA; the previous one is trusted until %s", now.Add(overlap).Format(time.RFC3339))
+	return LoadOrCreateAuthority(dir)
+}
+
+// loadAuthority reads ca.key and ca.crt from dir, creating them first if create is set.
+func loadAuthority(dir string, create bool) (*Authority, error) {
+	keyPath := filepath.Join(dir, "ca.key")
+	certPath := filepath.Join(dir, "ca.crt")
+
+	if _, err := os.Stat(keyPath); create && errors.Is(err, os.ErrNotExist) {
+		if err := createAuthority(dir, keyPath, certPath); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := crypto.LoadPrivateKey(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA key: %w", err)
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+
+	cert, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("CA certificate at %s does not hold an Ed25519 key", certPath)
+	}
+	if !pub.Equal(key.Public()) {
+		return nil, fmt.Errorf("CA certificate at %s does not match %s", certPath, keyPath)
+	}
+
+	return &Authority{Cert: cert, CertPEM: certPEM, key: key}, nil
+}
+
+// loadRotation returns the rotation in progress in dir, or nil if there is none.
+func loadRotation(dir string) (*Rotation, error) {
+	data, err := os.ReadFile(filepath.Join(dir, rotationFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rotation state: %w", err)
+	}
+
+	var rot Rotation
+	if err := json.Unmarshal(data, &rot); err != nil {
+		return nil, fmt.Errorf("failed to read rotation state: %w", err)
+	}
+	return &rot, nil
+}
+
+// retirePrevious removes the rotated-out CA and its rotation state.
+func retirePrevious(dir string) error {
+	if err := os.RemoveAll(filepath.Join(dir, previousDir)); err != nil {
+		return fmt.Errorf("failed to remove the previous CA: %w", err)
+	}
+	if err := os.Remove(filepath.Join(dir, rotationFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to clear rotation state: %w", err)
+	}
+	return nil
+}
+
+// createAuthority writes a new CA key and certificate with engine-only ownership.
+func createAuthority(dir, keyPath, certPath string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	certPEM, err := crypto.CreateCA(priv, fmt.Sprintf("Onyx Engine CA (%s)", hostname), caValidity)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := crypto.EncodePrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	if err := crypto.SavePEM(keyPath, keyPEM); err != nil {
+		return fmt.Errorf("failed to save CA key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to save CA certificate: %w", err)
+	}
+
+	if err := chownToEngine(dir, keyPath, certPath); err != nil {
+		return err
+	}
+
+	log.Printf("Created engine CA in %s", dir)
+	return nil
+}
+
+// SignCSR issues a client certificate chained to this CA with the given role bound into it.
+func (a *Authority) SignCSR(csrPEM []byte, role api.Role) ([]byte, error) {
+	return crypto.SignCSR(csrPEM, a.Cert, a.key, string(role))
+}
+
+// SignCRL issues a revocation list with the given sequence number and entries.
+func (a *Authority) SignCRL(number *big.Int, entries []x509.RevocationListEntry) ([]byte, error) {
+	return crypto.CreateCRL(a.Cert, a.key, number, entries)
+}
+
+// ServerCertificate issues a fresh server identity for the engine's TLS listeners.
+// During a rotation it comes from the previous CA, which every console still pins.
+func (a *Authority) ServerCertificate() (tls.Certificate, error) {
+	if a.Previous != nil {
+		return a.Previous.ServerCertificate()
+	}
+	return crypto.IssueServerCert(a.Cert, a.key, serverCertValidity)
+}
+
+// ServerIssuer returns the CA that issues the engine's server certificates: the previous CA
+// during a rotation, this one otherwise.
+func (a *Authority) ServerIssuer() *x509.Certificate {
+	if a.Previous != nil {
+		return a.Previous.Cert
+	}
+	return a.Cert
+}
+
+// Pool returns a certificate pool containing this CA and, during a rotation, the previous one.
+func (a *Authority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.Cert)
+	if a.Previous != nil {
+		pool.AddCert(a.Previous.Cert)
+	}
+	return pool
+}
+
+// Bundle returns the PEM certificates consoles should pin: this CA, followed during a rotation
+// by the previous one.
+func (a *Authority) Bundle() []byte {
+	if a.Previous == nil {
+		return a.CertPEM
+	}
+	return append(slices.Clone(a.CertPEM), a.Previous.CertPEM...)
+}
+
+// chownToEngine hands files created by root (e.g. during `sudo onyx --pair`) to the engine user,
+// so the service can read them without running privileged. It is a no-op for non-root callers.
+func chownToEngine(paths ...string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	u, err := user.Lookup(engineUser)
+	if err != nil {
+		// Development hosts without the system user keep root ownership
+		return nil
+	}
+
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	for _, p := range paths {
+		if err := os.Chown(p, uid, gid); err != nil {
+			return fmt.Errorf("failed to set ownership of %s: %w", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+)
+
+// identity is the caller of an API request.
+type identity struct {
+	Client *api.ClientInfo // Nil for callers on the local socket
+}
+
+// Role returns the caller's access level. The local socket is reachable only by root and
+// the engine user, so it always acts as owner.
+func (id identity) Role() api.Role {
+	if id.Client == nil {
+		return api.RoleOwner
+	}
+	return id.Client.Role
+}
+
+func (id identity) String() string {
+	if id.Client == nil {
+		return "local socket"
+	}
+	return fmt.Sprintf("%s (%s)", id.Client.Name, id.Client.Fingerprint[:16])
+}
+
+// auditEntry starts an audit entry attributed to this identity.
+func (id identity) auditEntry(action, target string) api.AuditEntry {
+	if id.Client == nil {
+		return api.AuditEntry{Actor: "local", Role: api.RoleOwner, Action: action, Target: target}
+	}
+	return api.AuditEntry{
+		Actor:     id.Client.Fingerprint,
+		ActorName: id.Client.Name,
+		Role:      id.Client.Role,
+		Action:    action,
+		Target:    target,
+	}
+}
+
+type identityKey struct{}
+
+// callerOf returns the identity attached to a request by require.
+func callerOf(r *http.Request) identity {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id
+}
+
+// audit records an action taken through the API by the caller of r. A non-nil err marks it as failed.
+func (e *Engine) audit(r *http.Request, action, target string, err error) {
+	entry := callerOf(r).auditEntry(action, target)
+	if r.TLS != nil {
+		entry.Remote = r.RemoteAddr
+	}
+	if err != nil {
+		entry.Result, entry.Detail = api.AuditFailed, err.Error()
+	}
+	e.auditLog.Record(entry)
+}
+
+// route registers an endpoint together with the least role allowed to call it.
+func (e *Engine) route(mux *http.ServeMux, pattern string, role api.Role, h http.HandlerFunc) {
+	mux.Handle(pattern, e.require(role, h))
+}
+
+// require identifies the caller and refuses it unless its role allows at least role.
+// Remote callers are looked up in the registry on every request, so a client revoked while
+// its connection is open cannot issue any further calls.
+func (e *Engine) require(role api.Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id identity
+		if r.TLS != nil {
+			if len(r.TLS.PeerCertificates) == 0 {
+				writeError(w, http.StatusUnauthorized, "client certificate required")
+				return
+			}
+
+			client, err := e.clients.Authorize(r.TLS.PeerCertificates[0])
+			if err != nil {
+				e.auditLog.Record(api.AuditEntry{
+					Actor:  crypto.Fingerprint(r.TLS.PeerCertificates[0]),
+					Remote: r.RemoteAddr,
+					Action: "access",
+					Target: r.Method + " " + r.URL.Path,
+					Result: api.AuditDenied,
+					Detail: err.Error(),
+				})
+				writeError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			id.Client = client
+		}
+
+		if !id.Role().Allows(role) {
+			msg := fmt.Sprintf("this action requires the %s role; %s is %s", role, id, id.Role())
+			entry := id.auditEntry("access", r.Method+" "+r.URL.Path)
+			entry.Remote, entry.Result, entry.Detail = r.RemoteAddr, api.AuditDenied, msg
+			e.auditLog.Record(entry)
+
+			writeError(w, http.StatusForbidden, msg)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
@@ -0,0 +1,318 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"onyx/internal/api"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// sitesServer is the HTTP server created for managed sites when the Caddyfile has none on :443.
+const sitesServer = "onyx_sites"
+
+// siteRouteID is the @id of a managed site's route, so it can be addressed through the admin API.
+func siteRouteID(host string) string {
+	return "onyx_site_" + host
+}
+
+// siteRoute translates a managed site into a Caddy HTTP route: the access rules first, then
+// the WAF, then the proxy to the upstreams.
+func siteRoute(site api.Site) map[string]any {
+	upstreams := make([]map[string]any, 0, len(site.Upstreams))
+	for _, u := range site.Upstreams {
+		upstreams = append(upstreams, map[string]any{"dial": u})
+	}
+
+	proxy := map[string]any{
+		"handler":   "reverse_proxy",
+		"upstreams": upstreams,
+	}
+	if lb := loadBalancing(site.LoadBalancing); len(lb) > 0 {
+		proxy["load_balancing"] = lb
+	}
+	if hc := healthChecks(site.HealthChecks); len(hc) > 0 {
+		proxy["health_checks"] = hc
+	}
+
+	handle := []any{proxy}
+	if site.WAF != api.WAFOff {
+		handle = append([]any{wafHandler(site.WAF)}, handle...)
+	}
+
+	// Clients outside the allowed ranges get a 403 before reaching the WAF or the upstreams
+	if len(site.Allow) > 0 {
+		handle = []any{map[string]any{
+			"handler": "subroute",
+			"routes": []any{
+				map[string]any{
+					"match":    []any{map[string]any{"not": []any{map[string]any{"remote_ip": map[string]any{"ranges": site.Allow}}}}},
+					"handle":   []any{map[string]any{"handler": "static_response", "status_code": http.StatusForbidden}},
+					"terminal": true,
+				},
+				map[string]any{"handle": handle},
+			},
+		}}
+	}
+
+	return map[string]any{
+		"@id":      siteRouteID(site.Host),
+		"match":    []any{map[string]any{"host": []string{site.Host}}},
+		"handle":   handle,
+		"terminal": true,
+	}
+}
+
+// loadBalancing translates a site's load-balancing settings into the reverse proxy's, leaving
+// Caddy's defaults (random selection, no retries) for anything unset.
+func loadBalancing(lb api.LoadBalancing) map[string]any {
+	cfg := make(map[string]any)
+	if lb.Policy != api.LBRandom {
+		cfg["selection_policy"] = map[string]any{"policy": lb.Policy}
+	}
+	if lb.Retries > 0 {
+		cfg["retries"] = lb.Retries
+	}
+	if lb.TryDuration != "" {
+		cfg["try_duration"] = lb.TryDuration
+	}
+	return cfg
+}
+
+// healthChecks translates a site's health checks into the reverse proxy's active and passive
+// checks, each of which is only configured when enabled.
+func healthChecks(hc api.HealthChecks) map[string]any {
+	cfg := make(map[string]any)
+	if hc.Path != "" {
+		active := map[string]any{"uri": hc.Path}
+		if hc.Interval != "" {
+			active["interval"] = hc.Interval
+		}
+		if hc.Timeout != "" {
+			active["timeout"] = hc.Timeout
+		}
+		if hc.ExpectStatus != 0 {
+			active["expect_status"] = hc.ExpectStatus
+		}
+		cfg["active"] = active
+	}
+	if hc.MaxFails > 0 {
+		failDuration := hc.FailDuration
+		if failDuration == "" {
+			failDuration = defaultFailDuration
+		}
+		passive := map[string]any{"max_fails": hc.MaxFails, "fail_duration": failDuration}
+		if len(hc.UnhealthyStatus) > 0 {
+			passive["unhealthy_status"] = hc.UnhealthyStatus
+		}
+		cfg["passive"] = passive
+	}
+	return cfg
+}
+
+// defaultFailDuration is how long a failure counts against an upstream when passive checks are
+// enabled without a duration; Caddy would otherwise leave them off.
+const defaultFailDuration = "30s"
+
+// wafHandler configures Coraza with the OWASP Core Rule Set bundled into the engine, blocking
+// or only logging what the rules flag depending on mode.
+func wafHandler(mode string) map[string]any {
+	engine := "On"
+	if mode == api.WAFDetect {
+		engine = "DetectionOnly"
+	}
+	return map[string]any{
+		"handler":        "waf",
+		"load_owasp_crs": true,
+		"directives": strings.Join([]string{
+			"Include @coraza.conf-recommended",
+			"Include @crs-setup.conf.example",
+			"Include @owasp_crs/*.conf",
+			"SecRuleEngine " + engine,
+		}, "\n"),
+	}
+}
+
+// mergeSites adds the managed sites to an adapted Caddyfile config. Their routes go first in
+// the server listening on :443, ahead of any catch-all from the Caddyfile, or in a server of
+// their own if there is none.
+func mergeSites(base []byte, sites []api.Site) ([]byte, error) {
+	if len(sites) == 0 {
+		return base, nil
+	}
+
+	var cfg map[string]any
+	if err := json.Unmarshal(base, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to inspect config: %w", err)
+	}
+
+	for _, host := range configuredHosts(base) {
+		if slices.ContainsFunc(sites, func(s api.Site) bool { return s.Host == host }) {
+			log.Printf("Config warning: %s is both a managed site and a Caddyfile site block; the managed site takes precedence", host)
+		}
+	}
+
+	servers := jsonObject(jsonObject(jsonObject(cfg, "apps"), "http"), "servers")
+	name := sitesServer
+	for n, srv := range servers {
+		listen, _ := srv.(map[string]any)["listen"].([]any)
+		if slices.ContainsFunc(listen, func(l any) bool { s, _ := l.(string); return strings.HasSuffix(s, ":443") }) {
+			name = n
+			break
+		}
+	}
+	server := jsonObject(servers, name)
+	if _, ok := server["listen"]; !ok {
+		server["listen"] = []string{":443"}
+	}
+
+	routes := make([]any, 0, len(sites))
+	for _, site := range sites {
+		routes = append(routes, siteRoute(site))
+	}
+	existing, _ := server["routes"].([]any)
+	server["routes"] = append(routes, existing...)
+
+	return json.Marshal(cfg)
+}
+
+// jsonObject returns the object stored under key in m, creating it if needed.
+func jsonObject(m map[string]any, key string) map[string]any {
+	if child, ok := m[key].(map[string]any); ok {
+		return child
+	}
+	child := make(map[string]any)
+	m[key] = child
+	return child
+}
+
+// configuredHosts returns every hostname matched by a route in the config's HTTP servers,
+// leaving out the routes of managed sites.
+func configuredHosts(cfgJSON []byte) []string {
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Routes []struct {
+						ID    string `json:"@id"`
+						Match []struct {
+							Host []string `json:"host"`
+						} `json:"match"`
+					} `json:"routes"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if json.Unmarshal(cfgJSON, &cfg) != nil {
+		return nil
+	}
+
+	var hosts []string
+	for _, srv := range cfg.Apps.HTTP.Servers {
+		for _, route := range srv.Routes {
+			if strings.HasPrefix(route.ID, siteRouteID("")) {
+				continue
+			}
+			for _, m := range route.Match {
+				hosts = append(hosts, m.Host...)
+			}
+		}
+	}
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// caddyAdmin talks to the admin endpoint of the running Caddy instance. The Caddyfile keeps it
+// on the loopback interface, so it is only reachable from the engine host.
+type caddyAdmin struct {
+	http *http.Client
+	host string // Host header the endpoint accepts
+}
+
+// newCaddyAdmin finds the admin endpoint declared by the running config.
+func newCaddyAdmin(cfgJSON []byte) (*caddyAdmin, error) {
+	var cfg struct {
+		Admin struct {
+			Disabled bool     `json:"disabled"`
+			Listen   string   `json:"listen"`
+			Origins  []string `json:"origins"`
+		} `json:"admin"`
+	}
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to inspect config: %w", err)
+	}
+	if cfg.Admin.Disabled {
+		return nil, fmt.Errorf("the Caddy admin API is disabled in the Caddyfile; managed sites need it on the loopback interface")
+	}
+
+	listen := cfg.Admin.Listen
+	if listen == "" {
+		listen = caddy.DefaultAdminListen
+	}
+	addr, err := caddy.ParseNetworkAddress(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin address %q: %w", listen, err)
+	}
+
+	network, dial := addr.Network, addr.JoinHostPort(0)
+	if addr.IsUnixNetwork() {
+		dial = addr.Host
+	}
+
+	// With origins configured, Caddy only accepts requests whose Host is one of them
+	host := dial
+	if addr.IsUnixNetwork() {
+		host = "localhost"
+	}
+	if len(cfg.Admin.Origins) > 0 {
+		host = cfg.Admin.Origins[0]
+		if _, after, ok := strings.Cut(host, "://"); ok {
+			host = after
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dial)
+		},
+	}
+	return &caddyAdmin{http: &http.Client{Transport: transport, Timeout: 30 * time.Second}, host: host}, nil
+}
+
+// Load replaces the running config with cfgJSON through POST /load.
+func (a *caddyAdmin) Load(cfgJSON []byte) error {
+	req, err := http.NewRequest(http.MethodPost, "http://"+a.host+"/load", bytes.NewReader(cfgJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("caddy admin API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var res struct {
+			Error string `json:"error"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &res) == nil && res.Error != "" {
+			return fmt.Errorf("%s", res.Error)
+		}
+		return fmt.Errorf("caddy admin API returned %s", resp.Status)
+	}
+	return nil
+}
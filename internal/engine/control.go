@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+	"onyx/internal/pairing"
+)
+
+// DefaultControlAddr is where the mTLS control plane listens for onyx-admin consoles.
+const DefaultControlAddr = ":2305"
+
+// Locations of the engine's persistent state.
+const (
+	StateDir   = "/var/lib/onyx"
+	AuthDir    = StateDir + "/auth"
+	ClientsDir = AuthDir + "/clients"
+)
+
+// startControl serves the engine API over mTLS. Only clients presenting a certificate
+// issued by the engine CA, absent from its CRL and present in the client registry are allowed through.
+// Both checks run on every handshake, so a revocation applies to the next connection attempt.
+// Connections without a certificate are let through the handshake only to pair; every API
+// endpoint refuses them.
+func (e *Engine) startControl() error {
+	if _, err := e.serverCertificate(e.ca()); err != nil {
+		return fmt.Errorf("failed to create control plane certificate: %w", err)
+	}
+
+	// The trusted CAs and the server certificate are picked per handshake, so a CA rotation
+	// or retirement applies to the next connection without restarting the listener.
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			ca := e.ca()
+			serverCert, err := e.serverCertificate(ca)
+			if err != nil {
+				log.Printf("Failed to issue control plane certificate: %v", err)
+				return nil, err
+			}
+
+			return &tls.Config{
+				MinVersion:       tls.VersionTLS13,
+				Certificates:     []tls.Certificate{*serverCert},
+				ClientAuth:       tls.VerifyClientCertIfGiven,
+				ClientCAs:        ca.Pool(),
+				VerifyConnection: e.verifyClient(hello.Conn.RemoteAddr().String()),
+			}, nil
+		},
+	}
+
+	raw, err := net.Listen("tcp", e.opts.ControlAddr)
+	if err != nil {
+		return fmt.Errorf("failed to open control plane on %s: %w", e.opts.ControlAddr, err)
+	}
+	ln := tls.NewListener(e.sessions.Listener(raw), tlsConfig)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", e.newAPIHandler())
+	mux.HandleFunc("POST "+pairing.Path, e.handlePair)
+
+	e.control = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnState:         e.sessions.ConnState,
+	}
+	go func() {
+		if err := e.control.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control plane error: %v", err)
+		}
+	}()
+
+	log.Printf("Control plane listening on %s", e.opts.ControlAddr)
+	return nil
+}
+
+// handlePair serves the pairing protocol on the control plane. Consoles reach it without a client
+// certificate and present either the token of a pairing window held by the engine or an invitation.
+func (e *Engine) handlePair(w http.ResponseWriter, r *http.Request) {
+	source, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// 1. Decode the request and agree on a protocol version
+	req, version, perr := readPairingRequest(r)
+	if perr != nil {
+		e.auditLog.Record(api.AuditEntry{Remote: source, Action: "pair.attempt", Result: api.AuditDenied, Detail: string(perr.Code) + ": " + perr.Message})
+		pairing.WriteError(w, version, perr)
+		return
+	}
+
+	// Window tokens are confirmed by the operator on the engine host; any other token must be an
+	// invitation, whose admin vouches for the console
+	if pw := e.pairingWindows.find(req.Token); pw != nil {
+		pw.pair(w, r, source, version, req)
+		return
+	}
+	if req.Nonce != "" {
+		// Only windows take a second round; its token was consumed by the first
+		perr := &pairing.Error{Code: pairing.ErrExpired, Message: "the pairing window has closed"}
+		e.auditLog.Record(api.AuditEntry{Remote: source, Action: "pair.attempt", Result: api.AuditDenied, Detail: string(perr.Code) + ": " + perr.Message})
+		pairing.WriteError(w, version, perr)
+		return
+	}
+	e.redeemInvite(w, source, version, req)
+}
+
+// serverCertificate returns the control plane's certificate for ca, issuing a new one when the
+// authority changed or the current one is past two thirds of its lifetime.
+func (e *Engine) serverCertificate(ca *Authority) (*tls.Certificate, error) {
+	e.serverCertMu.Lock()
+	defer e.serverCertMu.Unlock()
+
+	cached := e.serverCert
+	if cached != nil && e.serverCertCA == ca && time.Until(cached.Leaf.NotAfter) > serverCertValidity/3 {
+		return cached, nil
+	}
+
+	cert, err := ca.ServerCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+
+	e.serverCert, e.serverCertCA = &cert, ca
+	return &cert, nil
+}
+
+// verifyClient returns the handshake check for a connection from remote. It rejects chained
+// certificates that are on the CRL, unknown to the registry or revoked there, and records every
+// login attempt that got this far in the audit log. Connections without a certificate pass, to
+// be limited to pairing by the API's own checks.
+func (e *Engine) verifyClient(remote string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		leaf := cs.PeerCertificates[0]
+		entry := api.AuditEntry{Actor: crypto.Fingerprint(leaf), Remote: remote, Action: "login"}
+
+		err := e.revocations.VerifyPeerCertificate(nil, cs.VerifiedChains)
+		if err == nil {
+			var client *api.ClientInfo
+			if client, err = e.clients.Authorize(leaf); err == nil {
+				entry.ActorName, entry.Role = client.Name, client.Role
+			}
+		}
+
+		if err != nil {
+			entry.Result, entry.Detail = api.AuditDenied, err.Error()
+		}
+		e.auditLog.Record(entry)
+		return err
+	}
+}
@@ -0,0 +1,306 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/systemd"
+)
+
+// DefaultSocket is the unix socket the local `onyx` CLI uses to reach a running engine.
+const DefaultSocket = "/run/onyx/onyx.sock"
+
+// Options configures a long-running engine process.
+type Options struct {
+	Version     string
+	Caddyfile   string
+	SocketPath  string
+	ControlAddr string
+
+	ApprovalPolicy string // Two-person approval policy; ApprovalPolicyPath if empty
+	RollbackPath   string // Where a rollback leaves its Caddyfile; RollbackCaddyfile if empty
+}
+
+// Engine ties the data plane and both control listeners together for the lifetime of the process.
+type Engine struct {
+	opts           Options
+	startedAt      time.Time
+	authority      atomic.Pointer[Authority] // Replaced as a whole on CA rotation and retirement
+	clients        *Registry
+	revocations    *RevocationList
+	sessions       *sessionTracker
+	auditLog       *AuditLog
+	invites        *Invitations
+	pairingWindows hostedWindows // Opened by `onyx --pair` while the engine runs
+	changes        *ChangeQueue
+	sites          *SiteStore
+	history        *History
+	proxy          *Proxy
+	local          *http.Server
+	control        *http.Server
+
+	rotateMu     sync.Mutex // Serialises CA rotation and retirement
+	serverCertMu sync.Mutex
+	serverCert   *tls.Certificate
+	serverCertCA *Authority // Authority serverCert was issued for
+}
+
+// New creates an engine from the given options. Nothing is started until Run is called.
+func New(opts Options) *Engine {
+	if opts.ApprovalPolicy == "" {
+		opts.ApprovalPolicy = ApprovalPolicyPath
+	}
+	if opts.RollbackPath == "" {
+		opts.RollbackPath = RollbackCaddyfile
+	}
+	return &Engine{
+		opts:      opts,
+		startedAt: time.Now(),
+		proxy:     NewProxy(opts.Caddyfile),
+		sessions:  newSessionTracker(),
+	}
+}
+
+// Run starts the proxy and the control plane, then blocks until SIGINT or SIGTERM.
+// SIGHUP triggers a validated reload of the Caddyfile.
+func (e *Engine) Run() error {
+	auditLog, err := OpenAuditLog(AuditPath)
+	if err != nil {
+		return err
+	}
+	e.auditLog = auditLog
+
+	// A broken chain is reported and recorded, but does not keep the proxy down
+	if err := auditLog.Verify(); err != nil {
+		log.Printf("WARNING: audit log failed verification: %v", err)
+		auditLog.Record(api.AuditEntry{Actor: "engine", Action: "audit.verify", Result: api.AuditFailed, Detail: err.Error()})
+	}
+	auditLog.Record(api.AuditEntry{Actor: "engine", Action: "engine.start", Detail: e.opts.Version})
+
+	authority, err := LoadOrCreateAuthority(AuthDir)
+	if err != nil {
+		return err
+	}
+	e.authority.Store(authority)
+
+	clients, revocations, err := OpenClients(authority)
+	if err != nil {
+		return err
+	}
+	e.clients = clients
+	e.revocations = revocations
+
+	invites, err := OpenInvitations(InvitesPath)
+	if err != nil {
+		return err
+	}
+	e.invites = invites
+
+	changes, err := OpenChangeQueue(ChangesPath)
+	if err != nil {
+		return err
+	}
+	e.changes = changes
+
+	sites, err := OpenSiteStore(SitesPath)
+	if err != nil {
+		return err
+	}
+	e.sites = sites
+
+	history, err := OpenHistory(HistoryDir)
+	if err != nil {
+		return err
+	}
+	e.history = history
+
+	if err := e.proxy.Start(sites.List()); err != nil {
+		return err
+	}
+	e.recordConfig(api.AuditEntry{Actor: "engine"}, "start")
+
+	if err := e.startLocal(); err != nil {
+		e.shutdown()
+		return err
+	}
+
+	if err := e.startControl(); err != nil {
+		e.shutdown()
+		return err
+	}
+
+	// Both planes are listening, so systemd can now consider the service started
+	systemd.Ready(e.statusLine())
+
+	stopWatchdog := e.startWatchdog()
+	defer stopWatchdog()
+
+	stopRetirement := e.startRetirementCheck()
+	defer stopRetirement()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			entry := api.AuditEntry{Actor: "local", Role: api.RoleOwner, Action: "reload", Target: e.opts.Caddyfile, Detail: "SIGHUP"}
+			if err := e.Reload("signal", identity{}); err != nil {
+				entry.Result, entry.Detail = api.AuditFailed, "SIGHUP: "+err.Error()
+			}
+			e.auditLog.Record(entry)
+			continue
+		}
+
+		log.Printf("Received %s, shutting down", sig)
+		e.auditLog.Record(api.AuditEntry{Actor: "engine", Action: "engine.stop", Detail: sig.String()})
+		break
+	}
+
+	return e.shutdown()
+}
+
+// Reload applies the on-disk Caddyfile through the validate-then-swap path and records the
+// result in the config history as applied by by. systemd is told about the reload so
+// `systemctl reload` waits for it to finish.
+func (e *Engine) Reload(source string, by identity) error {
+	systemd.Reloading()
+	err := e.proxy.Reload(source)
+	if err == nil {
+		e.recordConfig(by.auditEntry("", ""), "reload via "+source)
+	}
+
+	status := e.statusLine()
+	if err != nil {
+		status = "Last reload failed, serving previous config; " + status
+	}
+	systemd.Ready(status)
+
+	return err
+}
+
+// ca returns the engine's current certificate authority.
+func (e *Engine) ca() *Authority {
+	return e.authority.Load()
+}
+
+// statusLine summarises the engine for `systemctl status`.
+func (e *Engine) statusLine() string {
+	status := "Serving " + e.proxy.Summary()
+	if rot := e.ca().Rotation; rot != nil {
+		status += "; CA rotation in progress until " + rot.RetiresAt.Local().Format("2006-01-02 15:04")
+	}
+	return status
+}
+
+// startWatchdog pings the systemd watchdog for as long as the internal health check passes.
+// If the data plane stops answering, the pings stop and systemd restarts the service.
+func (e *Engine) startWatchdog() (stop func()) {
+	interval, ok := systemd.WatchdogInterval()
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := e.healthCheck(); err != nil {
+					log.Printf("Health check failed, withholding watchdog ping: %v", err)
+					systemd.Status("Unhealthy: " + err.Error())
+					continue
+				}
+				systemd.Watchdog()
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// healthCheck verifies that the data plane and both control listeners are still answering.
+func (e *Engine) healthCheck() error {
+	if err := e.proxy.Healthy(); err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("unix", e.opts.SocketPath, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("control socket is not accepting connections: %w", err)
+	}
+	conn.Close()
+
+	conn, err = net.DialTimeout("tcp", e.opts.ControlAddr, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("control plane is not accepting connections: %w", err)
+	}
+	conn.Close()
+
+	return nil
+}
+
+// startLocal serves the engine API on a unix socket that only the engine user and root can reach.
+func (e *Engine) startLocal() error {
+	path := e.opts.SocketPath
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	// A stale socket from a previous crash would make Listen fail
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to open control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	e.local = &http.Server{Handler: e.newAPIHandler()}
+	go func() {
+		if err := e.local.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control socket error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// shutdown stops both control listeners and then the data plane.
+func (e *Engine) shutdown() error {
+	systemd.Stopping()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if e.control != nil {
+		e.control.Shutdown(ctx)
+	}
+	if e.local != nil {
+		e.local.Shutdown(ctx)
+	}
+	return e.proxy.Stop()
+}
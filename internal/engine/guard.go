@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"onyx/internal/api"
+	"onyx/internal/pairing"
+)
+
+// PairingLog records every pairing attempt on an installed engine.
+const PairingLog = "/var/log/onyx/pairing.log"
+
+// Attempt budgets for a single pairing window.
+const (
+	maxFailuresPerSource = 3  // Further attempts from the same address are refused
+	maxFailuresTotal     = 10 // The whole window is closed
+)
+
+// pairingGuard enforces the use limit of a pairing token and limits how many wrong guesses
+// a window tolerates, both per source address and in total.
+type pairingGuard struct {
+	mu        sync.Mutex
+	token     string
+	remaining int // Uses left before the token is spent
+	locked    bool
+	failures  map[string]int
+	total     int
+}
+
+func newPairingGuard(token string, uses int) *pairingGuard {
+	return &pairingGuard{
+		token:     token,
+		remaining: uses,
+		failures:  make(map[string]int),
+	}
+}
+
+// Check validates a presented token for the given source address.
+// Each correct presentation consumes one use immediately, so a spent token can never be replayed.
+func (g *pairingGuard) Check(source, token string) *pairing.Error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.locked {
+		return &pairing.Error{Code: pairing.ErrLockedOut, Message: "too many failed attempts; the pairing window is closed"}
+	}
+	if g.failures[source] >= maxFailuresPerSource {
+		return &pairing.Error{Code: pairing.ErrLockedOut, Message: "too many failed attempts from this address"}
+	}
+
+	// Compare in constant time so response timing reveals nothing about the token
+	if g.remaining > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) == 1 {
+		g.remaining--
+		return nil
+	}
+
+	g.failures[source]++
+	g.total++
+	if g.total >= maxFailuresTotal {
+		g.locked = true
+	}
+	return &pairing.Error{Code: pairing.ErrBadToken, Message: "invalid or already used pairing token"}
+}
+
+// Matches reports whether token is this window's, without consuming a use or counting a failure.
+func (g *pairingGuard) Matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) == 1
+}
+
+// Locked reports whether the global failure budget has been exhausted.
+func (g *pairingGuard) Locked() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.locked
+}
+
+// Failures returns the failure counts used in attempt reports.
+func (g *pairingGuard) Failures(source string) (fromSource, total int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.failures[source], g.total
+}
+
+// attemptLog reports pairing attempts to the operator's console, to PairingLog and to the audit log.
+type attemptLog struct {
+	console io.Writer
+	file    *log.Logger
+	f       *os.File
+	audit   *AuditLog
+}
+
+// openAttemptLog opens the pairing log at path for appending, auditing to auditPath. If it cannot
+// be opened the console still receives every report and a warning explains why the file does not.
+func openAttemptLog(console io.Writer, path, auditPath string) *attemptLog {
+	audit, err := OpenAuditLog(auditPath)
+	if err != nil {
+		fmt.Fprintf(console, "Warning: pairing attempts will not be audited: %v\n", err)
+	}
+	return newAttemptLog(console, path, audit)
+}
+
+// newAttemptLog is openAttemptLog for a process that already has the audit log open, such as
+// the engine holding a window for `onyx --pair`. It must be closed once the window is over.
+func newAttemptLog(console io.Writer, path string, audit *AuditLog) *attemptLog {
+	l := &attemptLog{console: console, audit: audit}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		fmt.Fprintf(console, "Warning: pairing attempts will not be logged to %s: %v\n", path, err)
+		return l
+	}
+	chownToEngine(path)
+
+	l.f, l.file = f, log.New(f, "", log.LstdFlags|log.LUTC)
+	return l
+}
+
+// Close closes the pairing log file.
+func (l *attemptLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Record reports a single attempt with its source address, audit result and outcome.
+func (l *attemptLog) Record(source, result, outcome string) {
+	fmt.Fprintf(l.console, "[attempt] %s: %s\n", source, outcome)
+	if l.file != nil {
+		l.file.Printf("source=%s outcome=%q", source, outcome)
+	}
+	l.audit.Record(api.AuditEntry{Remote: source, Action: "pair.attempt", Result: result, Detail: outcome})
+}
+
+// Paired reports a client that completed pairing. The operator who opened the window on the
+// engine host is the one who authorised it.
+func (l *attemptLog) Paired(source string, info *api.ClientInfo) {
+	clientID := fmt.Sprintf("%s (%s, %s)", info.Name, info.Fingerprint[:16], info.Role)
+	fmt.Fprintf(l.console, "[attempt] %s: paired as %s\n", source, clientID)
+	if l.file != nil {
+		l.file.Printf("source=%s outcome=%q", source, "paired as "+clientID)
+	}
+	l.audit.Record(api.AuditEntry{
+		Actor:  "local",
+		Role:   api.RoleOwner,
+		Remote: source,
+		Action: "pair",
+		Target: info.Fingerprint,
+		Detail: fmt.Sprintf("%s as %s", info.Name, info.Role),
+	})
+}
@@ -0,0 +1,333 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+)
+
+// HistoryDir keeps a snapshot of every configuration the engine applied.
+const HistoryDir = StateDir + "/history"
+
+// RollbackCaddyfile holds the Caddyfile of the latest rollback, for an administrator to copy to
+// /etc/onyx/Caddyfile so that later reloads keep it.
+const RollbackCaddyfile = StateDir + "/Caddyfile.rollback"
+
+// maxHistory is how many snapshots are kept; older ones are deleted.
+const maxHistory = 100
+
+// ErrUnknownSnapshot is returned when the history has no snapshot with the requested ID.
+var ErrUnknownSnapshot = errors.New("no such configuration in the history")
+
+// History records each configuration the proxy applied as <id>.json under dir. A config
+// identical to the latest snapshot, such as a reload without edits, is not recorded again.
+type History struct {
+	dir string
+
+	mu   sync.Mutex
+	ids  []int  // Snapshot IDs on disk, oldest first
+	last string // Hash of the latest snapshot
+}
+
+// OpenHistory opens the history in dir, creating the directory if needed.
+func OpenHistory(dir string) (*History, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	h := &History{dir: dir}
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err == nil && strings.HasSuffix(entry.Name(), ".json") {
+			h.ids = append(h.ids, id)
+		}
+	}
+	slices.Sort(h.ids)
+
+	if len(h.ids) > 0 {
+		latest, err := h.load(h.ids[len(h.ids)-1])
+		if err != nil {
+			return nil, err
+		}
+		h.last = latest.Hash
+	}
+	return h, nil
+}
+
+// Record stores snap as the newest snapshot, filling in its ID, hash and time. It returns nil
+// if the content matches the latest snapshot.
+func (h *History) Record(snap api.ConfigSnapshot) (*api.ConfigSnapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hash, err := configHash([]byte(snap.Caddyfile), snap.Sites)
+	if err != nil {
+		return nil, err
+	}
+	if hash == h.last {
+		return nil, nil
+	}
+
+	snap.ID = 1
+	if len(h.ids) > 0 {
+		snap.ID = h.ids[len(h.ids)-1] + 1
+	}
+	snap.Hash, snap.AppliedAt = hash, time.Now().UTC()
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(h.path(snap.ID), data, 0640); err != nil {
+		return nil, fmt.Errorf("failed to save config snapshot: %w", err)
+	}
+	h.ids, h.last = append(h.ids, snap.ID), hash
+
+	// Forget the oldest snapshots beyond the limit
+	for len(h.ids) > maxHistory {
+		if err := os.Remove(h.path(h.ids[0])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to prune config snapshot %d: %v", h.ids[0], err)
+			break
+		}
+		h.ids = h.ids[1:]
+	}
+	return &snap, nil
+}
+
+// List returns every snapshot, newest first, without the Caddyfile and sites.
+func (h *History) List() ([]api.ConfigSnapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]api.ConfigSnapshot, 0, len(h.ids))
+	for _, id := range slices.Backward(h.ids) {
+		snap, err := h.load(id)
+		if err != nil {
+			return nil, err
+		}
+		snap.Caddyfile, snap.Sites = "", nil
+		list = append(list, *snap)
+	}
+	return list, nil
+}
+
+// Get returns a full snapshot by ID.
+func (h *History) Get(id int) (*api.ConfigSnapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !slices.Contains(h.ids, id) {
+		return nil, fmt.Errorf("%w: #%d", ErrUnknownSnapshot, id)
+	}
+	return h.load(id)
+}
+
+// load reads a snapshot from disk. Callers must hold h.mu unless h is not shared yet.
+func (h *History) load(id int) (*api.ConfigSnapshot, error) {
+	data, err := os.ReadFile(h.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config snapshot %d: %w", id, err)
+	}
+	var snap api.ConfigSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to read config snapshot %d: %w", id, err)
+	}
+	return &snap, nil
+}
+
+func (h *History) path(id int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%06d.json", id))
+}
+
+// configHash is the SHA-256 of a Caddyfile and the settings of the managed sites.
+// Bookkeeping such as when a site was last edited does not change it.
+func configHash(caddyfile []byte, sites []api.Site) (string, error) {
+	data, err := siteContent(sites)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.New()
+	sum.Write(caddyfile)
+	sum.Write([]byte{0})
+	sum.Write(data)
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// siteContent encodes what the proxy serves for sites, leaving out who changed them and when.
+// Settings left at their defaults are omitted, so adding a setting keeps older hashes valid.
+func siteContent(sites []api.Site) ([]byte, error) {
+	type content struct {
+		Host          string            `json:"host"`
+		Upstreams     []string          `json:"upstreams"`
+		WAF           string            `json:"waf,omitempty"`
+		Allow         []string          `json:"allow,omitempty"`
+		LoadBalancing api.LoadBalancing `json:"load_balancing,omitzero"`
+		HealthChecks  api.HealthChecks  `json:"health_checks,omitzero"`
+	}
+	list := make([]content, 0, len(sites))
+	for _, s := range sites {
+		list = append(list, content{
+			Host:          s.Host,
+			Upstreams:     s.Upstreams,
+			WAF:           s.WAF,
+			Allow:         s.Allow,
+			LoadBalancing: s.LoadBalancing,
+			HealthChecks:  s.HealthChecks,
+		})
+	}
+	return json.Marshal(list)
+}
+
+// recordConfig snapshots the proxy's active config as applied by by, returning nil if it was
+// unchanged. Failures are logged, since the config is already live.
+func (e *Engine) recordConfig(by api.AuditEntry, source string) *api.ConfigSnapshot {
+	caddyfile, sites := e.proxy.Applied()
+	snap, err := e.history.Record(api.ConfigSnapshot{
+		AppliedBy:     by.Actor,
+		AppliedByName: by.ActorName,
+		Source:        source,
+		Caddyfile:     string(caddyfile),
+		Sites:         sites,
+	})
+	if err != nil {
+		log.Printf("Failed to record config history: %v", err)
+		return nil
+	}
+	if snap != nil {
+		log.Printf("Config #%d (%s) recorded in the history", snap.ID, snap.Hash[:12])
+	}
+	return snap
+}
+
+// Rollback re-applies a snapshot from the history through the validate-then-swap path, then
+// saves its Caddyfile at Options.RollbackPath for an administrator to install, since the engine
+// cannot write /etc/onyx. It returns the snapshot recorded for the rollback, or the target
+// itself if that config was already active.
+func (e *Engine) Rollback(id int, by identity) (*api.ConfigSnapshot, error) {
+	snap, err := e.history.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. Swap in the Caddyfile and sites together, then keep the sites
+	caddyfile := []byte(snap.Caddyfile)
+	if err := e.sites.Replace(snap.Sites, func(sites []api.Site) error {
+		return e.proxy.Restore(caddyfile, sites)
+	}); err != nil {
+		return nil, err
+	}
+
+	// 2. Leave the Caddyfile where an administrator can install it before the next reload
+	if err := writeFileAtomic(e.opts.RollbackPath, caddyfile, 0640); err != nil {
+		log.Printf("Rolled back to config #%d, but failed to save its Caddyfile: %v", id, err)
+	} else if onDisk, err := os.ReadFile(e.opts.Caddyfile); err == nil && string(onDisk) != snap.Caddyfile {
+		log.Printf("Rolled back to config #%d; the next reload reads %s again unless %s is copied over it", id, e.opts.Caddyfile, e.opts.RollbackPath)
+	}
+
+	if recorded := e.recordConfig(by.auditEntry("", ""), fmt.Sprintf("rollback to #%d", id)); recorded != nil {
+		return recorded, nil
+	}
+	return snap, nil
+}
+
+func (e *Engine) handleConfigHistory(w http.ResponseWriter, r *http.Request) {
+	list, err := e.history.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (e *Engine) handleConfigSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid snapshot ID %q", r.PathValue("id")))
+		return
+	}
+
+	snap, err := e.history.Get(id)
+	writeSnapshotResult(w, snap, err)
+}
+
+// handleConfigRollback re-applies a snapshot. A snapshot that lacks some of the live managed
+// sites removes them, so like a site sync it then goes through the approval policy.
+func (e *Engine) handleConfigRollback(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid snapshot ID %q", r.PathValue("id")))
+		return
+	}
+	target := "#" + strconv.Itoa(id)
+
+	snap, err := e.history.Get(id)
+	if err != nil {
+		e.audit(r, "config.rollback", target, err)
+		writeSnapshotResult(w, nil, err)
+		return
+	}
+	kept := make(map[string]bool, len(snap.Sites))
+	for _, site := range snap.Sites {
+		kept[site.Host] = true
+	}
+	for _, site := range e.sites.List() {
+		if !kept[site.Host] {
+			e.runGuarded(w, r, "config.rollback", target, nil)
+			return
+		}
+	}
+
+	result, _, _, err := rollbackOp(e, callerOf(r), target, nil)
+	e.audit(r, "config.rollback", target, err)
+	if err != nil {
+		writeSnapshotResult(w, nil, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// rollbackOp re-applies the snapshot named by target, such as "#12".
+func rollbackOp(e *Engine, by identity, target string, _ json.RawMessage) (any, string, func(), error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(target, "#"))
+	if err != nil {
+		return nil, target, nil, fmt.Errorf("invalid snapshot ID %q", target)
+	}
+
+	snap, err := e.Rollback(id, by)
+	if err != nil {
+		return nil, target, nil, err
+	}
+	log.Printf("Rolled back to config #%d on behalf of %s", id, by)
+	return snap, target, nil, nil
+}
+
+// writeSnapshotResult maps history errors onto HTTP status codes.
+func writeSnapshotResult(w http.ResponseWriter, snap *api.ConfigSnapshot, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownSnapshot):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, snap)
+	}
+}
@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"onyx/internal/api"
+)
+
+func TestHistoryPrunesOldest(t *testing.T) {
+	dir := t.TempDir()
+	h, err := OpenHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(h *History, n int) *api.ConfigSnapshot {
+		t.Helper()
+		snap, err := h.Record(api.ConfigSnapshot{Source: "test", Caddyfile: fmt.Sprintf("# config %d\n", n)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snap
+	}
+
+	const extra = 5
+	for n := 1; n <= maxHistory+extra; n++ {
+		if snap := record(h, n); snap == nil || snap.ID != n {
+			t.Fatalf("config %d recorded as %+v", n, snap)
+		}
+	}
+
+	list, err := h.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != maxHistory || list[0].ID != maxHistory+extra || list[len(list)-1].ID != extra+1 {
+		t.Fatalf("history lists %d snapshots from #%d to #%d, want %d from #%d to #%d",
+			len(list), list[0].ID, list[len(list)-1].ID, maxHistory, maxHistory+extra, extra+1)
+	}
+	if _, err := h.Get(extra); !errors.Is(err, ErrUnknownSnapshot) {
+		t.Errorf("pruned snapshot #%d: got %v, want %v", extra, err, ErrUnknownSnapshot)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != maxHistory {
+		t.Errorf("%d files left on disk, want %d", len(files), maxHistory)
+	}
+
+	// A reopened history carries on numbering and knows the latest config
+	h, err = OpenHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap := record(h, maxHistory+extra); snap != nil {
+		t.Errorf("the unchanged latest config was recorded again as #%d", snap.ID)
+	}
+	if snap := record(h, 1); snap == nil || snap.ID != maxHistory+extra+1 {
+		t.Errorf("next config recorded as %+v, want #%d", snap, maxHistory+extra+1)
+	}
+}
+
+func TestHistoryIgnoresSiteBookkeeping(t *testing.T) {
+	h, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, UpdatedBy: "local"}
+	if snap, err := h.Record(api.ConfigSnapshot{Sites: []api.Site{site}}); err != nil || snap == nil {
+		t.Fatalf("first config not recorded: %v", err)
+	}
+
+	site.UpdatedBy = "someone else"
+	if snap, err := h.Record(api.ConfigSnapshot{Sites: []api.Site{site}}); err != nil || snap != nil {
+		t.Errorf("re-stamping a site recorded a new config: %+v, %v", snap, err)
+	}
+	site.WAF = api.WAFBlock
+	if snap, err := h.Record(api.ConfigSnapshot{Sites: []api.Site{site}}); err != nil || snap == nil {
+		t.Errorf("changing a site's WAF mode was not recorded: %v", err)
+	}
+}
+
+// rollbackFixture is an engine serving a Caddyfile on a loopback port, with the approval policy
+// enabled and two unrelated owners.
+type rollbackFixture struct {
+	e          *Engine
+	dir, addr  string
+	alice, bob *api.ClientInfo
+}
+
+func newRollbackFixture(t *testing.T) *rollbackFixture {
+	t.Helper()
+	dir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &rollbackFixture{dir: dir, addr: l.Addr().String()}
+	l.Close()
+
+	// Caddy keeps its instance ID in the user's data directory whatever the storage
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+
+	f.e = New(Options{
+		Caddyfile:      filepath.Join(dir, "Caddyfile"),
+		ApprovalPolicy: filepath.Join(dir, "approval.json"),
+		RollbackPath:   filepath.Join(dir, "Caddyfile.rollback"),
+	})
+	if err := SaveApprovalPolicy(f.e.opts.ApprovalPolicy, api.ApprovalPolicy{Enabled: true, Window: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, reg := newTestRegistry(t)
+	f.e.clients = reg
+	for _, owner := range []struct {
+		name string
+		info **api.ClientInfo
+	}{{"alice", &f.alice}, {"bob", &f.bob}} {
+		if *owner.info, err = reg.Add(issueClient(t, ca, owner.name, api.RoleOwner), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.e.auditLog, err = OpenAuditLog(filepath.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	if f.e.changes, err = OpenChangeQueue(filepath.Join(dir, "changes.json")); err != nil {
+		t.Fatal(err)
+	}
+	if f.e.sites, err = OpenSiteStore(filepath.Join(dir, "sites.json")); err != nil {
+		t.Fatal(err)
+	}
+	if f.e.history, err = OpenHistory(filepath.Join(dir, "history")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.writeCaddyfile(t, "one")
+	if err := f.e.proxy.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.e.proxy.Stop() })
+	if snap := f.e.recordConfig(api.AuditEntry{Actor: "local"}, "start"); snap == nil || snap.ID != 1 {
+		t.Fatalf("first config recorded as %+v", snap)
+	}
+	return f
+}
+
+// caddyfile is a Caddyfile answering every request with body, keeping Caddy's state in the
+// fixture's directory.
+func (f *rollbackFixture) caddyfile(body string) string {
+	return fmt.Sprintf(`{
+	admin off
+	persist_config off
+	storage file_system {
+		root %s
+	}
+}
+
+http://%s {
+	respond %q
+}
+`, filepath.Join(f.dir, "caddy"), f.addr, body)
+}
+
+func (f *rollbackFixture) writeCaddyfile(t *testing.T, body string) {
+	t.Helper()
+	if err := os.WriteFile(f.e.opts.Caddyfile, []byte(f.caddyfile(body)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serving returns what the proxy answers.
+func (f *rollbackFixture) serving(t *testing.T) string {
+	t.Helper()
+	resp, err := http.Get("http://" + f.addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// call runs handler as client, with the path value id set.
+func (f *rollbackFixture) call(handler http.HandlerFunc, client *api.ClientInfo, method, path, id string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity{Client: client}))
+	r.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	return rec
+}
+
+func TestRollbackRestoresCaddyfile(t *testing.T) {
+	f := newRollbackFixture(t)
+	f.writeCaddyfile(t, "two")
+	if err := f.e.proxy.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if snap := f.e.recordConfig(api.AuditEntry{Actor: "local"}, "reload via test"); snap == nil || snap.ID != 2 {
+		t.Fatalf("reloaded config recorded as %+v", snap)
+	}
+	if got := f.serving(t); got != "two" {
+		t.Fatalf("serving %q after the reload", got)
+	}
+
+	// Nothing is removed, so the rollback runs without a second owner
+	rec := f.call(f.e.handleConfigRollback, f.alice, http.MethodPost, "/v1/config/history/1/rollback", "1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+	}
+	var snap api.ConfigSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.ID != 3 || snap.Source != "rollback to #1" || snap.AppliedBy != f.alice.Fingerprint {
+		t.Errorf("rollback recorded as #%d %q by %s", snap.ID, snap.Source, snap.AppliedBy)
+	}
+	if got := f.serving(t); got != "one" {
+		t.Errorf("serving %q after the rollback", got)
+	}
+
+	// The restored Caddyfile is left for an administrator; the one on disk is not touched
+	saved, err := os.ReadFile(f.e.opts.RollbackPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != f.caddyfile("one") {
+		t.Errorf("saved %q as the rollback Caddyfile", saved)
+	}
+	if onDisk, _ := os.ReadFile(f.e.opts.Caddyfile); string(onDisk) != f.caddyfile("two") {
+		t.Error("the rollback rewrote the Caddyfile on disk")
+	}
+
+	// Rolling back to the active config records nothing new
+	again, err := f.e.Rollback(1, identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != 1 {
+		t.Errorf("rolling back to the active config returned #%d, want #1", again.ID)
+	}
+}
+
+func TestRollbackRemovingSitesIsGuarded(t *testing.T) {
+	f := newRollbackFixture(t)
+
+	// A site added after config #1, which rolling back to it would remove
+	if _, err := f.e.sites.Put(api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}}, false,
+		func([]api.Site) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := f.call(f.e.handleConfigRollback, f.alice, http.MethodPost, "/v1/config/history/1/rollback", "1")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got %d %s, want 202", rec.Code, rec.Body)
+	}
+	var change api.PendingChange
+	if err := json.Unmarshal(rec.Body.Bytes(), &change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Action != "config.rollback" || change.Target != "#1" || change.ProposedBy != f.alice.Fingerprint {
+		t.Errorf("proposed %+v", change)
+	}
+	if len(f.e.sites.List()) != 1 {
+		t.Error("the site was removed before a second owner approved")
+	}
+	if _, err := os.Stat(f.e.opts.RollbackPath); !errors.Is(err, os.ErrNotExist) {
+		t.Error("a rollback Caddyfile was saved before a second owner approved")
+	}
+
+	// The proposer cannot approve it alone
+	rec = f.call(f.e.handleApproveChange, f.alice, http.MethodPost, "/v1/changes/"+change.ID+"/approve", change.ID)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("self-approval: got %d %s, want 403", rec.Code, rec.Body)
+	}
+
+	rec = f.call(f.e.handleApproveChange, f.bob, http.MethodPost, "/v1/changes/"+change.ID+"/approve", change.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("approval: got %d %s, want 200", rec.Code, rec.Body)
+	}
+	if sites := f.e.sites.List(); len(sites) != 0 {
+		t.Errorf("sites after the approved rollback: %+v", sites)
+	}
+	if saved, err := os.ReadFile(f.e.opts.RollbackPath); err != nil || string(saved) != f.caddyfile("one") {
+		t.Errorf("rollback Caddyfile after approval: %q, %v", saved, err)
+	}
+	report, err := f.e.auditLog.Query(api.AuditQuery{Action: "config.rollback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 1 || report.Entries[0].Actor != f.bob.Fingerprint || report.Entries[0].Result == api.AuditFailed {
+		t.Errorf("rollback audited as %+v", report.Entries)
+	}
+}
@@ -0,0 +1,369 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+)
+
+// Pairing windows can be held by a running engine, so `onyx --pair` does not need a listener of
+// its own next to the control plane. The CLI opens the window over the local socket and relays
+// its events to the operator; consoles pair on the control plane's /pair.
+
+// String names the outcome the way the pairing event stream reports it.
+func (o PairingOutcome) String() string {
+	switch o {
+	case PairingSucceeded:
+		return "succeeded"
+	case PairingExpired:
+		return "expired"
+	default:
+		return "closed"
+	}
+}
+
+// HostPairingMode is StartPairingMode for a host whose engine is running: the engine holds the
+// window on its control plane and client, on the local socket, relays it to the operator.
+// The window closes when this process goes away.
+func HostPairingMode(client *api.Client, token string, opts PairingOptions, stdin io.Reader, stdout, stderr io.Writer) (PairingOutcome, error) {
+	if err := opts.checkSAS(); err != nil {
+		return PairingClosed, err
+	}
+
+	console := stdout
+	if opts.JSON {
+		console = stderr
+	}
+
+	answers := readLines(stdin)
+	return pairingLoop(token, opts, stdout, answers, func(token string) (PairingOutcome, error) {
+		return hostPairingWindow(client, token, opts, stdout, console, answers)
+	})
+}
+
+// hostPairingWindow has the engine hold a single window and relays its events until it closes.
+// Prompts and JSON documents go to out, progress to console.
+func hostPairingWindow(client *api.Client, token string, opts PairingOptions, out, console io.Writer, answers <-chan string) (PairingOutcome, error) {
+	req := api.PairingWindowRequest{
+		Token:      token,
+		Role:       opts.Role,
+		MaxClients: opts.MaxClients,
+		Window:     opts.Window.String(),
+		AcceptSAS:  opts.AcceptSAS,
+	}
+
+	var id string
+	var prompt chan struct{} // Closed to withdraw the pending confirmation prompt
+	outcome, paired := PairingClosed, 0
+
+	err := client.OpenPairingWindow(req, func(ev api.PairingEvent) {
+		switch ev.Type {
+		case api.PairingEventOpen:
+			id = ev.ID
+			announceWindow(out, token, ev.Listen, opts, ev.ExpiresAt, ev.CAFingerprint)
+		case api.PairingEventLog:
+			fmt.Fprintln(console, ev.Message)
+		case api.PairingEventCode:
+			json.NewEncoder(out).Encode(pairingVerification{Remote: ev.Remote, VerificationCode: ev.Code})
+		case api.PairingEventConfirm:
+			// The engine asks again only once the previous question was answered or abandoned
+			if prompt != nil {
+				close(prompt)
+			}
+			prompt = make(chan struct{})
+			go answerCode(client, id, ev, out, console, answers, prompt)
+		case api.PairingEventPaired:
+			paired++
+			reportPaired(console, ev.Message, paired, opts.MaxClients)
+		case api.PairingEventClosed:
+			outcome = PairingClosed
+			for _, o := range []PairingOutcome{PairingSucceeded, PairingExpired} {
+				if ev.Outcome == o.String() {
+					outcome = o
+				}
+			}
+			reportClosed(console, outcome, ev.Message)
+		}
+	})
+	if prompt != nil {
+		close(prompt)
+	}
+	if err != nil {
+		return PairingClosed, fmt.Errorf("failed to hold a pairing window in the engine: %w", err)
+	}
+	return outcome, nil
+}
+
+// answerCode asks the operator about a "confirm" event and sends the answer to the engine,
+// unless the prompt is withdrawn first.
+func answerCode(client *api.Client, id string, ev api.PairingEvent, out, console io.Writer, answers <-chan string, withdrawn <-chan struct{}) {
+	accept := confirmCode(out, answers, ev.Remote, ev.Code, nil, withdrawn)
+	select {
+	case <-withdrawn:
+		return
+	default:
+	}
+
+	if err := client.ConfirmPairing(id, api.PairingConfirmation{Request: ev.Request, Accept: accept}); err != nil {
+		fmt.Fprintf(console, "Warning: the engine did not take the answer: %v\n", err)
+	}
+}
+
+// handleOpenPairing holds a pairing window on the control plane for `onyx --pair` and streams
+// its events until it closes. The window is tied to the request, so it never outlives the
+// operator who opened it.
+func (e *Engine) handleOpenPairing(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		writeError(w, http.StatusForbidden, "pairing windows can only be opened on the engine host")
+		return
+	}
+
+	// 1. Check the window's settings
+	var req api.PairingWindowRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+	role, err := api.ParseRole(string(req.Role))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	window, err := time.ParseDuration(req.Window)
+	if err != nil || window <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid window %q", req.Window))
+		return
+	}
+	if req.MaxClients < 1 {
+		writeError(w, http.StatusBadRequest, "max_clients must be at least 1")
+		return
+	}
+	if len(req.Token) < 8 {
+		writeError(w, http.StatusBadRequest, "token must be at least 8 characters")
+		return
+	}
+	if e.pairingWindows.find(req.Token) != nil {
+		writeError(w, http.StatusConflict, "a pairing window with this token is already open")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// 2. Stream events from here on; pairing requests report through the same stream
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	emit := func(ev api.PairingEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(ev)
+		flusher.Flush()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), window)
+	defer cancel()
+	expiresAt, _ := ctx.Deadline()
+
+	// The attempt log may already warn through the stream, so the status must be sent first
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	attempts := newAttemptLog(eventLog(emit), PairingLog, e.auditLog)
+	defer attempts.Close()
+
+	ca := e.ca()
+	pw := &pairingWindow{
+		ca:       ca,
+		clients:  e.clients,
+		role:     role,
+		guard:    newPairingGuard(req.Token, req.MaxClients),
+		attempts: attempts,
+		ctx:      ctx,
+		done:     make(chan string, req.MaxClients),
+		closed:   make(chan string, 1),
+		id:       hex.EncodeToString(id),
+		answers:  make(chan api.PairingConfirmation, 1),
+	}
+	pw.confirm = pw.hostedConfirm(emit, req.AcceptSAS)
+
+	defer e.pairingWindows.add(pw)()
+
+	emit(api.PairingEvent{
+		Type:          api.PairingEventOpen,
+		ID:            pw.id,
+		Listen:        e.opts.ControlAddr,
+		ExpiresAt:     expiresAt.UTC(),
+		CAFingerprint: crypto.Fingerprint(ca.ServerIssuer()),
+	})
+	e.audit(r, "pairing.open", pw.id, nil)
+	log.Printf("Pairing window %s for the %s role open on the control plane until %s", pw.id, role, expiresAt.Format(time.RFC3339))
+
+	// 3. Report pairings until the window is full, closes or the operator goes away
+	outcome, reason := pw.wait(req.MaxClients, func(clientID string, _ int) {
+		emit(api.PairingEvent{Type: api.PairingEventPaired, Message: clientID})
+	})
+	emit(api.PairingEvent{Type: api.PairingEventClosed, Outcome: outcome.String(), Message: reason})
+	log.Printf("Pairing window %s %s", pw.id, outcome)
+}
+
+// hostedConfirm returns the confirm function of a window the engine holds. It asks the operator
+// through a "confirm" event and waits for the answer on pw.answers, one session at a time.
+// With acceptSAS every code is accepted and only reported.
+func (pw *pairingWindow) hostedConfirm(emit func(api.PairingEvent), acceptSAS bool) func(r *http.Request, code string) bool {
+	var mu sync.Mutex
+	asked := 0
+
+	return func(r *http.Request, code string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if acceptSAS {
+			emit(api.PairingEvent{Type: api.PairingEventCode, Remote: r.RemoteAddr, Code: code})
+			pw.attempts.Record(r.RemoteAddr, api.AuditOK, "verification code "+code+" (accepted unconfirmed, non-interactive)")
+			return true
+		}
+
+		asked++
+		select {
+		case <-pw.answers: // A late answer to an abandoned question
+		default:
+		}
+		emit(api.PairingEvent{Type: api.PairingEventConfirm, Request: asked, Remote: r.RemoteAddr, Code: code})
+
+		for {
+			select {
+			case answer := <-pw.answers:
+				if answer.Request == asked {
+					return answer.Accept
+				}
+			case <-r.Context().Done():
+				emit(api.PairingEvent{Type: api.PairingEventLog, Message: "[!] Client disconnected before confirmation."})
+				return false
+			case <-pw.ctx.Done():
+				return false
+			}
+		}
+	}
+}
+
+// handleConfirmPairing passes the operator's answer to a "confirm" event to its window.
+func (e *Engine) handleConfirmPairing(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		writeError(w, http.StatusForbidden, "pairing windows can only be answered on the engine host")
+		return
+	}
+
+	var answer api.PairingConfirmation
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&answer); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	pw := e.pairingWindows.get(r.PathValue("id"))
+	if pw == nil {
+		writeError(w, http.StatusNotFound, "no such pairing window")
+		return
+	}
+
+	select {
+	case pw.answers <- answer:
+		writeJSON(w, http.StatusOK, answer)
+	default:
+		writeError(w, http.StatusConflict, "no verification code is waiting for an answer")
+	}
+}
+
+// eventLog turns the lines an attemptLog writes to its console into log events.
+type eventLog func(api.PairingEvent)
+
+func (emit eventLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		emit(api.PairingEvent{Type: api.PairingEventLog, Message: line})
+	}
+	return len(p), nil
+}
+
+// hostedWindows are the pairing windows whose tokens the control plane accepts.
+type hostedWindows struct {
+	mu      sync.Mutex
+	windows map[*pairingWindow]struct{}
+}
+
+// add serves pw's token on the control plane until the returned function is called.
+func (h *hostedWindows) add(pw *pairingWindow) (remove func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.windows == nil {
+		h.windows = make(map[*pairingWindow]struct{})
+	}
+	h.windows[pw] = struct{}{}
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.windows, pw)
+	}
+}
+
+// get returns the window with the given ID, or nil.
+func (h *hostedWindows) get(id string) *pairingWindow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for pw := range h.windows {
+		if pw.id != "" && pw.id == id {
+			return pw
+		}
+	}
+	return nil
+}
+
+// find returns the window token belongs to, or nil. Every window's token is compared, in
+// constant time, so the answer's timing reveals nothing about which ones exist.
+func (h *hostedWindows) find(token string) *pairingWindow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var found *pairingWindow
+	for pw := range h.windows {
+		if pw.guard.Matches(token) {
+			found = pw
+		}
+	}
+	return found
+}
+
+// refuse counts a wrong token from source against every window, closing those that run out of
+// attempts.
+func (h *hostedWindows) refuse(source, token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for pw := range h.windows {
+		if pw.guard.Matches(token) {
+			continue // Opened since the token was looked up; never spend one of its uses here
+		}
+		if perr := pw.guard.Check(source, token); perr != nil {
+			pw.refused(source, perr)
+		}
+	}
+}
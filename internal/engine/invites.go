@@ -0,0 +1,284 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+	"onyx/internal/pairing"
+)
+
+// InvitesPath keeps pending invitations, so they survive an engine restart.
+const InvitesPath = AuthDir + "/invites.json"
+
+// Limits on invitations and on guessing their tokens.
+const (
+	maxInviteTTL       = 7 * 24 * time.Hour
+	inviteFailureReset = 15 * time.Minute // Failed redemptions are forgotten after this long
+)
+
+// invitation is a pending enrolment token. Only a hash of the token is kept.
+type invitation struct {
+	ID            string    `json:"id"`
+	TokenHash     string    `json:"token_hash"`
+	Role          api.Role  `json:"role"`
+	InvitedBy     string    `json:"invited_by"` // Fingerprint of the inviting admin, or "local"
+	InvitedByName string    `json:"invited_by_name,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// Invitations holds the enrolment tokens minted by owners through the control plane. Redeeming
+// one pairs a new console without anyone at the engine's terminal, so wrong guesses are
+// budgeted per source address and in total, like a pairing window.
+type Invitations struct {
+	path string
+
+	mu       sync.Mutex
+	pending  map[string]*invitation // Keyed by token hash
+	failures map[string]int         // Wrong tokens per source address
+	total    int
+	resetAt  time.Time // When the failure counts are cleared
+}
+
+// OpenInvitations loads the pending invitations at path, dropping expired ones.
+func OpenInvitations(path string) (*Invitations, error) {
+	inv := &Invitations{path: path, pending: make(map[string]*invitation), failures: make(map[string]int)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read invitations: %w", err)
+	}
+	if len(data) > 0 {
+		var list []*invitation
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to read invitations: %w", err)
+		}
+		for _, i := range list {
+			if time.Now().Before(i.ExpiresAt) {
+				inv.pending[i.TokenHash] = i
+			}
+		}
+	}
+	return inv, nil
+}
+
+// Create mints a token for role that can be redeemed once until ttl has passed.
+func (inv *Invitations) Create(role api.Role, ttl time.Duration, by identity) (*api.Invitation, error) {
+	if ttl <= 0 || ttl > maxInviteTTL {
+		return nil, fmt.Errorf("ttl must be between 1s and %s", maxInviteTTL)
+	}
+
+	token, err := GeneratePairingToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	i := &invitation{
+		ID:        hex.EncodeToString(id),
+		TokenHash: hashToken(token),
+		Role:      role,
+		InvitedBy: "local",
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if by.Client != nil {
+		i.InvitedBy, i.InvitedByName = by.Client.Fingerprint, by.Client.Name
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	inv.pending[i.TokenHash] = i
+	if err := inv.save(); err != nil {
+		delete(inv.pending, i.TokenHash)
+		return nil, err
+	}
+
+	return &api.Invitation{ID: i.ID, Token: token, Role: role, ExpiresAt: i.ExpiresAt}, nil
+}
+
+// Redeem consumes the invitation for token. A matching token is spent immediately, whatever
+// happens next, so it can never be replayed.
+func (inv *Invitations) Redeem(source, token string) (*invitation, *pairing.Error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if time.Now().After(inv.resetAt) {
+		clear(inv.failures)
+		inv.total, inv.resetAt = 0, time.Now().Add(inviteFailureReset)
+	}
+	if inv.total >= maxFailuresTotal || inv.failures[source] >= maxFailuresPerSource {
+		return nil, &pairing.Error{Code: pairing.ErrLockedOut, Message: "too many failed attempts; try again later"}
+	}
+
+	i, ok := inv.pending[hashToken(token)]
+	if !ok || time.Now().After(i.ExpiresAt) {
+		inv.failures[source]++
+		inv.total++
+		return nil, &pairing.Error{Code: pairing.ErrBadToken, Message: "invalid, expired or already used invitation"}
+	}
+
+	delete(inv.pending, i.TokenHash)
+	if err := inv.save(); err != nil {
+		log.Printf("Failed to save invitations: %v", err)
+	}
+	return i, nil
+}
+
+// save writes the unexpired invitations. Callers must hold inv.mu.
+func (inv *Invitations) save() error {
+	list := make([]*invitation, 0, len(inv.pending))
+	for hash, i := range inv.pending {
+		if time.Now().After(i.ExpiresAt) {
+			delete(inv.pending, hash)
+			continue
+		}
+		list = append(list, i)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(inv.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save invitations: %w", err)
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (e *Engine) handleInvite(w http.ResponseWriter, r *http.Request) {
+	req := api.InviteRequest{Role: api.RoleViewer, TTL: "1h"}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	role, err := api.ParseRole(string(req.Role))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", req.TTL))
+		return
+	}
+
+	req.Role, req.TTL = role, ttl.String()
+
+	// A second owner could approve anything the inviter proposes, so owner invitations are guarded
+	if role == api.RoleOwner {
+		e.runGuarded(w, r, "invite.create", string(role), req)
+		return
+	}
+
+	params, _ := json.Marshal(req)
+	invite, target, _, err := inviteOp(e, callerOf(r), string(role), params)
+	e.audit(r, "invite.create", target, err)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+// inviteOp mints an invitation on behalf of by, who is recorded as the inviter.
+func inviteOp(e *Engine, by identity, role string, params json.RawMessage) (any, string, func(), error) {
+	var req api.InviteRequest
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, role, nil, fmt.Errorf("malformed invitation parameters: %w", err)
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		return nil, role, nil, fmt.Errorf("invalid ttl %q", req.TTL)
+	}
+
+	invite, err := e.invites.Create(req.Role, ttl, by)
+	if err != nil {
+		return nil, role, nil, err
+	}
+	invite.CAFingerprint = crypto.Fingerprint(e.ca().ServerIssuer())
+
+	log.Printf("Invitation %s for the %s role created by %s, valid until %s", invite.ID, req.Role, by, invite.ExpiresAt.Format(time.RFC3339))
+	return invite, invite.ID, nil, nil
+}
+
+// redeemInvite pairs a console with an invitation token presented on the control plane. The
+// inviting admin stands in for the operator who would otherwise confirm the verification code.
+func (e *Engine) redeemInvite(w http.ResponseWriter, source string, version int, req pairing.Request) {
+	entry := api.AuditEntry{Remote: source, Action: "invite.redeem"}
+
+	fail := func(version int, perr *pairing.Error) {
+		entry.Result, entry.Detail = api.AuditDenied, string(perr.Code)+": "+perr.Message
+		e.auditLog.Record(entry)
+		pairing.WriteError(w, version, perr)
+	}
+
+	// 2. Spend the invitation, which must still be backed by an admin with access
+	invite, perr := e.invites.Redeem(source, req.Token)
+	if perr != nil {
+		// A wrong token may have been a guess at a pairing window's, so it counts there too
+		if perr.Code == pairing.ErrBadToken {
+			e.pairingWindows.refuse(source, req.Token)
+		}
+		fail(version, perr)
+		return
+	}
+	entry.Actor, entry.ActorName = invite.InvitedBy, invite.InvitedByName
+
+	if invite.InvitedBy != "local" {
+		inviter, err := e.clients.Get(invite.InvitedBy)
+		if err != nil || (inviter.Revoked && inviter.ReplacedBy == "") {
+			fail(version, &pairing.Error{Code: pairing.ErrBadToken, Message: "the invitation was withdrawn"})
+			return
+		}
+	}
+
+	// 3. Sign the CSR with the role chosen by the inviter, never one from the request
+	ca := e.ca()
+	certPEM, err := ca.SignCSR([]byte(req.CSR), invite.Role)
+	if err != nil {
+		fail(version, &pairing.Error{Code: pairing.ErrBadRequest, Message: fmt.Sprintf("signing failed: %v", err)})
+		return
+	}
+
+	// 4. Register the certificate along with who vouched for it
+	info, err := e.clients.Add(certPEM, invite.InvitedBy)
+	if err != nil {
+		fail(version, &pairing.Error{Code: pairing.ErrInternal, Message: "failed to persist authorization"})
+		return
+	}
+
+	pairing.WriteResponse(w, pairing.Response{
+		Version:       version,
+		Certificate:   string(certPEM),
+		CACertificate: string(ca.Bundle()),
+	})
+
+	entry.Target = info.Fingerprint
+	entry.Detail = fmt.Sprintf("%s as %s with invitation %s", info.Name, info.Role, invite.ID)
+	e.auditLog.Record(entry)
+	log.Printf("Client %s (%s, %s) paired from %s with invitation %s", info.Name, info.Fingerprint[:16], info.Role, source, invite.ID)
+}
@@ -5,20 +5,34 @@ package engine
 import (
 	"bufio"
 	"context"
-	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"onyx/internal/api"
 	"onyx/internal/crypto"
+	"onyx/internal/pairing"
 )
 
+// maxPairingBody bounds the size of a pairing request; a CSR is well under a kilobyte.
+const maxPairingBody = 64 << 10
+
+// revealTimeout bounds the wait between the two rounds of a window pairing.
+const revealTimeout = 30 * time.Second
+
 // GeneratePairingToken creates a high-entropy, human-readable 8-character token.
 func GeneratePairingToken() (string, error) {
 	const charset = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
@@ -33,100 +47,543 @@ func GeneratePairingToken() (string, error) {
 	return fmt.Sprintf("%s-%s", string(out[:4]), string(out[4:])), nil
 }
 
-// StartPairingMode opens a 5-minute window for a new admin to pair.
-func StartPairingMode(token string) {
-	reader := bufio.NewReader(os.Stdin)
+// PairingOptions controls how and where a pairing window is opened.
+type PairingOptions struct {
+	BindAddr   string        // Interface to listen on; empty means all interfaces
+	Port       int           // TCP port of the pairing listener
+	Window     time.Duration // How long each window stays open
+	MaxClients int           // How many admins may pair with the same token
+	Role       api.Role      // Access granted to every admin paired in this window
+
+	// JSON selects non-interactive mode: the token and expiry are printed as a JSON document
+	// on stdout, progress goes to stderr and the window is never reopened. Nobody confirms the
+	// verification codes, so JSON mode also needs AcceptSAS; each code is printed as a JSON
+	// document for the provisioning tool to compare with the one onyx-admin shows.
+	JSON bool
+
+	// AcceptSAS accepts verification codes without an operator comparing them, giving up the
+	// check against an attacker in the middle of the pairing connection. Only valid with JSON.
+	AcceptSAS bool
+}
+
+// checkSAS refuses JSON mode without AcceptSAS, where nobody would confirm the codes, and
+// AcceptSAS without JSON, where the operator is asked anyway.
+func (opts PairingOptions) checkSAS() error {
+	if opts.JSON && !opts.AcceptSAS {
+		return fmt.Errorf("non-interactive pairing cannot confirm verification codes unless told to accept them")
+	}
+	if opts.AcceptSAS && !opts.JSON {
+		return fmt.Errorf("verification codes are only accepted unconfirmed in non-interactive pairing")
+	}
+	return nil
+}
+
+// DefaultPairingOptions returns the classic interactive 5-minute window on port 2305.
+func DefaultPairingOptions() PairingOptions {
+	return PairingOptions{
+		Port:       2305,
+		Window:     5 * time.Minute,
+		MaxClients: 1,
+		Role:       api.RoleOwner,
+	}
+}
+
+// PairingOutcome describes how a pairing session ended.
+type PairingOutcome int
+
+const (
+	PairingSucceeded PairingOutcome = iota // Every allowed client paired
+	PairingExpired                         // The window ran out first
+	PairingClosed                          // The window was closed early (lockout, rejection)
+)
+
+// pairingAnnouncement is the document printed in JSON mode once the listener is up.
+type pairingAnnouncement struct {
+	Token         string    `json:"token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Listen        string    `json:"listen"`
+	MaxClients    int       `json:"max_clients"`
+	Role          api.Role  `json:"role"`
+	CAFingerprint string    `json:"ca_fingerprint"`
+}
 
-	// Generate a temporary CA key for this pairing session
-	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+// pairingVerification is the document printed in JSON mode for each code accepted unconfirmed.
+type pairingVerification struct {
+	Remote           string `json:"remote"`
+	VerificationCode string `json:"verification_code"`
+}
+
+// PairingPaths locates the files a pairing session reads and writes.
+type PairingPaths struct {
+	ClientsDir string // Client registry the paired admins are added to
+	CRLPath    string // Revocation list kept alongside the registry
+	AuditPath  string
+	PairingLog string
+}
+
+// DefaultPairingPaths returns the locations used by an installed engine.
+func DefaultPairingPaths() PairingPaths {
+	return PairingPaths{ClientsDir: ClientsDir, CRLPath: CRLPath, AuditPath: AuditPath, PairingLog: PairingLog}
+}
+
+// StartPairingMode opens a pairing window for new admins, talking to the operator through
+// stdin and stdout. In JSON mode stdout only carries the announcement and progress goes to stderr.
+// Client certificates are issued by the engine's persistent CA, and the session runs over TLS
+// with a CA-issued pairing certificate. In interactive mode the operator confirms the verification
+// code shown by onyx-admin before anything is persisted. Tokens are consumed on use and the window
+// closes early after too many failed attempts.
+func StartPairingMode(token string, ca *Authority, opts PairingOptions, paths PairingPaths, stdin io.Reader, stdout, stderr io.Writer) (PairingOutcome, error) {
+	if err := opts.checkSAS(); err != nil {
+		return PairingClosed, err
+	}
+
+	console := stdout
+	if opts.JSON {
+		console = stderr
+	}
+
+	crl, err := LoadRevocationList(ca, paths.CRLPath)
 	if err != nil {
-		fmt.Printf("Critical error: failed to generate session key: %v\n", err)
-		return
+		return PairingClosed, err
 	}
+	clients, err := OpenRegistry(paths.ClientsDir, crl)
+	if err != nil {
+		return PairingClosed, err
+	}
+
+	answers := readLines(stdin)
+	attempts := openAttemptLog(console, paths.PairingLog, paths.AuditPath)
+	defer attempts.Close()
+
+	return pairingLoop(token, opts, stdout, answers, func(token string) (PairingOutcome, error) {
+		return runPairingWindow(token, ca, clients, opts, stdout, console, attempts, answers)
+	})
+}
 
+// pairingLoop runs windows with run until one succeeds. In interactive mode the operator is
+// offered a new window, with a new token, each time one ends without every client paired.
+func pairingLoop(token string, opts PairingOptions, stdout io.Writer, answers <-chan string, run func(token string) (PairingOutcome, error)) (PairingOutcome, error) {
 	for {
-		fmt.Printf("\n[PAIRING MODE ACTIVE]\n")
-		fmt.Printf("Token: %s\n", token)
-		fmt.Printf("Port:  2305\n")
-		fmt.Printf("Window: 5 Minutes\n\n")
-
-		resultChan := make(chan bool)
-		pairingCtx, pairingCancel := context.WithTimeout(context.Background(), 5*time.Minute)
-
-		mux := http.NewServeMux()
-		mux.HandleFunc("/pair", func(w http.ResponseWriter, r *http.Request) {
-			// 1. Verify the Token
-			if r.Header.Get("X-Onyx-Token") != token {
-				http.Error(w, "Invalid pairing token", http.StatusUnauthorized)
-				return
-			}
-
-			// 2. Read the CSR from the body
-			csrBytes, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "Failed to read CSR", http.StatusBadRequest)
-				return
-			}
-
-			// 3. Sign the CSR
-			certPEM, err := crypto.SignCSR(csrBytes, caPriv)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Signing failed: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			// 4. Extract identity and save the "Public Key" (the cert) for future mTLS
-			cert, _ := crypto.ParseCertificate(certPEM)
-			clientID := cert.Subject.CommonName
-
-			// Ensure the auth directory exists
-			authDir := "/var/lib/onyx/auth/clients/"
-			os.MkdirAll(authDir, 0755)
-
-			certPath := filepath.Join(authDir, fmt.Sprintf("%s.crt", clientID))
-			if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
-				http.Error(w, "Failed to persist authorization", http.StatusInternalServerError)
-				return
-			}
-
-			// 5. Send the signed cert back to the client
-			w.Header().Set("Content-Type", "application/x-pem-file")
-			w.Write(certPEM)
-
-			resultChan <- true
-		})
+		outcome, err := run(token)
+		if err != nil || outcome == PairingSucceeded || opts.JSON {
+			return outcome, err
+		}
 
-		srv := &http.Server{Addr: ":2305", Handler: mux}
+		fmt.Fprint(stdout, "No onyx-admin client paired. Try again? (y/N): ")
+		answer := <-answers
+		if strings.TrimSpace(strings.ToLower(answer)) != "y" {
+			fmt.Fprintln(stdout, "Exiting pairing mode.")
+			return outcome, nil
+		}
 
-		go func() {
-			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-				fmt.Printf("Error: %v\n", err)
-			}
-		}()
+		// The previous token may have been consumed or guessed at, so never reuse it
+		if token, err = GeneratePairingToken(); err != nil {
+			return outcome, fmt.Errorf("failed to generate token: %w", err)
+		}
+	}
+}
 
-		success := false
-		select {
-		case <-resultChan:
-			fmt.Println("[✓] Device paired successfully. Certificate saved.")
-			success = true
-		case <-pairingCtx.Done():
-			fmt.Println("\n[!] Pairing window expired.")
+// runPairingWindow serves a single window until it fills up, expires or is closed. Prompts
+// and the JSON announcement go to out, progress to console.
+func runPairingWindow(token string, ca *Authority, clients *Registry, opts PairingOptions, out, console io.Writer, attempts *attemptLog, answers <-chan string) (PairingOutcome, error) {
+	// The pairing certificate is issued by the CA the client is about to pin
+	serverCert, err := ca.ServerCertificate()
+	if err != nil {
+		return PairingClosed, fmt.Errorf("failed to create pairing certificate: %w", err)
+	}
+
+	addr := net.JoinHostPort(opts.BindAddr, strconv.Itoa(opts.Port))
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{serverCert},
+	})
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return PairingClosed, fmt.Errorf("failed to open pairing listener: %s is already in use, by the engine's control plane if it listens there; with the engine running, run `onyx --pair` without --bind and --port to pair through it", addr)
+	}
+	if err != nil {
+		return PairingClosed, fmt.Errorf("failed to open pairing listener: %w", err)
+	}
+
+	pairingCtx, pairingCancel := context.WithTimeout(context.Background(), opts.Window)
+	defer pairingCancel()
+	expiresAt, _ := pairingCtx.Deadline()
+
+	window := &pairingWindow{
+		ca:       ca,
+		clients:  clients,
+		role:     opts.Role,
+		guard:    newPairingGuard(token, opts.MaxClients),
+		attempts: attempts,
+		ctx:      pairingCtx,
+		done:     make(chan string, opts.MaxClients),
+		closed:   make(chan string, 1),
+	}
+
+	// Only one request at a time may hold the console for confirmation
+	var confirmMu sync.Mutex
+
+	if opts.JSON {
+		// Nobody is watching a console, so the code is handed to the provisioning tool and
+		// recorded for later review
+		window.confirm = func(r *http.Request, code string) bool {
+			confirmMu.Lock()
+			defer confirmMu.Unlock()
+			json.NewEncoder(out).Encode(pairingVerification{Remote: r.RemoteAddr, VerificationCode: code})
+			attempts.Record(r.RemoteAddr, api.AuditOK, "verification code "+code+" (accepted unconfirmed, non-interactive)")
+			return true
+		}
+
+		announceWindow(out, token, ln.Addr().String(), opts, expiresAt, crypto.Fingerprint(ca.ServerIssuer()))
+	} else {
+		window.confirm = func(r *http.Request, code string) bool {
+			confirmMu.Lock()
+			defer confirmMu.Unlock()
+			return confirmCode(out, answers, r.RemoteAddr, code, r.Context().Done(), pairingCtx.Done())
 		}
 
+		announceWindow(out, token, ln.Addr().String(), opts, expiresAt, "")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST "+pairing.Path, window)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			fmt.Fprintf(console, "Error: %v\n", err)
+		}
+	}()
+
+	defer func() {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 2*time.Second)
 		srv.Shutdown(shutdownCtx)
 		shutdownCancel()
-		pairingCancel()
+	}()
+
+	outcome, reason := window.wait(opts.MaxClients, func(clientID string, paired int) {
+		reportPaired(console, clientID, paired, opts.MaxClients)
+	})
+	reportClosed(console, outcome, reason)
+	return outcome, nil
+}
+
+// announceWindow tells the operator, or in JSON mode the provisioning tool, that a window is open.
+// The CA fingerprint is only part of the JSON announcement.
+func announceWindow(out io.Writer, token, listen string, opts PairingOptions, expiresAt time.Time, caFingerprint string) {
+	if opts.JSON {
+		json.NewEncoder(out).Encode(pairingAnnouncement{
+			Token:         token,
+			ExpiresAt:     expiresAt.UTC(),
+			Listen:        listen,
+			MaxClients:    opts.MaxClients,
+			Role:          opts.Role,
+			CAFingerprint: caFingerprint,
+		})
+		return
+	}
+
+	fmt.Fprintf(out, "\n[PAIRING MODE ACTIVE]\n")
+	fmt.Fprintf(out, "Token:   %s\n", token)
+	fmt.Fprintf(out, "Listen:  %s\n", listen)
+	fmt.Fprintf(out, "Window:  %s (until %s)\n", opts.Window, expiresAt.Format("15:04:05"))
+	fmt.Fprintf(out, "Clients: %d\n", opts.MaxClients)
+	fmt.Fprintf(out, "Role:    %s\n\n", opts.Role)
+}
 
-		if success {
-			break
+func reportPaired(console io.Writer, clientID string, paired, maxClients int) {
+	fmt.Fprintf(console, "[✓] Device %s paired successfully (%d/%d). Certificate saved.\n", clientID, paired, maxClients)
+}
+
+func reportClosed(console io.Writer, outcome PairingOutcome, reason string) {
+	switch outcome {
+	case PairingClosed:
+		fmt.Fprintf(console, "\n[!] %s. Pairing window closed.\n", reason)
+	case PairingExpired:
+		fmt.Fprintln(console, "\n[!] Pairing window expired.")
+	}
+}
+
+// wait blocks until maxClients clients paired or the window closed or expired, passing each
+// pairing to paired. The reason is set when the window closed early.
+func (pw *pairingWindow) wait(maxClients int, paired func(clientID string, count int)) (PairingOutcome, string) {
+	for count := 0; count < maxClients; {
+		select {
+		case clientID := <-pw.done:
+			count++
+			paired(clientID, count)
+		case reason := <-pw.closed:
+			return PairingClosed, reason
+		case <-pw.ctx.Done():
+			return PairingExpired, ""
 		}
+	}
+	return PairingSucceeded, ""
+}
 
-		fmt.Print("No onyx-admin client paired. Try again? (y/N): ")
-		answer, _ := reader.ReadString('\n')
-		if strings.TrimSpace(strings.ToLower(answer)) != "y" {
-			fmt.Println("Exiting pairing mode.")
-			break
+// pairingWindow serves the pairing endpoint for a single token.
+type pairingWindow struct {
+	ca       *Authority
+	clients  *Registry
+	role     api.Role
+	guard    *pairingGuard
+	attempts *attemptLog
+	ctx      context.Context
+
+	// confirm asks the operator to compare the session's verification code
+	confirm func(r *http.Request, code string) bool
+
+	done   chan string // Receives the client ID once a client has been paired
+	closed chan string // Receives a reason when the window must close early
+
+	// Set for windows the engine holds for `onyx --pair`
+	id      string
+	answers chan api.PairingConfirmation // Operator answers posted to the local socket
+
+	mu      sync.Mutex
+	pending map[string]*pendingPairing // First rounds waiting for the console's nonce, by session
+}
+
+// pendingPairing is a window pairing whose token was accepted, waiting for the console to
+// reveal the nonce it committed to.
+type pendingPairing struct {
+	csr        string
+	commitment string
+	nonce      []byte // The engine's nonce
+	timer      *time.Timer
+}
+
+func (pw *pairingWindow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	source, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// 1. Decode the request and agree on a protocol version
+	req, version, perr := readPairingRequest(r)
+	if perr != nil {
+		pw.attempts.Record(source, api.AuditDenied, string(perr.Code)+": "+perr.Message)
+		pairing.WriteError(w, version, perr)
+		return
+	}
+
+	pw.pair(w, r, source, version, req)
+}
+
+// readPairingRequest decodes a pairing request and agrees on a protocol version. Errors are
+// answered in the newest version.
+func readPairingRequest(r *http.Request) (pairing.Request, int, *pairing.Error) {
+	var req pairing.Request
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPairingBody)).Decode(&req); err != nil {
+		return req, pairing.Version, &pairing.Error{Code: pairing.ErrBadRequest, Message: "malformed pairing request"}
+	}
+
+	version, ok := pairing.Negotiate(req.Versions)
+	if !ok {
+		return req, pairing.Version, &pairing.Error{Code: pairing.ErrUnsupportedVersion, Message: "no common protocol version"}
+	}
+	return req, version, nil
+}
+
+// pair checks the token of a decoded request against the window, has the operator confirm the
+// verification code and issues the certificate. It serves the window's own listener as well as
+// the control plane, when the engine holds the window.
+func (pw *pairingWindow) pair(w http.ResponseWriter, r *http.Request, source string, version int, req pairing.Request) {
+	fail := func(version int, perr *pairing.Error) {
+		pw.attempts.Record(source, api.AuditDenied, string(perr.Code)+": "+perr.Message)
+		pairing.WriteError(w, version, perr)
+	}
+
+	// Once the token is accepted any failure burns the window, since a consumed use cannot be returned
+	reject := func(perr *pairing.Error) {
+		fail(version, perr)
+		pw.close("Pairing token was used but pairing did not complete")
+	}
+
+	// A revealed nonce continues a pairing whose token was accepted on the same session
+	if req.Nonce != "" {
+		pw.reveal(w, r, source, version, req, fail, reject)
+		return
+	}
+
+	// 2. Verify the Token. A correct token is consumed here, whatever happens next.
+	if pw.ctx.Err() != nil {
+		fail(version, &pairing.Error{Code: pairing.ErrExpired, Message: "the pairing window has closed"})
+		return
+	}
+	if perr := pw.guard.Check(source, req.Token); perr != nil {
+		pw.refused(source, perr)
+		pairing.WriteError(w, version, perr)
+		return
+	}
+	pw.attempts.Record(source, api.AuditOK, "token accepted")
+
+	// 3. Answer the console's commitment with the engine's nonce, then wait for it to reveal its own
+	if len(req.Commitment) != 2*sha256.Size {
+		reject(&pairing.Error{Code: pairing.ErrBadRequest, Message: "missing or malformed nonce commitment"})
+		return
+	}
+	binding, err := crypto.SessionBinding(*r.TLS)
+	if err != nil {
+		reject(&pairing.Error{Code: pairing.ErrInternal, Message: "failed to bind the pairing to the session"})
+		return
+	}
+	nonce, err := crypto.NewNonce()
+	if err != nil {
+		reject(&pairing.Error{Code: pairing.ErrInternal, Message: "failed to generate nonce"})
+		return
+	}
+
+	pw.hold(source, binding, &pendingPairing{csr: req.CSR, commitment: req.Commitment, nonce: nonce})
+	pairing.WriteResponse(w, pairing.Response{Version: version, Nonce: hex.EncodeToString(nonce)})
+}
+
+// reveal completes a pairing once the console has revealed the nonce it committed to.
+func (pw *pairingWindow) reveal(w http.ResponseWriter, r *http.Request, source string, version int, req pairing.Request,
+	fail func(int, *pairing.Error), reject func(*pairing.Error)) {
+	// 4. Find the first round, which only this TLS session can continue
+	if pw.ctx.Err() != nil {
+		fail(version, &pairing.Error{Code: pairing.ErrExpired, Message: "the pairing window has closed"})
+		return
+	}
+	binding, err := crypto.SessionBinding(*r.TLS)
+	if err != nil {
+		fail(version, &pairing.Error{Code: pairing.ErrBadRequest, Message: "no pairing was started on this session"})
+		return
+	}
+	p := pw.take(binding)
+	if p == nil {
+		fail(version, &pairing.Error{Code: pairing.ErrBadRequest, Message: "no pairing was started on this session"})
+		return
+	}
+
+	adminNonce, err := hex.DecodeString(req.Nonce)
+	if err != nil || !crypto.VerifyCommitment(p.commitment, adminNonce) {
+		reject(&pairing.Error{Code: pairing.ErrBadRequest, Message: "the nonce does not match the commitment"})
+		return
+	}
+
+	// 5. Have the operator compare the verification code with the one shown by onyx-admin
+	code, err := crypto.ShortAuthString(*r.TLS, adminNonce, p.nonce)
+	if err != nil {
+		reject(&pairing.Error{Code: pairing.ErrInternal, Message: "failed to derive verification code"})
+		return
+	}
+
+	if !pw.confirm(r, code) {
+		reject(&pairing.Error{Code: pairing.ErrRejected, Message: "verification code rejected by the engine operator"})
+		return
+	}
+
+	// 6. Sign the CSR with the role chosen when the token was minted, never one from the request
+	certPEM, err := pw.ca.SignCSR([]byte(p.csr), pw.role)
+	if err != nil {
+		reject(&pairing.Error{Code: pairing.ErrBadRequest, Message: fmt.Sprintf("signing failed: %v", err)})
+		return
+	}
+
+	// 7. Register the certificate by fingerprint for future mTLS
+	info, err := pw.clients.Add(certPEM, "")
+	if err != nil {
+		reject(&pairing.Error{Code: pairing.ErrInternal, Message: "failed to persist authorization"})
+		return
+	}
+	clientID := fmt.Sprintf("%s (%s, %s)", info.Name, info.Fingerprint[:16], info.Role)
+
+	// 8. Send the signed cert back to the client along with the CA it should pin
+	pairing.WriteResponse(w, pairing.Response{
+		Version:       version,
+		Certificate:   string(certPEM),
+		CACertificate: string(pw.ca.Bundle()),
+	})
+	pw.attempts.Paired(source, info)
+
+	pw.done <- clientID
+}
+
+// hold keeps the first round of a pairing until the console reveals its nonce, and burns the
+// window if it does not within revealTimeout.
+func (pw *pairingWindow) hold(source, binding string, p *pendingPairing) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.pending == nil {
+		pw.pending = make(map[string]*pendingPairing)
+	}
+	if old := pw.pending[binding]; old != nil {
+		old.timer.Stop()
+	}
+	pw.pending[binding] = p
+	p.timer = time.AfterFunc(revealTimeout, func() {
+		pw.mu.Lock()
+		expired := pw.pending[binding] == p
+		if expired {
+			delete(pw.pending, binding)
+		}
+		pw.mu.Unlock()
+
+		if expired {
+			pw.attempts.Record(source, api.AuditDenied, "the console did not reveal its nonce in time")
+			pw.close("Pairing token was used but pairing did not complete")
 		}
+	})
+}
+
+// take removes and returns the first round held for a session, or nil.
+func (pw *pairingWindow) take(binding string) *pendingPairing {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	p := pw.pending[binding]
+	if p != nil {
+		delete(pw.pending, binding)
+		p.timer.Stop()
+	}
+	return p
+}
+
+// refused reports a token the guard turned down and closes the window once it is locked.
+func (pw *pairingWindow) refused(source string, perr *pairing.Error) {
+	fromSource, total := pw.guard.Failures(source)
+	pw.attempts.Record(source, api.AuditDenied, fmt.Sprintf("%s (failures: %d from this address, %d total)", perr.Code, fromSource, total))
+
+	if pw.guard.Locked() {
+		pw.close("Too many failed attempts")
 	}
 }
+
+// close ends the window early with the given reason, if it has not been closed already.
+func (pw *pairingWindow) close(reason string) {
+	select {
+	case pw.closed <- reason:
+	default:
+	}
+}
+
+// confirmCode shows the verification code of a session from remote on out and waits for the
+// operator to accept or reject it. The code is rejected if the client disconnects or the window
+// closes first.
+func confirmCode(out io.Writer, answers <-chan string, remote, code string, disconnected, closed <-chan struct{}) bool {
+	fmt.Fprintf(out, "\nPairing request from %s\n", remote)
+	fmt.Fprintf(out, "Verification code: %s\n", code)
+	fmt.Fprint(out, "Does onyx-admin show the same code? (y/N): ")
+
+	select {
+	case answer := <-answers:
+		return strings.TrimSpace(strings.ToLower(answer)) == "y"
+	case <-disconnected:
+		fmt.Fprintln(out, "\n[!] Client disconnected before confirmation.")
+	case <-closed:
+	}
+	return false
+}
+
+// readLines feeds console input to whichever prompt is currently waiting for it.
+// The channel is closed when input ends, which reads as an empty answer.
+func readLines(in io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
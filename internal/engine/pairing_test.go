@@ -0,0 +1,574 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+	"onyx/internal/pairing"
+)
+
+// syncBuffer collects console output written from the pairing window's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// pairingFixture is an engine's pairing state in a temp dir, with a window on a free local port.
+type pairingFixture struct {
+	ca    *Authority
+	paths PairingPaths
+	opts  PairingOptions
+	addr  string
+}
+
+func newPairingFixture(t *testing.T) *pairingFixture {
+	t.Helper()
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateAuthority(filepath.Join(dir, "auth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	opts := DefaultPairingOptions()
+	opts.BindAddr, opts.Port, opts.Window = "127.0.0.1", port, 30*time.Second
+
+	return &pairingFixture{
+		ca: ca,
+		paths: PairingPaths{
+			ClientsDir: filepath.Join(dir, "auth", "clients"),
+			CRLPath:    filepath.Join(dir, "auth", "ca.crl"),
+			AuditPath:  filepath.Join(dir, "audit.log"),
+			PairingLog: filepath.Join(dir, "pairing.log"),
+		},
+		opts: opts,
+		addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+	}
+}
+
+type pairingResult struct {
+	outcome PairingOutcome
+	err     error
+}
+
+// start runs a pairing window with the operator answering from stdin.
+func (f *pairingFixture) start(t *testing.T, token, stdin string, stdout, stderr *syncBuffer) <-chan pairingResult {
+	t.Helper()
+	done := make(chan pairingResult, 1)
+	go func() {
+		outcome, err := StartPairingMode(token, f.ca, f.opts, f.paths, strings.NewReader(stdin), stdout, stderr)
+		done <- pairingResult{outcome, err}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", f.addr); err == nil {
+			conn.Close()
+			return done
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pairing listener did not come up: %s", stdout)
+		}
+	}
+}
+
+// pairAdmin plays onyx-admin: it sends a CSR with token and returns what the engine issued.
+func pairAdmin(t *testing.T, addr, token string) (ed25519.PublicKey, []byte, []byte, string, error) {
+	t.Helper()
+	return pairInvited(t, addr, token, "")
+}
+
+// pairInvited plays onyx-admin redeeming a token with the engine CA fingerprint it was given.
+func pairInvited(t *testing.T, addr, token, caFingerprint string) (ed25519.PublicKey, []byte, []byte, string, error) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := crypto.GenerateCSR(priv, "admin@test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, caCert, code, err := crypto.PerformHandshake(addr, token, caFingerprint, csr, nil)
+	return pub, cert, caCert, code, err
+}
+
+func (f *pairingFixture) registered(t *testing.T) []api.ClientInfo {
+	t.Helper()
+	crl, err := LoadRevocationList(f.ca, f.paths.CRLPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := OpenRegistry(f.paths.ClientsDir, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := reg.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestPairingRoundTrip(t *testing.T) {
+	f := newPairingFixture(t)
+	const token = "ABCD-EFGH"
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	done := f.start(t, token, "y\n", stdout, stderr)
+
+	pub, certPEM, caPEM, code, err := pairAdmin(t, f.addr, token)
+	if err != nil {
+		t.Fatalf("pairing failed: %v\n%s", err, stdout)
+	}
+
+	res := <-done
+	if res.err != nil || res.outcome != PairingSucceeded {
+		t.Fatalf("got outcome %v, %v; want success", res.outcome, res.err)
+	}
+
+	// The operator was shown the same code as the admin
+	if !strings.Contains(stdout.String(), "Verification code: "+code) {
+		t.Errorf("console did not show the admin's code %s:\n%s", code, stdout)
+	}
+
+	// The certificate certifies the admin's key with the window's role, under the pinned CA
+	cert, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(cert.PublicKey) {
+		t.Error("issued certificate does not hold the admin's key")
+	}
+	if role := crypto.CertificateRole(cert); role != string(api.RoleOwner) {
+		t.Errorf("got role %q, want owner", role)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("issued certificate does not chain to the returned CA: %v", err)
+	}
+
+	// The admin is registered and the pairing is audited
+	list := f.registered(t)
+	if len(list) != 1 || list[0].Fingerprint != crypto.Fingerprint(cert) {
+		t.Errorf("registry holds %+v, want the issued certificate", list)
+	}
+	audit, err := OpenAuditLog(f.paths.AuditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := audit.Query(api.AuditQuery{Action: "pair"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paired := false
+	for _, entry := range report.Entries {
+		paired = paired || entry.Action == "pair"
+	}
+	if !paired {
+		t.Errorf("pairing missing from the audit log: %+v", report.Entries)
+	}
+
+	// The token was single-use
+	if _, _, _, _, err := pairAdmin(t, f.addr, token); err == nil {
+		t.Error("the window accepted a pairing after it closed")
+	}
+}
+
+func TestPairingRejectedCode(t *testing.T) {
+	f := newPairingFixture(t)
+	const token = "JKLM-NPQR"
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	done := f.start(t, token, "n\n", stdout, stderr)
+
+	_, _, _, _, err := pairAdmin(t, f.addr, token)
+	var perr *pairing.Error
+	if !errors.As(err, &perr) || perr.Code != pairing.ErrRejected {
+		t.Fatalf("got %v, want a rejected pairing", err)
+	}
+
+	if res := <-done; res.err != nil || res.outcome != PairingClosed {
+		t.Errorf("got outcome %v, %v; want closed", res.outcome, res.err)
+	}
+	if list := f.registered(t); len(list) != 0 {
+		t.Errorf("a rejected admin was registered: %+v", list)
+	}
+}
+
+func TestPairingJSONNeedsAcceptSAS(t *testing.T) {
+	f := newPairingFixture(t)
+	f.opts.JSON = true
+	if _, err := StartPairingMode("ABCD-EFGH", f.ca, f.opts, f.paths, strings.NewReader(""), &syncBuffer{}, &syncBuffer{}); err == nil {
+		t.Fatal("JSON mode opened a window without accepting verification codes")
+	}
+}
+
+func TestPairingJSONRecordsCode(t *testing.T) {
+	f := newPairingFixture(t)
+	f.opts.JSON, f.opts.AcceptSAS = true, true
+	const token = "STUV-WXYZ"
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	done := f.start(t, token, "", stdout, stderr)
+
+	_, _, _, code, err := pairAdmin(t, f.addr, token)
+	if err != nil {
+		t.Fatalf("pairing failed: %v\n%s", err, stderr)
+	}
+	if res := <-done; res.err != nil || res.outcome != PairingSucceeded {
+		t.Fatalf("got outcome %v, %v; want success", res.outcome, res.err)
+	}
+
+	// stdout holds the announcement followed by the code the admin was shown
+	dec := json.NewDecoder(strings.NewReader(stdout.String()))
+	var announcement pairingAnnouncement
+	var verification pairingVerification
+	if err := dec.Decode(&announcement); err != nil || announcement.Token != token {
+		t.Fatalf("got announcement %+v, %v", announcement, err)
+	}
+	if err := dec.Decode(&verification); err != nil || verification.VerificationCode != code {
+		t.Errorf("got verification %+v, %v; want code %s", verification, err, code)
+	}
+}
+
+// controlPlane starts an engine's control plane /pair endpoint for the fixture's state and
+// returns its address.
+func (f *pairingFixture) controlPlane(t *testing.T) (*Engine, string) {
+	t.Helper()
+	e := New(Options{})
+	e.authority.Store(f.ca)
+
+	var err error
+	if e.auditLog, err = OpenAuditLog(f.paths.AuditPath); err != nil {
+		t.Fatal(err)
+	}
+	if e.invites, err = OpenInvitations(filepath.Join(t.TempDir(), "invites.json")); err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadRevocationList(f.ca, f.paths.CRLPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.clients, err = OpenRegistry(f.paths.ClientsDir, crl); err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := f.ca.ServerCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(e.handlePair))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{serverCert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return e, srv.Listener.Addr().String()
+}
+
+// hostWindow has the engine serve a window for token whose operator accepts every code.
+func (f *pairingFixture) hostWindow(t *testing.T, e *Engine, token string) *pairingWindow {
+	t.Helper()
+	pw := &pairingWindow{
+		ca:       f.ca,
+		clients:  e.clients,
+		role:     api.RoleOperator,
+		guard:    newPairingGuard(token, 1),
+		attempts: openAttemptLog(io.Discard, f.paths.PairingLog, f.paths.AuditPath),
+		ctx:      context.Background(),
+		confirm:  func(*http.Request, string) bool { return true },
+		done:     make(chan string, 1),
+		closed:   make(chan string, 1),
+	}
+	t.Cleanup(e.pairingWindows.add(pw))
+	return pw
+}
+
+func TestControlPlanePairsWindowsAndInvitations(t *testing.T) {
+	f := newPairingFixture(t)
+	e, addr := f.controlPlane(t)
+	pw := f.hostWindow(t, e, "WIND-TOKN")
+
+	invite, err := e.invites.Create(api.RoleViewer, time.Hour, identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := pairAdmin(t, addr, "WIND-TOKN"); err != nil {
+		t.Fatalf("window token refused: %v", err)
+	}
+	select {
+	case <-pw.done:
+	default:
+		t.Error("the window was not told about its pairing")
+	}
+	if _, _, _, _, err := pairInvited(t, addr, invite.Token, crypto.Fingerprint(f.ca.ServerIssuer())); err != nil {
+		t.Fatalf("invitation refused: %v", err)
+	}
+
+	roles := map[api.Role]int{}
+	for _, c := range f.registered(t) {
+		roles[c.Role]++
+	}
+	if roles[api.RoleOperator] != 1 || roles[api.RoleViewer] != 1 {
+		t.Errorf("got roles %v, want one operator from the window and one viewer from the invitation", roles)
+	}
+}
+
+func TestControlPlaneCountsGuessesAgainstWindows(t *testing.T) {
+	f := newPairingFixture(t)
+	e, addr := f.controlPlane(t)
+	f.hostWindow(t, e, "WIND-TOKN")
+
+	for range maxFailuresPerSource {
+		if _, _, _, _, err := pairAdmin(t, addr, "GUES-SSED"); err == nil {
+			t.Fatal("a wrong token was accepted")
+		}
+	}
+
+	// The guesses locked this address out of the window, even with its real token
+	_, _, _, _, err := pairAdmin(t, addr, "WIND-TOKN")
+	var perr *pairing.Error
+	if !errors.As(err, &perr) || perr.Code != pairing.ErrLockedOut {
+		t.Errorf("got %v, want a lockout", err)
+	}
+}
+
+// localAPI serves e's API on a unix socket, as the engine does for the `onyx` CLI.
+func localAPI(t *testing.T, e *Engine) *api.Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "onyx.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: e.newAPIHandler()}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return api.NewLocalClient(socket)
+}
+
+func TestHostedPairingRoundTrip(t *testing.T) {
+	f := newPairingFixture(t)
+	e, addr := f.controlPlane(t)
+	client := localAPI(t, e)
+	const token = "HOST-TOKN"
+
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	done := make(chan pairingResult, 1)
+	go func() {
+		outcome, err := HostPairingMode(client, token, f.opts, strings.NewReader("y\n"), stdout, stderr)
+		done <- pairingResult{outcome, err}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); e.pairingWindows.find(token) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the engine did not open the window: %s%s", stdout, stderr)
+		}
+	}
+
+	_, certPEM, _, code, err := pairAdmin(t, addr, token)
+	if err != nil {
+		t.Fatalf("pairing failed: %v\n%s", err, stdout)
+	}
+	if res := <-done; res.err != nil || res.outcome != PairingSucceeded {
+		t.Fatalf("got outcome %v, %v; want success\n%s", res.outcome, res.err, stdout)
+	}
+
+	// The operator confirmed the admin's code through the local socket
+	if !strings.Contains(stdout.String(), "Verification code: "+code) {
+		t.Errorf("console did not show the admin's code %s:\n%s", code, stdout)
+	}
+	cert, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := f.registered(t); len(list) != 1 || list[0].Fingerprint != crypto.Fingerprint(cert) || list[0].Role != api.RoleOwner {
+		t.Errorf("registry holds %+v, want the issued owner certificate", list)
+	}
+
+	// The window is gone with the session that held it
+	if e.pairingWindows.find(token) != nil {
+		t.Error("the window outlived its session")
+	}
+}
+
+func TestHostedPairingIsLocalOnly(t *testing.T) {
+	e := New(Options{})
+	for _, h := range []http.HandlerFunc{e.handleOpenPairing, e.handleConfirmPairing} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/pairing", strings.NewReader("{}"))
+		req.TLS = &tls.ConnectionState{}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("a remote caller got %d, want %d", rec.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestPairingReportsPortInUse(t *testing.T) {
+	f := newPairingFixture(t)
+	ln, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	_, err = StartPairingMode("ABCD-EFGH", f.ca, f.opts, f.paths, strings.NewReader(""), &syncBuffer{}, &syncBuffer{})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("got %v, want the port reported as in use", err)
+	}
+}
+
+func TestPairingAcceptSASNeedsJSON(t *testing.T) {
+	f := newPairingFixture(t)
+	f.opts.AcceptSAS = true
+	if _, err := StartPairingMode("ABCD-EFGH", f.ca, f.opts, f.paths, strings.NewReader(""), &syncBuffer{}, &syncBuffer{}); err == nil {
+		t.Error("interactive pairing took --accept-sas")
+	}
+	if _, err := HostPairingMode(api.NewLocalClient(filepath.Join(t.TempDir(), "none.sock")), "ABCD-EFGH", f.opts, strings.NewReader(""), &syncBuffer{}, &syncBuffer{}); err == nil {
+		t.Error("interactive hosted pairing took --accept-sas")
+	}
+}
+
+// pairingSession returns a function that sends pairing rounds over one TLS session to addr.
+func pairingSession(t *testing.T, addr string) func(pairing.Request) (*pairing.Response, error) {
+	t.Helper()
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS13, InsecureSkipVerify: true},
+		MaxConnsPerHost: 1,
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	return func(req pairing.Request) (*pairing.Response, error) {
+		req.Versions = pairing.SupportedVersions
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Post("https://"+addr+pairing.Path, pairing.ContentType, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		var res pairing.Response
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return &res, nil
+	}
+}
+
+func TestPairingNeedsTheCommittedNonce(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := crypto.GenerateCSR(priv, "admin@test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := crypto.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := pairing.Request{Token: "WIND-TOKN", CSR: string(csr), Commitment: crypto.Commitment(nonce)}
+
+	tests := []struct {
+		name      string
+		first     pairing.Request
+		reveal    []byte
+		elsewhere bool // Reveal over a second TLS session
+		want      pairing.ErrorCode
+		burned    bool
+	}{
+		{"no commitment", pairing.Request{Token: "WIND-TOKN", CSR: string(csr)}, nil, false, pairing.ErrBadRequest, true},
+		{"nonce not committed to", commit, other, false, pairing.ErrBadRequest, true},
+		{"reveal from another session", commit, nonce, true, pairing.ErrBadRequest, false},
+		{"committed nonce", commit, nonce, false, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newPairingFixture(t)
+			e, addr := f.controlPlane(t)
+			pw := f.hostWindow(t, e, "WIND-TOKN")
+			send := pairingSession(t, addr)
+
+			res, err := send(tt.first)
+			if err == nil && tt.reveal != nil {
+				if res.Nonce == "" {
+					t.Fatal("the window answered the first round without its nonce")
+				}
+				reveal := send
+				if tt.elsewhere {
+					reveal = pairingSession(t, addr)
+				}
+				res, err = reveal(pairing.Request{Token: "WIND-TOKN", Nonce: hex.EncodeToString(tt.reveal)})
+			}
+
+			var perr *pairing.Error
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("pairing failed: %v", err)
+			case tt.want == "" && res.Certificate == "":
+				t.Fatal("no certificate was issued")
+			case tt.want != "" && (!errors.As(err, &perr) || perr.Code != tt.want):
+				t.Fatalf("got %v, want %s", err, tt.want)
+			}
+
+			select {
+			case <-pw.closed:
+				if !tt.burned {
+					t.Error("the window was closed")
+				}
+			default:
+				if tt.burned {
+					t.Error("the window stayed open after its token was spent")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+// DefaultCaddyfile is the data plane configuration read by an installed engine.
+const DefaultCaddyfile = "/etc/onyx/Caddyfile"
+
+// Proxy hosts the embedded Caddy data plane inside the engine process.
+// The Caddy modules themselves (standard, Coraza, OVH DNS) are linked in by the binary.
+type Proxy struct {
+	caddyfile string
+
+	mu       sync.Mutex
+	source   []byte     // Text of the Caddyfile in the active config
+	base     []byte     // The adapted Caddyfile, before managed sites are merged in
+	sites    []api.Site // Sites managed through the control plane
+	lastGood []byte     // The last config that loaded and passed the self-check
+}
+
+// NewProxy creates a data plane that is configured from the given Caddyfile.
+func NewProxy(caddyfile string) *Proxy {
+	return &Proxy{caddyfile: caddyfile}
+}
+
+// Start adapts the Caddyfile to Caddy's native JSON config, merges in the managed sites and
+// starts Caddy in-process.
+func (p *Proxy) Start(sites []api.Site) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	body, base, err := p.adapt()
+	if err != nil {
+		return err
+	}
+	cfgJSON, err := mergeSites(base, sites)
+	if err != nil {
+		return err
+	}
+
+	if err := caddy.Load(cfgJSON, true); err != nil {
+		return fmt.Errorf("failed to start proxy: %w", err)
+	}
+
+	p.source, p.base, p.sites, p.lastGood = body, base, sites, cfgJSON
+	log.Printf("Proxy started from %s", p.caddyfile)
+	return nil
+}
+
+// Reload re-reads the Caddyfile and swaps it in without dropping connections.
+// If the new config fails to load or the self-check fails, the last good config is restored.
+// The source describes what triggered the reload and is only used for logging.
+func (p *Proxy) Reload(source string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := time.Now()
+	err := p.reload()
+	if err != nil {
+		log.Printf("Reload (%s) failed after %s: %v", source, time.Since(start).Round(time.Millisecond), err)
+		return err
+	}
+
+	log.Printf("Reload (%s) succeeded in %s", source, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Restore swaps in a Caddyfile and set of managed sites from the config history, through the
+// same validate-then-swap path as a reload. The Caddyfile on disk is left to the caller.
+func (p *Proxy) Restore(caddyfile []byte, sites []api.Site) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	base, err := p.adaptSource(caddyfile)
+	if err != nil {
+		return err
+	}
+	return p.swap(caddyfile, base, sites)
+}
+
+// Applied returns the Caddyfile text and managed sites of the active config.
+func (p *Proxy) Applied() ([]byte, []api.Site) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.source, p.sites
+}
+
+func (p *Proxy) reload() error {
+	// 1. Validate and adapt before touching the running instance
+	body, base, err := p.adapt()
+	if err != nil {
+		return err
+	}
+	return p.swap(body, base, p.sites)
+}
+
+// swap loads the adapted Caddyfile base merged with sites, self-checks the result and restores
+// the last good config if it fails. Callers must hold p.mu.
+func (p *Proxy) swap(body, base []byte, sites []api.Site) error {
+	cfgJSON, err := mergeSites(base, sites)
+	if err != nil {
+		return err
+	}
+
+	// 2. Swap the config in. Caddy keeps serving the old config if this fails.
+	if err := caddy.Load(cfgJSON, false); err != nil {
+		return fmt.Errorf("new config rejected: %w", err)
+	}
+
+	// 3. Self-check the result and roll back if the listeners did not come up
+	if err := selfCheck(cfgJSON); err != nil {
+		if rbErr := caddy.Load(p.lastGood, true); rbErr != nil {
+			return fmt.Errorf("self-check failed (%v) and rollback failed: %w", err, rbErr)
+		}
+		return fmt.Errorf("self-check failed, rolled back to last good config: %w", err)
+	}
+
+	p.source, p.base, p.sites, p.lastGood = body, base, sites, cfgJSON
+	return nil
+}
+
+// ApplySites replaces the managed sites in the running config through Caddy's admin API,
+// leaving the Caddyfile part untouched. Like a reload, the result is self-checked and the
+// last good config is restored if it fails.
+func (p *Proxy) ApplySites(sites []api.Site) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastGood == nil {
+		return fmt.Errorf("proxy is not running")
+	}
+
+	cfgJSON, err := mergeSites(p.base, sites)
+	if err != nil {
+		return err
+	}
+
+	admin, err := newCaddyAdmin(p.lastGood)
+	if err != nil {
+		return err
+	}
+	if err := admin.Load(cfgJSON); err != nil {
+		return fmt.Errorf("new config rejected: %w", err)
+	}
+
+	if err := selfCheck(cfgJSON); err != nil {
+		if rbErr := caddy.Load(p.lastGood, true); rbErr != nil {
+			return fmt.Errorf("self-check failed (%v) and rollback failed: %w", err, rbErr)
+		}
+		return fmt.Errorf("self-check failed, rolled back to last good config: %w", err)
+	}
+
+	p.sites, p.lastGood = sites, cfgJSON
+	return nil
+}
+
+// CaddyfileHosts returns the hostnames served by site blocks in the Caddyfile.
+func (p *Proxy) CaddyfileHosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return configuredHosts(p.base)
+}
+
+// Stop gracefully shuts down the running Caddy instance.
+func (p *Proxy) Stop() error {
+	return caddy.Stop()
+}
+
+// adapt reads the Caddyfile from disk and converts it to JSON.
+func (p *Proxy) adapt() (body, cfgJSON []byte, err error) {
+	body, err = os.ReadFile(p.caddyfile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	cfgJSON, err = p.adaptSource(body)
+	return body, cfgJSON, err
+}
+
+// adaptSource converts Caddyfile text to JSON, logging any adapter warnings.
+func (p *Proxy) adaptSource(body []byte) ([]byte, error) {
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	if adapter == nil {
+		return nil, fmt.Errorf("caddyfile adapter is not registered")
+	}
+
+	cfgJSON, warnings, err := adapter.Adapt(body, map[string]any{"filename": p.caddyfile})
+	if err != nil {
+		return nil, fmt.Errorf("failed to adapt %s: %w", p.caddyfile, err)
+	}
+
+	for _, w := range warnings {
+		log.Printf("Config warning: %s", w.String())
+	}
+
+	return cfgJSON, nil
+}
+
+// Healthy re-runs the self-check against the currently active config.
+func (p *Proxy) Healthy() error {
+	p.mu.Lock()
+	cfgJSON := p.lastGood
+	p.mu.Unlock()
+
+	if cfgJSON == nil {
+		return fmt.Errorf("proxy is not running")
+	}
+	return selfCheck(cfgJSON)
+}
+
+// Summary returns a one-line description of the active config for status output.
+func (p *Proxy) Summary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers, err := httpServers(p.lastGood)
+	if err != nil || len(servers) == 0 {
+		return "proxy idle"
+	}
+
+	var addrs []string
+	for _, listen := range servers {
+		addrs = append(addrs, listen...)
+	}
+	slices.Sort(addrs)
+	return fmt.Sprintf("%d server(s) on %s", len(servers), strings.Join(slices.Compact(addrs), ", "))
+}
+
+// httpServers extracts the listen addresses of every server in the HTTP app, keyed by server name.
+func httpServers(cfgJSON []byte) (map[string][]string, error) {
+	var cfg struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]struct {
+					Listen []string `json:"listen"`
+				} `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to inspect config: %w", err)
+	}
+
+	servers := make(map[string][]string)
+	for name, srv := range cfg.Apps.HTTP.Servers {
+		servers[name] = srv.Listen
+	}
+	return servers, nil
+}
+
+// selfCheck verifies that every TCP listener declared by the HTTP app accepts connections.
+func selfCheck(cfgJSON []byte) error {
+	servers, err := httpServers(cfgJSON)
+	if err != nil {
+		return err
+	}
+
+	for name, listen := range servers {
+		for _, l := range listen {
+			addr, err := caddy.ParseNetworkAddress(l)
+			if err != nil {
+				return fmt.Errorf("server %s: %w", name, err)
+			}
+			if addr.Network != "tcp" && addr.Network != "tcp4" && addr.Network != "tcp6" {
+				continue
+			}
+
+			target := addr.JoinHostPort(0)
+			if err := dialListener(addr.Network, target); err != nil {
+				return fmt.Errorf("server %s is not accepting connections on %s: %w", name, target, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// selfCheckAttempts is how often the self-check dials a listener before giving up. Caddy hands
+// its sockets over to the new config with SO_REUSEPORT, and a connection queued on an old
+// socket as it closes is reset even though the new one is listening.
+const selfCheckAttempts = 3
+
+// dialListener connects to a listener and hangs up, retrying briefly after a failure.
+func dialListener(network, target string) error {
+	var err error
+	for attempt := range selfCheckAttempts {
+		if attempt > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, target, 2*time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,556 @@
+package engine
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+)
+
+// lastUsedInterval throttles how often a client's last-use time is written to disk.
+const lastUsedInterval = time.Minute
+
+// ErrUnknownClient is returned when no registered client matches a fingerprint.
+var ErrUnknownClient = errors.New("no such client")
+
+// clientRecord is the on-disk form of a paired client, stored as <fingerprint>.json.
+type clientRecord struct {
+	api.ClientInfo
+	Certificate string `json:"certificate"`
+
+	savedLastUsed time.Time
+}
+
+// Registry tracks every admin client paired with the engine, keyed by certificate fingerprint.
+// Both the engine and `onyx --pair` write to the same directory, so lookups that miss the
+// in-memory view re-read it from disk.
+type Registry struct {
+	dir string
+	crl *RevocationList
+
+	mu      sync.Mutex
+	clients map[string]*clientRecord
+}
+
+// OpenRegistry loads the client registry from dir, converting certificates saved by older
+// versions as <CommonName>.crt into fingerprint-keyed records. Revocations are published to crl.
+func OpenRegistry(dir string, crl *RevocationList) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create client registry: %w", err)
+	}
+	chownToEngine(dir)
+
+	r := &Registry{dir: dir, crl: crl, clients: make(map[string]*clientRecord)}
+	if err := r.migrateLegacy(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	// Clients revoked before the engine kept a CRL must still be on it
+	for _, rec := range r.clients {
+		if rec.Revoked {
+			if err := r.publishRevocation(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// OpenClients opens the installed engine's client registry together with its CRL.
+func OpenClients(ca *Authority) (*Registry, *RevocationList, error) {
+	crl, err := LoadRevocationList(ca, CRLPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clients, err := OpenRegistry(ClientsDir, crl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clients, crl, nil
+}
+
+// Add records a newly issued client certificate. The display name defaults to its CommonName.
+// invitedBy is the fingerprint of the admin whose invitation was redeemed, if any.
+func (r *Registry) Add(certPEM []byte, invitedBy string) (*api.ClientInfo, error) {
+	rec, err := newClientRecord(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	rec.InvitedBy = invitedBy
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.save(rec); err != nil {
+		return nil, err
+	}
+	r.clients[rec.Fingerprint] = rec
+
+	info := rec.ClientInfo
+	return &info, nil
+}
+
+// Renew records certPEM as the replacement of the client with fingerprint oldFP. The new
+// record keeps the old one's name. The old certificate stays valid until the new one is first
+// used, so a renewal whose response never reached the client can simply be retried.
+func (r *Registry) Renew(oldFP string, certPEM []byte) (*api.ClientInfo, error) {
+	rec, err := newClientRecord(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, ok := r.clients[oldFP]
+	if !ok || old.Revoked {
+		return nil, fmt.Errorf("client %s cannot be renewed", oldFP[:16])
+	}
+
+	// A replacement from an earlier attempt that was never used is superseded by this one
+	if prev, ok := r.clients[old.ReplacedBy]; ok && !prev.Revoked && prev.LastUsed.IsZero() {
+		if err := r.retire(prev); err != nil {
+			return nil, err
+		}
+	}
+
+	rec.Name = old.Name
+	rec.InvitedBy = old.InvitedBy
+	rec.RenewedFrom = old.Fingerprint
+	if err := r.save(rec); err != nil {
+		return nil, err
+	}
+	r.clients[rec.Fingerprint] = rec
+
+	old.ReplacedBy = rec.Fingerprint
+	if err := r.save(old); err != nil {
+		return nil, err
+	}
+
+	info := rec.ClientInfo
+	return &info, nil
+}
+
+// newClientRecord builds the registry record for a freshly issued certificate.
+func newClientRecord(certPEM []byte) (*clientRecord, error) {
+	cert, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientRecord{
+		ClientInfo: api.ClientInfo{
+			Fingerprint: crypto.Fingerprint(cert),
+			Name:        cert.Subject.CommonName,
+			CommonName:  cert.Subject.CommonName,
+			Role:        certificateRole(cert),
+			Serial:      cert.SerialNumber.Text(16),
+			IssuedAt:    cert.NotBefore,
+			ExpiresAt:   cert.NotAfter,
+		},
+		Certificate: string(certPEM),
+	}, nil
+}
+
+// certificateRole reads the role bound into a client certificate. Consoles paired before roles
+// existed had full access, and keep it until they are re-paired. Anything unrecognised gets the least.
+func certificateRole(cert *x509.Certificate) api.Role {
+	name := crypto.CertificateRole(cert)
+	if name == "" {
+		return api.RoleOwner
+	}
+
+	role, err := api.ParseRole(name)
+	if err != nil {
+		return api.RoleViewer
+	}
+	return role
+}
+
+// Authorize checks that a presented certificate belongs to a registered, unrevoked client
+// and records the time of use.
+func (r *Registry) Authorize(cert *x509.Certificate) (*api.ClientInfo, error) {
+	fp := crypto.Fingerprint(cert)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.clients[fp]
+	if !ok {
+		// The client may have been paired by `onyx --pair` since we last looked
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		if rec, ok = r.clients[fp]; !ok {
+			return nil, fmt.Errorf("client %s is not registered with this engine", fp[:16])
+		}
+	}
+
+	if rec.Revoked {
+		return nil, fmt.Errorf("client %s (%s) has been revoked", rec.Name, fp[:16])
+	}
+
+	// First use of a renewed certificate proves the client has it, so the old one can go
+	if old, ok := r.clients[rec.RenewedFrom]; ok && !old.Revoked {
+		if err := r.retire(old); err != nil {
+			log.Printf("Failed to retire renewed certificate of client %s: %v", old.Name, err)
+		}
+	}
+
+	rec.LastUsed = time.Now().UTC()
+	if rec.LastUsed.Sub(rec.savedLastUsed) > lastUsedInterval {
+		if err := r.save(rec); err != nil {
+			log.Printf("Failed to record last use of client %s: %v", rec.Name, err)
+		}
+	}
+
+	info := rec.ClientInfo
+	return &info, nil
+}
+
+// List returns every known client, including revoked ones, ordered by issue date.
+func (r *Registry) List() ([]api.ClientInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	list := make([]api.ClientInfo, 0, len(r.clients))
+	for _, rec := range r.clients {
+		list = append(list, rec.ClientInfo)
+	}
+	slices.SortFunc(list, func(a, b api.ClientInfo) int { return a.IssuedAt.Compare(b.IssuedAt) })
+	return list, nil
+}
+
+// CountIssuedBy returns how many active clients still hold a certificate issued by ca.
+func (r *Registry) CountIssuedBy(ca *x509.Certificate) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, rec := range r.clients {
+		if rec.Status() != "active" {
+			continue
+		}
+		cert, err := crypto.ParseCertificate([]byte(rec.Certificate))
+		if err == nil && cert.CheckSignatureFrom(ca) == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Get returns a single client by fingerprint or unique fingerprint prefix.
+func (r *Registry) Get(ref string) (*api.ClientInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	rec, err := r.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	info := rec.ClientInfo
+	return &info, nil
+}
+
+// Ancestry returns the fingerprint of the first certificate in fp's renewal lineage, which
+// identifies the same console across renewals, followed by the same for each admin whose
+// invitation brought the previous one in, nearest first. The chain ends at a console paired on
+// the engine host.
+func (r *Registry) Ancestry(fp string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	rec, err := r.resolve(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []string
+	seen := make(map[string]bool)
+	for rec != nil && !seen[rec.Fingerprint] {
+		for seen[rec.Fingerprint] = true; rec.RenewedFrom != ""; {
+			prev, ok := r.clients[rec.RenewedFrom]
+			if !ok || seen[prev.Fingerprint] {
+				break
+			}
+			seen[prev.Fingerprint] = true
+			rec = prev
+		}
+		chain = append(chain, rec.Fingerprint)
+		rec = r.clients[rec.InvitedBy]
+	}
+	return chain, nil
+}
+
+// Rename changes the display name of a client.
+func (r *Registry) Rename(ref, name string) (*api.ClientInfo, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("name must not be empty")
+	}
+
+	return r.update(ref, func(rec *clientRecord) error {
+		rec.Name = name
+		return nil
+	})
+}
+
+// Revoke marks a client as revoked and adds its certificate to the CRL, which the control plane
+// consults on every handshake. The record is kept so the history stays inspectable.
+func (r *Registry) Revoke(ref string) (*api.ClientInfo, error) {
+	return r.update(ref, func(rec *clientRecord) error {
+		if rec.Revoked {
+			return fmt.Errorf("client %s is already revoked", rec.Name)
+		}
+		if err := r.publishRevocation(rec); err != nil {
+			return err
+		}
+		rec.Revoked = true
+		rec.RevokedAt = time.Now().UTC()
+
+		// Neither half of a pending renewal may outlive the other
+		for _, fp := range []string{rec.RenewedFrom, rec.ReplacedBy} {
+			if other, ok := r.clients[fp]; ok && !other.Revoked {
+				if err := r.retire(other); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// RevokeAll revokes every client that still has access, as after a suspected compromise, and
+// returns them. Pairing again from the engine host restores access.
+func (r *Registry) RevokeAll() ([]api.ClientInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	var revoked []api.ClientInfo
+	for _, rec := range r.clients {
+		if rec.Revoked {
+			continue
+		}
+		if err := r.retire(rec); err != nil {
+			return revoked, err
+		}
+		revoked = append(revoked, rec.ClientInfo)
+	}
+	slices.SortFunc(revoked, func(a, b api.ClientInfo) int { return a.IssuedAt.Compare(b.IssuedAt) })
+	return revoked, nil
+}
+
+// retire revokes a certificate that has been replaced. Callers must hold r.mu.
+func (r *Registry) retire(rec *clientRecord) error {
+	if err := r.publishRevocation(rec); err != nil {
+		return err
+	}
+	rec.Revoked = true
+	rec.RevokedAt = time.Now().UTC()
+	return r.save(rec)
+}
+
+// publishRevocation puts a client's certificate on the CRL.
+func (r *Registry) publishRevocation(rec *clientRecord) error {
+	cert, err := crypto.ParseCertificate([]byte(rec.Certificate))
+	if err != nil {
+		return fmt.Errorf("client %s has no usable certificate on record: %w", rec.Name, err)
+	}
+	return r.crl.Revoke(cert.SerialNumber)
+}
+
+// update applies fn to a client and persists the result.
+func (r *Registry) update(ref string, fn func(*clientRecord) error) (*api.ClientInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	rec, err := r.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fn(rec); err != nil {
+		return nil, err
+	}
+	if err := r.save(rec); err != nil {
+		return nil, err
+	}
+
+	info := rec.ClientInfo
+	return &info, nil
+}
+
+// resolve finds a client by full fingerprint or by a prefix that matches exactly one client.
+func (r *Registry) resolve(ref string) (*clientRecord, error) {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if len(ref) < 6 {
+		return nil, fmt.Errorf("fingerprint %q is too short; give at least 6 characters", ref)
+	}
+
+	if rec, ok := r.clients[ref]; ok {
+		return rec, nil
+	}
+
+	var match *clientRecord
+	for fp, rec := range r.clients {
+		if strings.HasPrefix(fp, ref) {
+			if match != nil {
+				return nil, fmt.Errorf("fingerprint %q is ambiguous", ref)
+			}
+			match = rec
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%w with fingerprint %q", ErrUnknownClient, ref)
+	}
+	return match, nil
+}
+
+// load merges the records on disk into memory. In-memory last-use times are kept if newer.
+// Callers must hold r.mu.
+func (r *Registry) load() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read client registry: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(r.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read client record: %w", err)
+		}
+
+		var rec clientRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("Skipping unreadable client record %s: %v", entry.Name(), err)
+			continue
+		}
+		rec.savedLastUsed = rec.LastUsed
+
+		if existing, ok := r.clients[rec.Fingerprint]; ok && existing.LastUsed.After(rec.LastUsed) {
+			rec.LastUsed = existing.LastUsed
+			rec.savedLastUsed = existing.savedLastUsed
+		}
+		r.clients[rec.Fingerprint] = &rec
+	}
+
+	return nil
+}
+
+// save writes a record atomically. Callers must hold r.mu.
+func (r *Registry) save(rec *clientRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, rec.Fingerprint+".json")
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save client record: %w", err)
+	}
+
+	rec.savedLastUsed = rec.LastUsed
+	return nil
+}
+
+// migrateLegacy converts <CommonName>.crt files written by older pairing code into records.
+func (r *Registry) migrateLegacy() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read client registry: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".crt" {
+			continue
+		}
+
+		path := filepath.Join(r.dir, entry.Name())
+		certPEM, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		info, err := r.Add(certPEM, "")
+		if err != nil {
+			log.Printf("Skipping legacy client certificate %s: %v", entry.Name(), err)
+			continue
+		}
+
+		os.Remove(path)
+		log.Printf("Migrated legacy client %s to fingerprint %s", info.Name, info.Fingerprint[:16])
+	}
+
+	return nil
+}
+
+// writeFileAtomic replaces path with data via a temporary file, so readers never see a partial write.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return chownToEngine(path)
+}
@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+)
+
+// handshake builds the connection state of a console presenting certPEM, as verified against ca.
+func handshake(t *testing.T, ca *Authority, certPEM []byte) tls.ConnectionState {
+	t.Helper()
+	cert, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert, ca.Cert}},
+	}
+}
+
+// writeCRL puts an empty revocation list with the given number and lifetime at path.
+func writeCRL(t *testing.T, ca *Authority, path string, number int64, nextUpdate time.Time) {
+	t.Helper()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+	}, ca.Cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte // Returns the certificate presented
+		denied  string                                                                  // Part of the error, or "" to accept
+	}{
+		{
+			name: "registered",
+			prepare: func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte {
+				cert := issueClient(t, ca, "alice", api.RoleOperator)
+				if _, err := reg.Add(cert, ""); err != nil {
+					t.Fatal(err)
+				}
+				return cert
+			},
+		},
+		{
+			name: "revoked",
+			prepare: func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte {
+				cert := issueClient(t, ca, "alice", api.RoleOperator)
+				info, err := reg.Add(cert, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := reg.Revoke(info.Fingerprint); err != nil {
+					t.Fatal(err)
+				}
+				return cert
+			},
+			denied: "has been revoked",
+		},
+		{
+			name: "unknown fingerprint",
+			prepare: func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte {
+				return issueClient(t, ca, "mallory", api.RoleOwner)
+			},
+			denied: "is not registered",
+		},
+		{
+			name: "CRL replaced by an older one",
+			prepare: func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte {
+				revoked := issueClient(t, ca, "alice", api.RoleOperator)
+				info, err := reg.Add(revoked, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := reg.Revoke(info.Fingerprint); err != nil {
+					t.Fatal(err)
+				}
+				writeCRL(t, ca, crlPath, 0, ca.Cert.NotAfter)
+				return revoked
+			},
+			denied: "revocation status unavailable",
+		},
+		{
+			name: "CRL deleted",
+			prepare: func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte {
+				cert := issueClient(t, ca, "alice", api.RoleOperator)
+				info, err := reg.Add(cert, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := reg.Revoke(info.Fingerprint); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(crlPath); err != nil {
+					t.Fatal(err)
+				}
+				return cert
+			},
+			denied: "revocation status unavailable",
+		},
+		{
+			name: "CRL expired",
+			prepare: func(t *testing.T, ca *Authority, reg *Registry, crlPath string) []byte {
+				cert := issueClient(t, ca, "alice", api.RoleOperator)
+				if _, err := reg.Add(cert, ""); err != nil {
+					t.Fatal(err)
+				}
+				writeCRL(t, ca, crlPath, 1, time.Now().Add(-time.Hour))
+				return cert
+			},
+			denied: "revocation status unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca, err := LoadOrCreateAuthority(filepath.Join(dir, "auth"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			crlPath := filepath.Join(dir, "auth", "ca.crl")
+			e := New(Options{})
+			if e.revocations, err = LoadRevocationList(ca, crlPath); err != nil {
+				t.Fatal(err)
+			}
+			if e.clients, err = OpenRegistry(filepath.Join(dir, "auth", "clients"), e.revocations); err != nil {
+				t.Fatal(err)
+			}
+			if e.auditLog, err = OpenAuditLog(filepath.Join(dir, "audit.log")); err != nil {
+				t.Fatal(err)
+			}
+
+			err = e.verifyClient("192.0.2.1")(handshake(t, ca, tt.prepare(t, ca, e.clients, crlPath)))
+			switch {
+			case tt.denied == "" && err != nil:
+				t.Fatalf("handshake refused: %v", err)
+			case tt.denied != "" && (err == nil || !strings.Contains(err.Error(), tt.denied)):
+				t.Fatalf("got %v, want an error containing %q", err, tt.denied)
+			}
+
+			// Every attempt is audited, denials with their reason
+			report, err := e.auditLog.Query(api.AuditQuery{Action: "login"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(report.Entries); n != 1 {
+				t.Fatalf("got %d login entries, want 1", n)
+			}
+			if denied := report.Entries[0].Result == api.AuditDenied; denied != (tt.denied != "") {
+				t.Errorf("audited as %s", report.Entries[0].Result)
+			}
+		})
+	}
+}
+
+func TestRenewalRetiresOldCertificate(t *testing.T) {
+	ca, reg := newTestRegistry(t)
+	oldCert := issueClient(t, ca, "alice", api.RoleOperator)
+	old, err := reg.Add(oldCert, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A renewal whose response was lost is retried; the unused first replacement is superseded
+	lost, err := reg.Renew(old.Fingerprint, issueClient(t, ca, "alice", api.RoleOperator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert := issueClient(t, ca, "alice", api.RoleOperator)
+	renewed, err := reg.Renew(old.Fingerprint, newCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Name != old.Name || renewed.RenewedFrom != old.Fingerprint {
+		t.Errorf("renewed record %+v does not continue %s", renewed, old.Fingerprint)
+	}
+	if info, err := reg.Get(lost.Fingerprint); err != nil || !info.Revoked {
+		t.Errorf("the superseded replacement is still active: %+v, %v", info, err)
+	}
+
+	// Until the new certificate is used, the old one keeps working
+	authorize := func(certPEM []byte) error {
+		cert, err := crypto.ParseCertificate(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reg.crl.VerifyPeerCertificate(nil, [][]*x509.Certificate{{cert}}); err != nil {
+			return err
+		}
+		_, err = reg.Authorize(cert)
+		return err
+	}
+	if err := authorize(oldCert); err != nil {
+		t.Fatalf("old certificate refused before the renewal was used: %v", err)
+	}
+	if err := authorize(newCert); err != nil {
+		t.Fatalf("renewed certificate refused: %v", err)
+	}
+	if err := authorize(oldCert); err == nil {
+		t.Error("old certificate still accepted after the renewed one was used")
+	}
+	if info, err := reg.Get(old.Fingerprint); err != nil || !info.Revoked {
+		t.Errorf("old record not retired: %+v, %v", info, err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ca, reg := newTestRegistry(t)
+	add := func(name string) *api.ClientInfo {
+		info, err := reg.Add(issueClient(t, ca, name, api.RoleOperator), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	revoked := func(fp string) bool {
+		info, err := reg.Get(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial, _ := new(big.Int).SetString(info.Serial, 16)
+		onCRL, err := reg.crl.IsRevoked(serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if onCRL != info.Revoked {
+			t.Errorf("client %s: record says revoked=%v, CRL says %v", info.Name, info.Revoked, onCRL)
+		}
+		return info.Revoked
+	}
+
+	alice, bob, carol := add("alice"), add("bob"), add("carol")
+	renewed, err := reg.Renew(carol.Fingerprint, issueClient(t, ca, "carol", api.RoleOperator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By unique prefix; a second revocation is refused
+	if _, err := reg.Revoke(alice.Fingerprint[:12]); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked(alice.Fingerprint) || revoked(bob.Fingerprint) {
+		t.Error("revoking alice did not revoke exactly alice")
+	}
+	if _, err := reg.Revoke(alice.Fingerprint); err == nil {
+		t.Error("revoking alice twice succeeded")
+	}
+
+	// Neither half of a pending renewal outlives the other
+	if _, err := reg.Revoke(carol.Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked(renewed.Fingerprint) {
+		t.Error("the pending renewal of a revoked client is still active")
+	}
+
+	all, err := reg.RevokeAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Fingerprint != bob.Fingerprint {
+		t.Errorf("RevokeAll returned %+v, want only bob", all)
+	}
+	if !revoked(bob.Fingerprint) {
+		t.Error("bob survived RevokeAll")
+	}
+}
+
+func TestMigrateLegacyClients(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateAuthority(filepath.Join(dir, "auth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadRevocationList(ca, filepath.Join(dir, "auth", "ca.crl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientsDir := filepath.Join(dir, "auth", "clients")
+	if err := os.MkdirAll(clientsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older pairing code saved certificates as <CommonName>.crt
+	certPEM := issueClient(t, ca, "admin@laptop", api.RoleOwner)
+	if err := os.WriteFile(filepath.Join(clientsDir, "admin@laptop.crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(clientsDir, "broken.crt"), []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := OpenRegistry(clientsDir, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := reg.Authorize(cert)
+	if err != nil {
+		t.Fatalf("migrated client refused: %v", err)
+	}
+	if info.Name != "admin@laptop" || info.Role != api.RoleOwner {
+		t.Errorf("migrated as %+v", info)
+	}
+	if _, err := os.Stat(filepath.Join(clientsDir, info.Fingerprint+".json")); err != nil {
+		t.Errorf("no fingerprint-named record: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(clientsDir, "admin@laptop.crt")); !os.IsNotExist(err) {
+		t.Error("the legacy file was left behind")
+	}
+	if _, err := os.Stat(filepath.Join(clientsDir, "broken.crt")); err != nil {
+		t.Error("an unreadable legacy file was removed instead of skipped")
+	}
+}
@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"onyx/internal/crypto"
+)
+
+// CRLPath is where the engine keeps the signed revocation list for its CA.
+const CRLPath = AuthDir + "/ca.crl"
+
+// RevocationList is the engine CA's signed list of withdrawn client certificates.
+// Changes written by another process (such as `onyx clients revoke` while the engine is
+// stopped) are picked up on the next check, so revocation never needs a restart.
+type RevocationList struct {
+	path string
+	ca   *Authority
+
+	mu      sync.Mutex
+	crl     *x509.RevocationList
+	revoked map[string]bool // Serial numbers in hex
+	modTime time.Time
+}
+
+// LoadRevocationList reads the CRL at path. A missing file is treated as an empty list.
+func LoadRevocationList(ca *Authority, path string) (*RevocationList, error) {
+	l := &RevocationList{path: path, ca: ca, revoked: make(map[string]bool)}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.refresh(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Revoke adds a certificate serial to the list and publishes a newly signed CRL.
+func (l *RevocationList) Revoke(serial *big.Int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.refresh(); err != nil {
+		return err
+	}
+	if l.revoked[serial.Text(16)] {
+		return nil
+	}
+
+	number := big.NewInt(1)
+	var entries []x509.RevocationListEntry
+	if l.crl != nil {
+		number.Add(l.crl.Number, number)
+		entries = slices.Clone(l.crl.RevokedCertificateEntries)
+	}
+	entries = append(entries, x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: time.Now().UTC(),
+	})
+
+	crlPEM, err := l.ca.SignCRL(number, entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.path, crlPEM, 0644); err != nil {
+		return fmt.Errorf("failed to save revocation list: %w", err)
+	}
+
+	// Force the next check to re-read what was just written
+	l.modTime = time.Time{}
+	return l.refresh()
+}
+
+// SetAuthority switches the list to a rotated or retired authority and re-signs it with the
+// current CA if it is not already, keeping every entry.
+func (l *RevocationList) SetAuthority(ca *Authority) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ca, l.modTime = ca, time.Time{}
+	if err := l.refresh(); err != nil {
+		return err
+	}
+	if l.crl == nil || l.crl.CheckSignatureFrom(ca.Cert) == nil {
+		return nil
+	}
+
+	number := new(big.Int).Add(l.crl.Number, big.NewInt(1))
+	crlPEM, err := ca.SignCRL(number, l.crl.RevokedCertificateEntries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.path, crlPEM, 0644); err != nil {
+		return fmt.Errorf("failed to save revocation list: %w", err)
+	}
+
+	l.modTime = time.Time{}
+	return l.refresh()
+}
+
+// IsRevoked reports whether the certificate with the given serial has been revoked.
+func (l *RevocationList) IsRevoked(serial *big.Int) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.refresh(); err != nil {
+		return false, err
+	}
+	return l.revoked[serial.Text(16)], nil
+}
+
+// VerifyPeerCertificate rejects client certificates on the CRL. It is meant for tls.Config and
+// runs after the chain has been verified against the engine CA.
+func (l *RevocationList) VerifyPeerCertificate(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return fmt.Errorf("client certificate required")
+	}
+	leaf := chains[0][0]
+
+	revoked, err := l.IsRevoked(leaf.SerialNumber)
+	if err != nil {
+		// Fail closed: an unreadable list must not let revoked clients back in
+		log.Printf("Revocation check failed: %v", err)
+		return fmt.Errorf("revocation status unavailable")
+	}
+	if revoked {
+		return fmt.Errorf("client certificate %s has been revoked", crypto.Fingerprint(leaf)[:16])
+	}
+	return nil
+}
+
+// refresh re-reads the CRL if the file changed since it was last loaded. A list that went
+// missing, was replaced by an older one or has expired is an error, never an empty list, so
+// checks fail closed until the file is put right. Callers must hold l.mu.
+func (l *RevocationList) refresh() error {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if l.crl != nil {
+			return fmt.Errorf("revocation list %s has disappeared", l.path)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	if info.ModTime().Equal(l.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read revocation list: %w", err)
+	}
+
+	// Until a rotation re-signs it, the list may still carry the previous CA's signature
+	crl, err := crypto.ParseCRL(data, l.ca.Cert)
+	if err != nil && l.ca.Previous != nil {
+		crl, err = crypto.ParseCRL(data, l.ca.Previous.Cert)
+	}
+	if err != nil {
+		return err
+	}
+	if l.crl != nil && crl.Number.Cmp(l.crl.Number) < 0 {
+		return fmt.Errorf("revocation list %s is number %s, older than number %s already loaded", l.path, crl.Number, l.crl.Number)
+	}
+	if time.Now().After(crl.NextUpdate) {
+		return fmt.Errorf("revocation list %s expired at %s", l.path, crl.NextUpdate.Format(time.RFC3339))
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.Text(16)] = true
+	}
+
+	l.crl, l.revoked, l.modTime = crl, revoked, info.ModTime()
+	return nil
+}
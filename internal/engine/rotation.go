@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"onyx/internal/api"
+	"onyx/internal/crypto"
+	"onyx/internal/systemd"
+)
+
+// retirementCheckInterval is how often the engine looks for a rotation whose overlap has ended.
+const retirementCheckInterval = time.Minute
+
+// DefaultRotationOverlap is how long the previous CA stays trusted after a rotation by default.
+const DefaultRotationOverlap = 30 * 24 * time.Hour
+
+// RotateCA replaces the engine CA and starts trusting the new one immediately, alongside the
+// previous one until the overlap ends.
+func (e *Engine) RotateCA(overlap time.Duration) (*Authority, error) {
+	e.rotateMu.Lock()
+	defer e.rotateMu.Unlock()
+
+	ca, err := RotateAuthority(AuthDir, overlap)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.installAuthority(ca); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// installAuthority makes ca the authority used for new handshakes, signatures and the CRL.
+func (e *Engine) installAuthority(ca *Authority) error {
+	if err := e.revocations.SetAuthority(ca); err != nil {
+		return fmt.Errorf("failed to re-sign revocation list: %w", err)
+	}
+	e.authority.Store(ca)
+	systemd.Status(e.statusLine())
+	return nil
+}
+
+// startRetirementCheck retires the previous CA once its overlap period has ended.
+func (e *Engine) startRetirementCheck() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(retirementCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := e.retireIfDue(); err != nil {
+					log.Printf("CA retirement failed, will retry: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// retireIfDue reloads the authority from disk once the rotation's overlap has ended,
+// which retires the previous CA.
+func (e *Engine) retireIfDue() error {
+	e.rotateMu.Lock()
+	defer e.rotateMu.Unlock()
+
+	current := e.ca()
+	if current.Rotation == nil || time.Now().Before(current.Rotation.RetiresAt) {
+		return nil
+	}
+
+	ca, err := LoadOrCreateAuthority(AuthDir)
+	if err == nil {
+		err = e.installAuthority(ca)
+	}
+
+	entry := api.AuditEntry{Actor: "engine", Action: "ca.retire", Target: crypto.Fingerprint(current.Previous.Cert)}
+	if err != nil {
+		entry.Result, entry.Detail = api.AuditFailed, err.Error()
+	}
+	e.auditLog.Record(entry)
+	return err
+}
+
+// DescribeAuthority summarises ca for status output, counting the clients in the registry
+// that still depend on the previous CA.
+func DescribeAuthority(ca *Authority, clients *Registry) (api.CAStatus, error) {
+	status := api.CAStatus{
+		Fingerprint: crypto.Fingerprint(ca.Cert),
+		KeyID:       hex.EncodeToString(ca.Cert.SubjectKeyId),
+		ExpiresAt:   ca.Cert.NotAfter,
+	}
+	if ca.Previous == nil {
+		return status, nil
+	}
+
+	count, err := clients.CountIssuedBy(ca.Previous.Cert)
+	if err != nil {
+		return status, err
+	}
+	status.Rotation = &api.CARotation{
+		PreviousFingerprint: crypto.Fingerprint(ca.Previous.Cert),
+		StartedAt:           ca.Rotation.StartedAt,
+		RetiresAt:           ca.Rotation.RetiresAt,
+		ClientsOnPrevious:   count,
+	}
+	return status, nil
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"onyx/internal/crypto"
+)
+
+// sessionTracker remembers which control-plane connections belong to which client,
+// so every open session of a revoked client can be cut off at once.
+type sessionTracker struct {
+	mu    sync.Mutex
+	conns map[string]map[net.Conn]struct{} // Keyed by client certificate fingerprint
+	owner map[net.Conn]string
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{
+		conns: make(map[string]map[net.Conn]struct{}),
+		owner: make(map[net.Conn]string),
+	}
+}
+
+// Listener wraps the raw listener under the control plane's TLS, so the tracker also notices
+// connections closing after they were hijacked from the HTTP server, which never report
+// http.StateClosed.
+func (t *sessionTracker) Listener(ln net.Listener) net.Listener {
+	return trackedListener{Listener: ln, t: t}
+}
+
+// ConnState is installed as http.Server.ConnState. By the time a connection turns active the
+// TLS handshake has completed, so the client certificate is known. Connections are tracked by
+// the raw connection under TLS, which is what trackedConn reports closing.
+func (t *sessionTracker) ConnState(conn net.Conn, state http.ConnState) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	raw := tlsConn.NetConn()
+
+	switch state {
+	case http.StateActive:
+		peers := tlsConn.ConnectionState().PeerCertificates
+		if len(peers) == 0 {
+			return
+		}
+		t.track(raw, crypto.Fingerprint(peers[0]))
+
+	// Hijacked connections stay tracked until trackedConn sees them close, since long-lived
+	// streams are exactly what must be cut off
+	case http.StateClosed:
+		t.untrack(raw)
+	}
+}
+
+func (t *sessionTracker) track(conn net.Conn, fp string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.owner[conn]; ok {
+		return
+	}
+	if t.conns[fp] == nil {
+		t.conns[fp] = make(map[net.Conn]struct{})
+	}
+	t.conns[fp][conn] = struct{}{}
+	t.owner[conn] = fp
+}
+
+func (t *sessionTracker) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fp, ok := t.owner[conn]
+	if !ok {
+		return
+	}
+	delete(t.owner, conn)
+	delete(t.conns[fp], conn)
+	if len(t.conns[fp]) == 0 {
+		delete(t.conns, fp)
+	}
+}
+
+// Close terminates every open connection of the given client and returns how many there were.
+func (t *sessionTracker) Close(fingerprint string) int {
+	t.mu.Lock()
+	conns := t.conns[fingerprint]
+	delete(t.conns, fingerprint)
+	for conn := range conns {
+		delete(t.owner, conn)
+	}
+	t.mu.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+type trackedListener struct {
+	net.Listener
+	t *sessionTracker
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: conn, t: l.t}, nil
+}
+
+// trackedConn untracks itself when closed, by whichever side closes it.
+type trackedConn struct {
+	net.Conn
+	t *sessionTracker
+}
+
+func (c *trackedConn) Close() error {
+	c.t.untrack(c)
+	return c.Conn.Close()
+}
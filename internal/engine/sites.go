@@ -0,0 +1,560 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"onyx/internal/api"
+)
+
+// SitesPath keeps the sites managed through the control plane.
+const SitesPath = StateDir + "/sites.json"
+
+// Errors returned by the site store.
+var (
+	ErrUnknownSite = errors.New("no such site")
+	ErrSiteExists  = errors.New("site already exists")
+	ErrInvalidSite = errors.New("invalid site")
+	ErrSitesStale  = errors.New("the live sites changed since the plan was made")
+)
+
+// SiteStore holds the reverse-proxy sites added through the control plane. Every change is
+// applied to the running proxy before it is saved, so the store never lists a site the
+// proxy refused.
+type SiteStore struct {
+	path string
+
+	mu    sync.Mutex
+	sites map[string]api.Site // Keyed by host
+}
+
+// OpenSiteStore loads the managed sites at path.
+func OpenSiteStore(path string) (*SiteStore, error) {
+	s := &SiteStore{path: path, sites: make(map[string]api.Site)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read sites: %w", err)
+	}
+	if len(data) > 0 {
+		var list []api.Site
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to read sites: %w", err)
+		}
+		for _, site := range list {
+			s.sites[site.Host] = site
+		}
+	}
+	return s, nil
+}
+
+// List returns every managed site, ordered by host.
+func (s *SiteStore) List() []api.Site {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+// Get returns the site for host.
+func (s *SiteStore) Get(host string) (*api.Site, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	site, ok := s.sites[api.NormalizeHost(host)]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSite, host)
+	}
+	return &site, nil
+}
+
+// Put creates site, or replaces the existing one with the same host when replace is set.
+// The full list of sites is handed to apply before anything is saved.
+func (s *SiteStore) Put(site api.Site, replace bool, apply func([]api.Site) error) (*api.Site, error) {
+	if err := validateSite(&site); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.sites[site.Host]
+	switch {
+	case replace && !exists:
+		return nil, fmt.Errorf("%w %q", ErrUnknownSite, site.Host)
+	case !replace && exists:
+		return nil, fmt.Errorf("%w: %s", ErrSiteExists, site.Host)
+	}
+
+	site.UpdatedAt = time.Now().UTC()
+	s.sites[site.Host] = site
+	if err := s.commit(apply); err != nil {
+		if exists {
+			s.sites[site.Host] = old
+		} else {
+			delete(s.sites, site.Host)
+		}
+		return nil, err
+	}
+	return &site, nil
+}
+
+// Delete removes the site for host, applying the remaining sites before saving.
+func (s *SiteStore) Delete(host string, apply func([]api.Site) error) (*api.Site, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	host = api.NormalizeHost(host)
+	site, ok := s.sites[host]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSite, host)
+	}
+
+	delete(s.sites, host)
+	if err := s.commit(apply); err != nil {
+		s.sites[host] = site
+		return nil, err
+	}
+	return &site, nil
+}
+
+// Replace swaps the whole set of sites for sites, as when rolling back the config.
+func (s *SiteStore) Replace(sites []api.Site, apply func([]api.Site) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.sites
+	s.sites = make(map[string]api.Site, len(sites))
+	for _, site := range sites {
+		s.sites[site.Host] = site
+	}
+	if err := s.commit(apply); err != nil {
+		s.sites = old
+		return err
+	}
+	return nil
+}
+
+// Sync converges the store on exactly sites, as described by a desired-state file. If ifMatch
+// is set, the current sites must still have that ETag. Sites whose settings are unchanged keep
+// their bookkeeping; the others are stamped as updated by by.
+func (s *SiteStore) Sync(sites []api.Site, ifMatch, by string, apply func([]api.Site) error) ([]api.Site, error) {
+	desired := make(map[string]api.Site, len(sites))
+	for _, site := range sites {
+		if err := validateSite(&site); err != nil {
+			return nil, err
+		}
+		if _, dup := desired[site.Host]; dup {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidSite, site.Host)
+		}
+		desired[site.Host] = site
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ifMatch != "" && ifMatch != sitesETag(s.list()) {
+		return nil, ErrSitesStale
+	}
+
+	now := time.Now().UTC()
+	for host, site := range desired {
+		if old, ok := s.sites[host]; ok && sameSite(old, site) {
+			desired[host] = old
+			continue
+		}
+		site.UpdatedAt, site.UpdatedBy = now, by
+		desired[host] = site
+	}
+
+	old := s.sites
+	s.sites = desired
+	if err := s.commit(apply); err != nil {
+		s.sites = old
+		return nil, err
+	}
+	return s.list(), nil
+}
+
+// sitesETag is a quoted hash of what the proxy serves for sites, in the form of an HTTP ETag.
+func sitesETag(sites []api.Site) string {
+	data, _ := siteContent(sites)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func sameSite(a, b api.Site) bool {
+	x, _ := siteContent([]api.Site{a})
+	y, _ := siteContent([]api.Site{b})
+	return bytes.Equal(x, y)
+}
+
+// commit applies the sites in memory and then saves them. If saving fails, the proxy is put
+// back to the sites on disk. Callers must hold s.mu and restore the map on error.
+func (s *SiteStore) commit(apply func([]api.Site) error) error {
+	list := s.list()
+	if err := apply(list); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data, 0640)
+	}
+	if err != nil {
+		if onDisk, loadErr := OpenSiteStore(s.path); loadErr == nil {
+			if rbErr := apply(onDisk.List()); rbErr != nil {
+				log.Printf("Failed to restore the saved sites: %v", rbErr)
+			}
+		}
+		return fmt.Errorf("failed to save sites: %w", err)
+	}
+	return nil
+}
+
+// list returns the sites ordered by host. Callers must hold s.mu.
+func (s *SiteStore) list() []api.Site {
+	list := make([]api.Site, 0, len(s.sites))
+	for _, site := range s.sites {
+		list = append(list, site)
+	}
+	slices.SortFunc(list, func(a, b api.Site) int { return strings.Compare(a.Host, b.Host) })
+	return list
+}
+
+// validateSite normalises site in place, the way api.NormalizeSite does for requests, and
+// checks that Caddy can serve it.
+func validateSite(site *api.Site) error {
+	site.Host = api.NormalizeHost(site.Host)
+	if err := validateHost(site.Host); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSite, err)
+	}
+
+	if len(site.Upstreams) == 0 {
+		return fmt.Errorf("%w: at least one upstream is required", ErrInvalidSite)
+	}
+	for i, u := range site.Upstreams {
+		u = strings.TrimSpace(u)
+		host, port, err := net.SplitHostPort(u)
+		if err != nil || host == "" {
+			return fmt.Errorf("%w: upstream %q must be host:port", ErrInvalidSite, u)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%w: upstream %q has an invalid port", ErrInvalidSite, u)
+		}
+		site.Upstreams[i] = u
+	}
+	if hasDuplicates(site.Upstreams) {
+		return fmt.Errorf("%w: upstreams must not repeat", ErrInvalidSite)
+	}
+
+	site.WAF = api.NormalizeWAF(site.WAF)
+	switch site.WAF {
+	case api.WAFOff, api.WAFDetect, api.WAFBlock:
+	default:
+		return fmt.Errorf("%w: WAF mode %q must be %q, %q or off", ErrInvalidSite, site.WAF, api.WAFDetect, api.WAFBlock)
+	}
+
+	// Single addresses are stored as ranges, so the same rule always looks the same
+	for i, a := range site.Allow {
+		prefix, ok := api.NormalizeRange(a)
+		if !ok {
+			return fmt.Errorf("%w: allowed range %q must be an IP address or CIDR", ErrInvalidSite, prefix)
+		}
+		site.Allow[i] = prefix
+	}
+	if hasDuplicates(site.Allow) {
+		return fmt.Errorf("%w: allowed ranges must not repeat", ErrInvalidSite)
+	}
+
+	if err := validateLoadBalancing(&site.LoadBalancing); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSite, err)
+	}
+	if err := validateHealthChecks(&site.HealthChecks); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSite, err)
+	}
+	return nil
+}
+
+// lbPolicies are the load-balancing policies a site can use.
+var lbPolicies = []string{api.LBRandom, api.LBRoundRobin, api.LBLeastConn, api.LBIPHash, api.LBCookie, api.LBFirst}
+
+func validateLoadBalancing(lb *api.LoadBalancing) error {
+	lb.Normalize()
+	if !slices.Contains(lbPolicies, lb.Policy) {
+		return fmt.Errorf("load-balancing policy %q must be one of random, %s", lb.Policy, strings.Join(lbPolicies[1:], ", "))
+	}
+	if lb.Retries < 0 || lb.Retries > 10 {
+		return fmt.Errorf("retries must be between 0 and 10")
+	}
+	return validateDuration("try duration", lb.TryDuration)
+}
+
+func validateHealthChecks(hc *api.HealthChecks) error {
+	hc.Normalize()
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("health check path %q must start with /", hc.Path)
+	}
+	if hc.Path == "" && (hc.Interval != "" || hc.Timeout != "" || hc.ExpectStatus != 0) {
+		return fmt.Errorf("active health checks need a path")
+	}
+	if hc.MaxFails < 0 {
+		return fmt.Errorf("max fails must not be negative")
+	}
+	if hc.MaxFails == 0 && (hc.FailDuration != "" || len(hc.UnhealthyStatus) > 0) {
+		return fmt.Errorf("passive health checks need max fails")
+	}
+
+	for _, d := range []struct {
+		name, value string
+	}{{"health check interval", hc.Interval}, {"health check timeout", hc.Timeout}, {"fail duration", hc.FailDuration}} {
+		if err := validateDuration(d.name, d.value); err != nil {
+			return err
+		}
+	}
+	for _, code := range append([]int{hc.ExpectStatus}, hc.UnhealthyStatus...) {
+		if code != 0 && (code < 100 || code > 599) {
+			return fmt.Errorf("%d is not an HTTP status code", code)
+		}
+	}
+	return nil
+}
+
+// validateDuration checks an optional positive Go duration.
+func validateDuration(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%s %q must be a positive duration such as 10s", name, value)
+	}
+	return nil
+}
+
+func hasDuplicates(list []string) bool {
+	seen := make(map[string]bool, len(list))
+	for _, v := range list {
+		if seen[v] {
+			return true
+		}
+		seen[v] = true
+	}
+	return false
+}
+
+// validateHost accepts a DNS name, optionally with a leading wildcard label.
+func validateHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || len(host) > 253 {
+		return fmt.Errorf("host %q is not a valid hostname", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("host %q is not a valid hostname", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("host %q is not a valid hostname", host)
+			}
+		}
+	}
+	return nil
+}
+
+// putSite creates or replaces a site on behalf of the caller of r, refusing hosts that the
+// Caddyfile already serves.
+func (e *Engine) putSite(r *http.Request, site api.Site, replace bool) (*api.Site, error) {
+	if err := e.checkCaddyfileHosts([]api.Site{site}); err != nil {
+		return nil, err
+	}
+	site.UpdatedBy = callerOf(r).auditEntry("", "").Actor
+	return e.sites.Put(site, replace, e.proxy.ApplySites)
+}
+
+// checkCaddyfileHosts refuses sites whose host is configured in the Caddyfile.
+func (e *Engine) checkCaddyfileHosts(sites []api.Site) error {
+	configured := e.proxy.CaddyfileHosts()
+	for _, site := range sites {
+		if host := api.NormalizeHost(site.Host); slices.Contains(configured, host) {
+			return fmt.Errorf("%w: %s is configured in %s", ErrSiteExists, host, e.opts.Caddyfile)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) handleListSites(w http.ResponseWriter, r *http.Request) {
+	sites := e.sites.List()
+	w.Header().Set("ETag", sitesETag(sites))
+	writeJSON(w, http.StatusOK, sites)
+}
+
+func (e *Engine) handleGetSite(w http.ResponseWriter, r *http.Request) {
+	site, err := e.sites.Get(r.PathValue("host"))
+	writeSiteResult(w, http.StatusOK, site, err)
+}
+
+func (e *Engine) handleCreateSite(w http.ResponseWriter, r *http.Request) {
+	var req api.SiteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	site, err := e.putSite(r, siteFromRequest(req.Host, req), false)
+	e.audit(r, "site.create", api.NormalizeHost(req.Host), err)
+	if err == nil {
+		log.Printf("Site %s added by %s, proxying to %s", site.Host, callerOf(r), strings.Join(site.Upstreams, ", "))
+		e.recordConfig(callerOf(r).auditEntry("", ""), "site.create "+site.Host)
+	}
+	writeSiteResult(w, http.StatusCreated, site, err)
+}
+
+func (e *Engine) handleUpdateSite(w http.ResponseWriter, r *http.Request) {
+	var req api.SiteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	host := r.PathValue("host")
+	site, err := e.putSite(r, siteFromRequest(host, req), true)
+	e.audit(r, "site.update", api.NormalizeHost(host), err)
+	if err == nil {
+		log.Printf("Site %s updated by %s, proxying to %s", site.Host, callerOf(r), strings.Join(site.Upstreams, ", "))
+		e.recordConfig(callerOf(r).auditEntry("", ""), "site.update "+site.Host)
+	}
+	writeSiteResult(w, http.StatusOK, site, err)
+}
+
+func (e *Engine) handleDeleteSite(w http.ResponseWriter, r *http.Request) {
+	e.runGuarded(w, r, "site.delete", api.NormalizeHost(r.PathValue("host")), nil)
+}
+
+func deleteSiteOp(e *Engine, by identity, host string, _ json.RawMessage) (any, string, func(), error) {
+	site, err := e.sites.Delete(host, e.proxy.ApplySites)
+	if err != nil {
+		return nil, host, nil, err
+	}
+	log.Printf("Site %s removed on behalf of %s", site.Host, by)
+	e.recordConfig(by.auditEntry("", ""), "site.delete "+site.Host)
+	return site, site.Host, nil, nil
+}
+
+// syncSitesParams carries a desired set of sites through the approval queue.
+type syncSitesParams struct {
+	Sites   []api.Site `json:"sites"`
+	IfMatch string     `json:"if_match,omitempty"`
+}
+
+// handleSyncSites replaces every managed site with the ones in the request, honouring
+// If-Match against the ETag of the live sites. Removing sites is destructive, so a set that
+// drops any goes through the approval policy.
+func (e *Engine) handleSyncSites(w http.ResponseWriter, r *http.Request) {
+	var req []api.SiteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+
+	// 1. Check the sites now, rather than when a second owner approves them
+	params := syncSitesParams{Sites: make([]api.Site, 0, len(req)), IfMatch: r.Header.Get("If-Match")}
+	desired := make(map[string]bool, len(req))
+	for _, sr := range req {
+		site := siteFromRequest(sr.Host, sr)
+		if err := validateSite(&site); err != nil {
+			writeSiteResult(w, 0, nil, err)
+			return
+		}
+		params.Sites = append(params.Sites, site)
+		desired[site.Host] = true
+	}
+	if err := e.checkCaddyfileHosts(params.Sites); err != nil {
+		writeSiteResult(w, 0, nil, err)
+		return
+	}
+
+	// 2. Only a set that removes sites needs a second owner
+	var removed []string
+	for _, site := range e.sites.List() {
+		if !desired[site.Host] {
+			removed = append(removed, site.Host)
+		}
+	}
+	if len(removed) > 0 {
+		e.runGuarded(w, r, "sites.sync", strings.Join(removed, ","), params)
+		return
+	}
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result, auditTarget, _, err := syncSitesOp(e, callerOf(r), "", raw)
+	e.audit(r, "sites.sync", auditTarget, err)
+	if err != nil {
+		writeOpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// syncSitesOp applies a desired set of sites; removed lists the hosts it drops, if any.
+func syncSitesOp(e *Engine, by identity, removed string, params json.RawMessage) (any, string, func(), error) {
+	var p syncSitesParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, removed, nil, fmt.Errorf("malformed site parameters: %w", err)
+	}
+	if err := e.checkCaddyfileHosts(p.Sites); err != nil {
+		return nil, removed, nil, err
+	}
+
+	sites, err := e.sites.Sync(p.Sites, p.IfMatch, by.auditEntry("", "").Actor, e.proxy.ApplySites)
+	if err != nil {
+		return nil, removed, nil, err
+	}
+	log.Printf("Managed sites synced on behalf of %s: %d site(s) live", by, len(sites))
+	e.recordConfig(by.auditEntry("", ""), "sites.sync")
+	return sites, removed, nil, nil
+}
+
+func siteFromRequest(host string, req api.SiteRequest) api.Site {
+	return api.Site{
+		Host:          host,
+		Upstreams:     req.Upstreams,
+		WAF:           req.WAF,
+		Allow:         req.Allow,
+		LoadBalancing: req.LoadBalancing,
+		HealthChecks:  req.HealthChecks,
+	}
+}
+
+// writeSiteResult maps site store errors onto HTTP status codes.
+func writeSiteResult(w http.ResponseWriter, status int, site *api.Site, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownSite):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrSiteExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidSite):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		writeJSON(w, status, site)
+	}
+}
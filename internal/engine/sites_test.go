@@ -0,0 +1,518 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"onyx/internal/api"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// assertJSON fails unless got marshals to the same JSON value as want.
+func assertJSON(t *testing.T, got any, want string) {
+	t.Helper()
+	data, ok := got.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var g, w any
+	if err := json.Unmarshal(data, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("bad golden JSON: %v", err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		pretty, _ := json.MarshalIndent(g, "", "  ")
+		t.Errorf("got\n%s\nwant\n%s", pretty, want)
+	}
+}
+
+// wafJSON is the handler wafHandler configures for engine, the SecRuleEngine setting of a mode.
+func wafJSON(engine string) string {
+	return `{
+		"handler": "waf",
+		"load_owasp_crs": true,
+		"directives": "Include @coraza.conf-recommended\nInclude @crs-setup.conf.example\nInclude @owasp_crs/*.conf\nSecRuleEngine ` + engine + `"
+	}`
+}
+
+// proxyRoute is the route of app.example.com with only the given reverse_proxy handler.
+func proxyRoute(handler string) string {
+	return `{
+		"@id": "onyx_site_app.example.com",
+		"match": [{"host": ["app.example.com"]}],
+		"handle": [` + handler + `],
+		"terminal": true
+	}`
+}
+
+// checkProxyHandlers fails unless every reverse_proxy handler in route decodes strictly into
+// Caddy's, so a misspelled setting cannot slip through as an unknown field.
+func checkProxyHandlers(t *testing.T, route any) {
+	t.Helper()
+	data, err := json.Marshal(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if v["handler"] == "reverse_proxy" {
+				found++
+				delete(v, "handler")
+				raw, _ := json.Marshal(v)
+				var h reverseproxy.Handler
+				if err := caddy.StrictUnmarshalJSON(raw, &h); err != nil {
+					t.Errorf("Caddy does not accept the reverse_proxy handler %s: %v", raw, err)
+				}
+				return
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(tree)
+	if found != 1 {
+		t.Errorf("route has %d reverse_proxy handlers, want 1", found)
+	}
+}
+
+func TestSiteRoute(t *testing.T) {
+	tests := []struct {
+		name string
+		site api.Site
+		want string
+	}{
+		{
+			name: "single upstream",
+			site: api.Site{Host: "App.Example.com.", Upstreams: []string{" 10.0.80.80:8080 "}},
+			want: `{
+				"@id": "onyx_site_app.example.com",
+				"match": [{"host": ["app.example.com"]}],
+				"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "wildcard host and several upstreams",
+			site: api.Site{Host: "*.example.com", Upstreams: []string{"10.0.80.80:8080", "backend.internal:9000"}},
+			want: `{
+				"@id": "onyx_site_*.example.com",
+				"match": [{"host": ["*.example.com"]}],
+				"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}, {"dial": "backend.internal:9000"}]}],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "WAF blocking",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, WAF: "Block"},
+			want: `{
+				"@id": "onyx_site_app.example.com",
+				"match": [{"host": ["app.example.com"]}],
+				"handle": [
+					` + wafJSON("On") + `,
+					{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}
+				],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "WAF detecting",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, WAF: api.WAFDetect},
+			want: `{
+				"@id": "onyx_site_app.example.com",
+				"match": [{"host": ["app.example.com"]}],
+				"handle": [
+					` + wafJSON("DetectionOnly") + `,
+					{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}
+				],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "WAF off",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, WAF: "off"},
+			want: `{
+				"@id": "onyx_site_app.example.com",
+				"match": [{"host": ["app.example.com"]}],
+				"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "allow rules",
+			site: api.Site{Host: "admin.example.com", Upstreams: []string{"10.0.80.80:8080"}, Allow: []string{"10.0.0.1", "192.168.1.7/16", "2001:db8::1"}},
+			want: `{
+				"@id": "onyx_site_admin.example.com",
+				"match": [{"host": ["admin.example.com"]}],
+				"handle": [{
+					"handler": "subroute",
+					"routes": [
+						{
+							"match": [{"not": [{"remote_ip": {"ranges": ["10.0.0.1/32", "192.168.0.0/16", "2001:db8::1/128"]}}]}],
+							"handle": [{"handler": "static_response", "status_code": 403}],
+							"terminal": true
+						},
+						{"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}]}
+					]
+				}],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "allow rules ahead of the WAF",
+			site: api.Site{Host: "admin.example.com", Upstreams: []string{"10.0.80.80:8080"}, WAF: api.WAFBlock, Allow: []string{"10.0.0.0/8"}},
+			want: `{
+				"@id": "onyx_site_admin.example.com",
+				"match": [{"host": ["admin.example.com"]}],
+				"handle": [{
+					"handler": "subroute",
+					"routes": [
+						{
+							"match": [{"not": [{"remote_ip": {"ranges": ["10.0.0.0/8"]}}]}],
+							"handle": [{"handler": "static_response", "status_code": 403}],
+							"terminal": true
+						},
+						{"handle": [
+							` + wafJSON("On") + `,
+							{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}
+						]}
+					]
+				}],
+				"terminal": true
+			}`,
+		},
+		{
+			name: "random selection",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, LoadBalancing: api.LoadBalancing{Policy: "Random"}},
+			want: proxyRoute(`{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}`),
+		},
+		{
+			name: "round robin with retries",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080", "10.0.80.81:8080"}, LoadBalancing: api.LoadBalancing{Policy: " Round_Robin ", Retries: 2, TryDuration: "5000ms"}},
+			want: proxyRoute(`{
+				"handler": "reverse_proxy",
+				"upstreams": [{"dial": "10.0.80.80:8080"}, {"dial": "10.0.80.81:8080"}],
+				"load_balancing": {"selection_policy": {"policy": "round_robin"}, "retries": 2, "try_duration": "5s"}
+			}`),
+		},
+		{
+			name: "least connections",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, LoadBalancing: api.LoadBalancing{Policy: api.LBLeastConn}},
+			want: proxyRoute(`{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}], "load_balancing": {"selection_policy": {"policy": "least_conn"}}}`),
+		},
+		{
+			name: "IP hash",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, LoadBalancing: api.LoadBalancing{Policy: api.LBIPHash}},
+			want: proxyRoute(`{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}], "load_balancing": {"selection_policy": {"policy": "ip_hash"}}}`),
+		},
+		{
+			name: "cookie affinity",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, LoadBalancing: api.LoadBalancing{Policy: api.LBCookie}},
+			want: proxyRoute(`{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}], "load_balancing": {"selection_policy": {"policy": "cookie"}}}`),
+		},
+		{
+			name: "failover",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, LoadBalancing: api.LoadBalancing{Policy: api.LBFirst}},
+			want: proxyRoute(`{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}], "load_balancing": {"selection_policy": {"policy": "first"}}}`),
+		},
+		{
+			name: "active health checks",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, HealthChecks: api.HealthChecks{Path: " /healthz", Interval: "10s", Timeout: "2s", ExpectStatus: 204}},
+			want: proxyRoute(`{
+				"handler": "reverse_proxy",
+				"upstreams": [{"dial": "10.0.80.80:8080"}],
+				"health_checks": {"active": {"uri": "/healthz", "interval": "10s", "timeout": "2s", "expect_status": 204}}
+			}`),
+		},
+		{
+			name: "passive health checks with the default fail duration",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, HealthChecks: api.HealthChecks{MaxFails: 3}},
+			want: proxyRoute(`{
+				"handler": "reverse_proxy",
+				"upstreams": [{"dial": "10.0.80.80:8080"}],
+				"health_checks": {"passive": {"max_fails": 3, "fail_duration": "30s"}}
+			}`),
+		},
+		{
+			name: "active and passive health checks",
+			site: api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, HealthChecks: api.HealthChecks{
+				Path: "/healthz", MaxFails: 5, FailDuration: "60s", UnhealthyStatus: []int{502, 503},
+			}},
+			want: proxyRoute(`{
+				"handler": "reverse_proxy",
+				"upstreams": [{"dial": "10.0.80.80:8080"}],
+				"health_checks": {
+					"active": {"uri": "/healthz"},
+					"passive": {"max_fails": 5, "fail_duration": "1m0s", "unhealthy_status": [502, 503]}
+				}
+			}`),
+		},
+		{
+			name: "load balancing and health checks behind allow rules",
+			site: api.Site{
+				Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}, Allow: []string{"10.0.0.0/8"},
+				LoadBalancing: api.LoadBalancing{Policy: api.LBLeastConn}, HealthChecks: api.HealthChecks{MaxFails: 1},
+			},
+			want: proxyRoute(`{
+				"handler": "subroute",
+				"routes": [
+					{
+						"match": [{"not": [{"remote_ip": {"ranges": ["10.0.0.0/8"]}}]}],
+						"handle": [{"handler": "static_response", "status_code": 403}],
+						"terminal": true
+					},
+					{"handle": [{
+						"handler": "reverse_proxy",
+						"upstreams": [{"dial": "10.0.80.80:8080"}],
+						"load_balancing": {"selection_policy": {"policy": "least_conn"}},
+						"health_checks": {"passive": {"max_fails": 1, "fail_duration": "30s"}}
+					}]}
+				]
+			}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Routes are built from sites as the store keeps them
+			site := tt.site
+			if err := validateSite(&site); err != nil {
+				t.Fatal(err)
+			}
+			route := siteRoute(site)
+			assertJSON(t, route, tt.want)
+			checkProxyHandlers(t, route)
+		})
+	}
+}
+
+func TestValidateSiteRejects(t *testing.T) {
+	valid := func(edit func(*api.Site)) api.Site {
+		site := api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}}
+		edit(&site)
+		return site
+	}
+
+	tests := []struct {
+		name    string
+		site    api.Site
+		message string // Part of the error message
+	}{
+		{"empty host", valid(func(s *api.Site) { s.Host = " " }), "not a valid hostname"},
+		{"host with a path", valid(func(s *api.Site) { s.Host = "app.example.com/admin" }), "not a valid hostname"},
+		{"inner wildcard", valid(func(s *api.Site) { s.Host = "app.*.example.com" }), "not a valid hostname"},
+		{"no upstreams", valid(func(s *api.Site) { s.Upstreams = nil }), "at least one upstream"},
+		{"upstream without a port", valid(func(s *api.Site) { s.Upstreams = []string{"10.0.80.80"} }), "must be host:port"},
+		{"upstream with a bad port", valid(func(s *api.Site) { s.Upstreams = []string{"10.0.80.80:70000"} }), "invalid port"},
+		{"repeated upstream", valid(func(s *api.Site) { s.Upstreams = []string{"10.0.80.80:8080", " 10.0.80.80:8080"} }), "must not repeat"},
+		{"unknown WAF mode", valid(func(s *api.Site) { s.WAF = "paranoid" }), "WAF mode"},
+		{"bad allowed range", valid(func(s *api.Site) { s.Allow = []string{"10.0.0.0/33"} }), "must be an IP address or CIDR"},
+		{"repeated allowed range", valid(func(s *api.Site) { s.Allow = []string{"10.0.0.1", "10.0.0.1/32"} }), "must not repeat"},
+		{"unknown policy", valid(func(s *api.Site) { s.LoadBalancing.Policy = "weighted" }), "load-balancing policy"},
+		{"negative retries", valid(func(s *api.Site) { s.LoadBalancing.Retries = -1 }), "retries must be between 0 and 10"},
+		{"too many retries", valid(func(s *api.Site) { s.LoadBalancing.Retries = 11 }), "retries must be between 0 and 10"},
+		{"bad try duration", valid(func(s *api.Site) { s.LoadBalancing.TryDuration = "soon" }), "try duration"},
+		{"negative try duration", valid(func(s *api.Site) { s.LoadBalancing.TryDuration = "-5s" }), "try duration"},
+		{"relative health check path", valid(func(s *api.Site) { s.HealthChecks.Path = "healthz" }), "must start with /"},
+		{"interval without a path", valid(func(s *api.Site) { s.HealthChecks.Interval = "10s" }), "need a path"},
+		{"expected status without a path", valid(func(s *api.Site) { s.HealthChecks.ExpectStatus = 200 }), "need a path"},
+		{"zero interval", valid(func(s *api.Site) { s.HealthChecks.Path, s.HealthChecks.Interval = "/healthz", "0s" }), "health check interval"},
+		{"bad timeout", valid(func(s *api.Site) { s.HealthChecks.Path, s.HealthChecks.Timeout = "/healthz", "5" }), "health check timeout"},
+		{"bad expected status", valid(func(s *api.Site) { s.HealthChecks.Path, s.HealthChecks.ExpectStatus = "/healthz", 99 }), "not an HTTP status code"},
+		{"negative max fails", valid(func(s *api.Site) { s.HealthChecks.MaxFails = -1 }), "must not be negative"},
+		{"fail duration without max fails", valid(func(s *api.Site) { s.HealthChecks.FailDuration = "30s" }), "need max fails"},
+		{"unhealthy status without max fails", valid(func(s *api.Site) { s.HealthChecks.UnhealthyStatus = []int{502} }), "need max fails"},
+		{"bad fail duration", valid(func(s *api.Site) { s.HealthChecks.MaxFails, s.HealthChecks.FailDuration = 3, "forever" }), "fail duration"},
+		{"bad unhealthy status", valid(func(s *api.Site) { s.HealthChecks.MaxFails, s.HealthChecks.UnhealthyStatus = 3, []int{600} }), "not an HTTP status code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSite(&tt.site)
+			if !errors.Is(err, ErrInvalidSite) || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("got %v, want an invalid site error containing %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestMergeSites(t *testing.T) {
+	site := api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}}
+	route := `{
+		"@id": "onyx_site_app.example.com",
+		"match": [{"host": ["app.example.com"]}],
+		"handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.80.80:8080"}]}],
+		"terminal": true
+	}`
+	catchAll := `{"handle": [{"handler": "file_server"}]}`
+
+	tests := []struct {
+		name  string
+		base  string
+		sites []api.Site
+		want  string
+	}{
+		{
+			name: "no sites",
+			base: `{"apps": {"http": {"servers": {"srv0": {"listen": [":443"], "routes": [` + catchAll + `]}}}}}`,
+			want: `{"apps": {"http": {"servers": {"srv0": {"listen": [":443"], "routes": [` + catchAll + `]}}}}}`,
+		},
+		{
+			name:  "ahead of the Caddyfile routes on :443",
+			base:  `{"apps": {"http": {"servers": {"srv0": {"listen": [":443"], "routes": [` + catchAll + `]}, "srv1": {"listen": [":8080"]}}}}}`,
+			sites: []api.Site{site},
+			want:  `{"apps": {"http": {"servers": {"srv0": {"listen": [":443"], "routes": [` + route + `, ` + catchAll + `]}, "srv1": {"listen": [":8080"]}}}}}`,
+		},
+		{
+			name:  "in a server of their own",
+			base:  `{"admin": {"listen": "127.0.0.1:2019"}, "apps": {"http": {"servers": {"srv0": {"listen": [":8080"]}}}}}`,
+			sites: []api.Site{site},
+			want:  `{"admin": {"listen": "127.0.0.1:2019"}, "apps": {"http": {"servers": {"srv0": {"listen": [":8080"]}, "onyx_sites": {"listen": [":443"], "routes": [` + route + `]}}}}}`,
+		},
+		{
+			name:  "without any HTTP app",
+			base:  `{}`,
+			sites: []api.Site{site},
+			want:  `{"apps": {"http": {"servers": {"onyx_sites": {"listen": [":443"], "routes": [` + route + `]}}}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeSites([]byte(tt.base), tt.sites)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, got, tt.want)
+
+			// Managed routes are not mistaken for Caddyfile sites
+			if hosts := configuredHosts(got); len(hosts) != 0 {
+				t.Errorf("configuredHosts = %v, want none", hosts)
+			}
+		})
+	}
+}
+
+// newTestSiteStore opens an empty store whose apply function records the sites it is handed.
+func newTestSiteStore(t *testing.T) (*SiteStore, *[][]api.Site, func([]api.Site) error) {
+	t.Helper()
+	store, err := OpenSiteStore(filepath.Join(t.TempDir(), "sites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied [][]api.Site
+	return store, &applied, func(sites []api.Site) error {
+		applied = append(applied, sites)
+		return nil
+	}
+}
+
+func TestSyncRejectsStaleETag(t *testing.T) {
+	store, applied, apply := newTestSiteStore(t)
+	site := api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}}
+	if _, err := store.Put(site, false, apply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two admins plan against the same sites; the first to apply wins
+	planned := sitesETag(store.List())
+	first := []api.Site{{Host: "app.example.com", Upstreams: []string{"10.0.80.81:8080"}}}
+	second := []api.Site{{Host: "app.example.com", Upstreams: []string{"10.0.80.82:8080"}}}
+
+	if _, err := store.Sync(first, planned, "alice", apply); err != nil {
+		t.Fatalf("sync with a current ETag: %v", err)
+	}
+	calls := len(*applied)
+	if _, err := store.Sync(second, planned, "bob", apply); !errors.Is(err, ErrSitesStale) {
+		t.Fatalf("got %v, want %v", err, ErrSitesStale)
+	}
+	if len(*applied) != calls {
+		t.Error("a stale sync reached the proxy")
+	}
+	if got, _ := store.Get("app.example.com"); got.Upstreams[0] != "10.0.80.81:8080" || got.UpdatedBy != "alice" {
+		t.Errorf("a stale sync changed the site to %+v", got)
+	}
+
+	// The ETag only follows what the proxy serves, so a no-op sync keeps it
+	current := sitesETag(store.List())
+	if _, err := store.Sync(first, current, "carol", apply); err != nil {
+		t.Fatal(err)
+	}
+	if sitesETag(store.List()) != current {
+		t.Error("an unchanged sync changed the ETag")
+	}
+	if got, _ := store.Get("app.example.com"); got.UpdatedBy != "alice" {
+		t.Errorf("an unchanged sync restamped the site as updated by %s", got.UpdatedBy)
+	}
+}
+
+func TestHandleSyncSitesStaleIfMatch(t *testing.T) {
+	e := New(Options{})
+	store, applied, apply := newTestSiteStore(t)
+	e.sites = store
+	var err error
+	if e.auditLog, err = OpenAuditLog(filepath.Join(t.TempDir(), "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.80:8080"}}, false, apply); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ETag a client would get from listing the sites
+	rec := httptest.NewRecorder()
+	e.handleListSites(rec, httptest.NewRequest(http.MethodGet, "/v1/sites", nil))
+	etag := rec.Header().Get("ETag")
+	if etag != sitesETag(store.List()) {
+		t.Fatalf("listing sent ETag %q", etag)
+	}
+
+	// Someone else changes the site in between
+	if _, err := store.Put(api.Site{Host: "app.example.com", Upstreams: []string{"10.0.80.81:8080"}}, true, apply); err != nil {
+		t.Fatal(err)
+	}
+	calls := len(*applied)
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/sites", strings.NewReader(`[{"host": "app.example.com", "upstreams": ["10.0.80.82:8080"]}]`))
+	req.Header.Set("If-Match", etag)
+	rec = httptest.NewRecorder()
+	e.handleSyncSites(rec, req)
+
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("got %d %s, want 412", rec.Code, rec.Body)
+	}
+	if len(*applied) != calls {
+		t.Error("a stale write reached the proxy")
+	}
+	if got, _ := store.Get("app.example.com"); got.Upstreams[0] != "10.0.80.81:8080" {
+		t.Errorf("a stale write changed the site to %v", got.Upstreams)
+	}
+	report, err := e.auditLog.Query(api.AuditQuery{Action: "sites.sync"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 1 || report.Entries[0].Result != api.AuditFailed {
+		t.Errorf("stale write audited as %+v", report.Entries)
+	}
+}
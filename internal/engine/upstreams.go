@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"onyx/internal/api"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// UpstreamHealth reports every backend of the reverse proxies in the running config, whether
+// they come from the Caddyfile or a managed site. Caddy keeps active health check results on
+// the provisioned handlers only, so they are read from the running config rather than the
+// admin API.
+func (p *Proxy) UpstreamHealth() []api.UpstreamHealth {
+	app, err := caddy.ActiveContext().AppIfConfigured("http")
+	if err != nil {
+		return nil
+	}
+	httpApp, ok := app.(*caddyhttp.App)
+	if !ok {
+		return nil
+	}
+
+	var list []api.UpstreamHealth
+	for _, name := range slices.Sorted(maps.Keys(httpApp.Servers)) {
+		list = appendUpstreams(list, httpApp.Servers[name].Routes, nil)
+	}
+	return list
+}
+
+// appendUpstreams walks routes and their subroutes, attributing each reverse proxy to the hosts
+// of the nearest route that matches on host.
+func appendUpstreams(list []api.UpstreamHealth, routes caddyhttp.RouteList, hosts []string) []api.UpstreamHealth {
+	for _, route := range routes {
+		routeHosts := hosts
+		if matched := routeHostsOf(route); len(matched) > 0 {
+			routeHosts = matched
+		}
+
+		for _, h := range route.Handlers {
+			switch h := h.(type) {
+			case *caddyhttp.Subroute:
+				list = appendUpstreams(list, h.Routes, routeHosts)
+			case *reverseproxy.Handler:
+				for _, u := range h.Upstreams {
+					if u.Host == nil { // Not provisioned yet
+						continue
+					}
+					list = append(list, api.UpstreamHealth{
+						Site:     strings.Join(routeHosts, ", "),
+						Address:  u.Dial,
+						Healthy:  u.Healthy(),
+						Requests: u.NumRequests(),
+						Fails:    u.Fails(),
+					})
+				}
+			}
+		}
+	}
+	return list
+}
+
+// routeHostsOf returns the hosts a provisioned route matches on.
+func routeHostsOf(route caddyhttp.Route) []string {
+	var hosts []string
+	for _, set := range route.MatcherSets {
+		for _, m := range set {
+			switch m := m.(type) {
+			case *caddyhttp.MatchHost:
+				hosts = append(hosts, *m...)
+			case caddyhttp.MatchHost:
+				hosts = append(hosts, m...)
+			}
+		}
+	}
+	return hosts
+}
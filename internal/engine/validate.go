@@ -0,0 +1,309 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"onyx/internal/api"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// maxValidateBody bounds an uploaded Caddyfile.
+const maxValidateBody = 1 << 20
+
+// ValidateCommand is the hidden onyx subcommand that provisions an uploaded config on behalf
+// of Validate. Provisioning replaces Caddy's default logger and storage, opens log writers and
+// runs module hooks, so it happens in a child process and never inside the running engine.
+const ValidateCommand = "validate-config"
+
+// validateTimeout bounds the child process provisioning an upload.
+const validateTimeout = 30 * time.Second
+
+// validateRejected is the exit code of a validator that provisioned the config and failed.
+const validateRejected = 3
+
+// errorLocation finds the file and line Caddy's parser attaches to its errors, either as a
+// "file:line - " prefix or as ", at file:line" after the message.
+var errorLocation = regexp.MustCompile(`(?:^|, at )([^\s,]+):(\d+)`)
+
+// Validate adapts caddyfile the way a reload would and provisions the result with the engine's
+// own modules in a child process, without loading it. The managed sites are merged in, so the
+// config checked is the one that would run. Only the uploaded text is read: file imports,
+// environment variables and WAF rule files are refused.
+func (p *Proxy) Validate(filename string, caddyfile []byte) api.ValidateResult {
+	res := api.ValidateResult{Errors: []api.Diagnostic{}, Warnings: []api.Diagnostic{}}
+
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	if adapter == nil {
+		res.Errors = append(res.Errors, api.Diagnostic{Message: "caddyfile adapter is not registered"})
+		return res
+	}
+
+	// 1. Refuse anything that would read the engine's files or environment into the result
+	if refused := outsideReads(filename, caddyfile); len(refused) > 0 {
+		res.Errors = refused
+		return res
+	}
+
+	// 2. Adapt, collecting warnings with their positions
+	base, warnings, err := adapter.Adapt(caddyfile, map[string]any{"filename": filename})
+	for _, w := range warnings {
+		res.Warnings = append(res.Warnings, api.Diagnostic{File: w.File, Line: w.Line, Directive: w.Directive, Message: w.Message})
+	}
+	if err != nil {
+		res.Errors = append(res.Errors, locate(err))
+		return res
+	}
+
+	p.mu.Lock()
+	sites := p.sites
+	p.mu.Unlock()
+
+	cfgJSON, err := mergeSites(base, sites)
+	if err != nil {
+		res.Errors = append(res.Errors, api.Diagnostic{File: filename, Message: err.Error()})
+		return res
+	}
+	res.Config = cfgJSON
+
+	// 3. Provision every module as a load would, which catches errors the adapter cannot see
+	if err := provisionIsolated(cfgJSON); err != nil {
+		res.Errors = append(res.Errors, api.Diagnostic{File: filename, Message: err.Error()})
+		return res
+	}
+
+	res.Valid = true
+	return res
+}
+
+// provisionIsolated has a child copy of the running binary provision cfgJSON and returns the
+// error it reports.
+func provisionIsolated(cfgJSON []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the validator: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe, ValidateCommand)
+	cmd.Stdin = bytes.NewReader(cfgJSON)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exit) && exit.ExitCode() == validateRejected:
+		return errors.New(strings.TrimSpace(out.String()))
+	case ctx.Err() != nil:
+		return fmt.Errorf("validation did not finish within %s", validateTimeout)
+	default:
+		return fmt.Errorf("validator failed: %w: %s", err, lastLine(stderr.String()))
+	}
+}
+
+// RunValidator is the child side of Validate. It reads a config from r, provisions it with its
+// log writers and storage swapped for throwaway ones, writes the error to w if that fails and
+// returns the process exit code.
+func RunValidator(r io.Reader, w io.Writer) int {
+	var cfg caddy.Config
+	if err := json.NewDecoder(r).Decode(&cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read config: %v\n", err)
+		return 1
+	}
+
+	dir, err := os.MkdirTemp("", "onyx-validate-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create scratch storage: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	err = isolate(&cfg, dir)
+	if err == nil {
+		err = caddy.Validate(&cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return validateRejected
+	}
+	return 0
+}
+
+// isolate checks that the storage and log writers in cfg are well-formed, then replaces them
+// so that provisioning creates no files outside dir. Whether a log file or storage path is
+// writable is left for the reload to find out.
+func isolate(cfg *caddy.Config, dir string) error {
+	if cfg.StorageRaw != nil {
+		if err := decodeInline("caddy.storage", "module", cfg.StorageRaw); err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+	}
+	root, _ := json.Marshal(dir)
+	cfg.StorageRaw = json.RawMessage(`{"module":"file_system","root":` + string(root) + `}`)
+
+	if cfg.Logging == nil {
+		return nil
+	}
+	discard := json.RawMessage(`{"output":"discard"}`)
+	if cfg.Logging.Sink != nil && cfg.Logging.Sink.WriterRaw != nil {
+		if err := decodeInline("caddy.logging.writers", "output", cfg.Logging.Sink.WriterRaw); err != nil {
+			return fmt.Errorf("logging sink: %w", err)
+		}
+		cfg.Logging.Sink.WriterRaw = discard
+	}
+	for name, l := range cfg.Logging.Logs {
+		if l == nil || l.WriterRaw == nil {
+			continue
+		}
+		if err := decodeInline("caddy.logging.writers", "output", l.WriterRaw); err != nil {
+			return fmt.Errorf("log %s: %w", name, err)
+		}
+		l.WriterRaw = discard
+	}
+	return nil
+}
+
+// decodeInline decodes raw into the module named by its key field in namespace, without
+// provisioning it.
+func decodeInline(namespace, key string, raw json.RawMessage) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	var name string
+	if err := json.Unmarshal(fields[key], &name); err != nil || name == "" {
+		return fmt.Errorf("module name missing in %q", key)
+	}
+	delete(fields, key)
+
+	info, err := caddy.GetModule(namespace + "." + name)
+	if err != nil {
+		return err
+	}
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return caddy.StrictUnmarshalJSON(rest, info.New())
+}
+
+// lastLine returns the last non-empty line of s.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
+
+// wafFileRead matches Coraza directive lines that read rule or data files. Includes of the
+// embedded rule set start with '@' and are allowed.
+var wafFileRead = regexp.MustCompile(`(?im)^\s*include\s+[^@\s]|@\w*FromFile\b`)
+
+// outsideReads reports the parts of an uploaded Caddyfile that would pull the engine's files
+// or environment into the adapted config or its error messages: imports other than snippets
+// defined in the upload, {$VAR}, {env.*} and {file.*} placeholders, and WAF directives that
+// read files. Syntax errors are left for the adapter to report.
+func outsideReads(filename string, body []byte) []api.Diagnostic {
+	tokens, err := caddyfile.Tokenize(body, filename)
+	if err != nil {
+		return nil
+	}
+
+	newLine := func(i int) bool {
+		return i == 0 || tokens[i-1].Line+tokens[i-1].NumLineBreaks() < tokens[i].Line
+	}
+	snippets := make(map[string]bool)
+	for i, t := range tokens {
+		if newLine(i) && len(t.Text) > 2 && strings.HasPrefix(t.Text, "(") && strings.HasSuffix(t.Text, ")") {
+			snippets[t.Text[1:len(t.Text)-1]] = true
+		}
+	}
+
+	var refused []api.Diagnostic
+	for i, t := range tokens {
+		d := api.Diagnostic{File: filename, Line: t.Line}
+		switch {
+		case t.Text == "import" && newLine(i) && i+1 < len(tokens) && !snippets[tokens[i+1].Text]:
+			d.Directive = "import"
+			d.Message = "only snippets defined in the uploaded Caddyfile can be imported; inline the file to validate it"
+		case strings.Contains(t.Text, "{$"), strings.Contains(t.Text, "{env."):
+			d.Message = "environment variables are not expanded when validating an upload; use literal values"
+		case strings.Contains(t.Text, "{file."):
+			d.Message = "{file.*} placeholders are not allowed when validating an upload; use literal values"
+		case wafFileRead.MatchString(t.Text):
+			d.Message = "WAF directives that read files are not allowed when validating an upload; only the embedded rule set can be included"
+		default:
+			continue
+		}
+		refused = append(refused, d)
+	}
+	return refused
+}
+
+// errorDirective finds the directive named in errors raised while parsing its tokens.
+var errorDirective = regexp.MustCompile(`parsing caddyfile tokens for '([^']+)'`)
+
+// locate turns an adapter error into a diagnostic, moving the file and line it names out of
+// the message.
+func locate(err error) api.Diagnostic {
+	d := api.Diagnostic{Message: err.Error()}
+	if m := errorDirective.FindStringSubmatch(d.Message); m != nil {
+		d.Directive = m[1]
+	}
+
+	loc := errorLocation.FindStringSubmatchIndex(d.Message)
+	if loc == nil {
+		return d
+	}
+	d.File = d.Message[loc[2]:loc[3]]
+	d.Line, _ = strconv.Atoi(d.Message[loc[4]:loc[5]])
+	if loc[0] == 0 {
+		d.Message = strings.TrimLeft(d.Message[loc[1]:], ":- ")
+	} else {
+		d.Message = d.Message[:loc[0]]
+	}
+	return d
+}
+
+func (e *Engine) handleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	var req api.ValidateRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxValidateBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body or Caddyfile over 1 MiB")
+		return
+	}
+
+	filename := strings.TrimSpace(req.Filename)
+	if filename == "" {
+		filename = "Caddyfile"
+	}
+	if strings.TrimSpace(req.Caddyfile) == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s is empty", filename))
+		return
+	}
+
+	// The adapted config holds the managed sites and anything the modules resolved, so only
+	// owners see it
+	res := e.proxy.Validate(filename, []byte(req.Caddyfile))
+	if !callerOf(r).Role().Allows(api.RoleOwner) {
+		res.Config = nil
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,158 @@
+// Package pairing defines the wire protocol spoken between onyx-admin and an engine
+// when a new admin console is paired. Both binaries use these types, so a change to
+// the protocol is a change to this package.
+//
+// Protocol, version 2:
+//
+// The admin opens a TLS 1.3 session to the engine and sends the request below. The engine's
+// control plane serves /pair for every kind of token: invitations, and pairing windows opened
+// on the engine host. A standalone pairing listener serves it only for its own window.
+//
+//	POST /pair
+//	Content-Type: application/json
+//
+//	{"versions": [2], "token": "ABCD-EFGH", "csr": "-----BEGIN CERTIFICATE REQUEST-----...",
+//	 "commitment": "<hex SHA-256 of the admin's nonce>"}
+//
+// "versions" lists every protocol version the admin speaks. The engine picks the highest
+// version both sides support and answers with that version in every response.
+//
+// An invitation is redeemed at once: the engine answers 200 OK with
+//
+//	{"version": 2, "certificate": "<PEM>", "ca_certificate": "<PEM>"}
+//
+// where "certificate" is the issued client certificate and "ca_certificate" is the engine CA
+// the admin must pin.
+//
+// A pairing window token is consumed, and the engine answers 200 OK with its own nonce
+//
+//	{"version": 2, "nonce": "<hex>"}
+//
+// The admin then reveals the nonce it committed to, over the same TLS session:
+//
+//	{"versions": [2], "token": "ABCD-EFGH", "nonce": "<hex>"}
+//
+// Both ends derive the verification code from the session and the two nonces, and the engine
+// holds this second request until its operator has compared the code. It then answers with the
+// certificates as above. Because the admin's nonce is fixed before the engine's is known, and
+// the engine's before the admin's is revealed, neither end can steer the code.
+//
+// On failure the engine answers with a 4xx/5xx status and
+//
+//	{"version": 2, "error": {"code": "bad-token", "message": "..."}}
+//
+// Clients should switch on the error code, not the message or the HTTP status.
+// An "unsupported-version" error also lists the engine's "supported_versions".
+//
+// Version 1 sent no commitment and derived the code from the TLS session alone; it is no
+// longer spoken, since a man-in-the-middle could choose its key share until the codes matched.
+package pairing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Version is the newest protocol version this build speaks.
+const Version = 2
+
+// SupportedVersions lists every protocol version this build can speak, newest last.
+var SupportedVersions = []int{2}
+
+// Path is the HTTP endpoint that accepts pairing requests.
+const Path = "/pair"
+
+// ContentType is the media type of every request and response body.
+const ContentType = "application/json"
+
+// Request is sent by onyx-admin to ask for a client certificate.
+type Request struct {
+	Versions   []int  `json:"versions"`
+	Token      string `json:"token"`
+	CSR        string `json:"csr,omitempty"`
+	Commitment string `json:"commitment,omitempty"` // First round: commitment to the admin's nonce
+	Nonce      string `json:"nonce,omitempty"`      // Second round: the nonce committed to
+}
+
+// Response is returned by the engine for every pairing request, successful or not.
+type Response struct {
+	Version       int    `json:"version"`
+	Certificate   string `json:"certificate,omitempty"`
+	CACertificate string `json:"ca_certificate,omitempty"`
+	Nonce         string `json:"nonce,omitempty"` // The engine's nonce, answering a window's first round
+	Error         *Error `json:"error,omitempty"`
+}
+
+// ErrorCode is a machine-readable pairing failure reason.
+type ErrorCode string
+
+// Error codes defined by protocol version 2.
+const (
+	ErrExpired            ErrorCode = "expired"             // The pairing window or token has expired
+	ErrBadToken           ErrorCode = "bad-token"           // The token is wrong or has already been used
+	ErrLockedOut          ErrorCode = "locked-out"          // Too many failed attempts; pairing is closed
+	ErrUnsupportedVersion ErrorCode = "unsupported-version" // No protocol version in common
+	ErrBadRequest         ErrorCode = "bad-request"         // Malformed body or CSR
+	ErrRejected           ErrorCode = "rejected"            // The engine operator rejected the verification code
+	ErrInternal           ErrorCode = "internal"            // The engine failed to complete the request
+)
+
+// Error is a structured pairing failure.
+type Error struct {
+	Code              ErrorCode `json:"code"`
+	Message           string    `json:"message"`
+	SupportedVersions []int     `json:"supported_versions,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Status maps an error code to the HTTP status the engine responds with.
+func (e *Error) Status() int {
+	switch e.Code {
+	case ErrBadToken:
+		return http.StatusUnauthorized
+	case ErrExpired:
+		return http.StatusGone
+	case ErrLockedOut:
+		return http.StatusTooManyRequests
+	case ErrRejected:
+		return http.StatusForbidden
+	case ErrInternal:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Negotiate picks the highest version offered by the client that this build supports.
+func Negotiate(offered []int) (int, bool) {
+	best := 0
+	for _, v := range offered {
+		if v > best && slices.Contains(SupportedVersions, v) {
+			best = v
+		}
+	}
+	return best, best != 0
+}
+
+// WriteResponse encodes a successful pairing response.
+func WriteResponse(w http.ResponseWriter, res Response) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// WriteError encodes a pairing failure with the status matching its code.
+func WriteError(w http.ResponseWriter, version int, perr *Error) {
+	if perr.Code == ErrUnsupportedVersion {
+		perr.SupportedVersions = SupportedVersions
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(perr.Status())
+	json.NewEncoder(w).Encode(Response{Version: version, Error: perr})
+}
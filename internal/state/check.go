@@ -54,7 +54,7 @@ func CheckHeartbeat(client *http.Client, remoteIPs []string) SystemState {
 	if client != nil {
 		for _, ip := range remoteIPs {
 			// We probe the management port (2305) over mTLS
-			resp, err := client.Get("https://" + ip + ":2305/status")
+			resp, err := client.Get("https://" + ip + ":2305/v1/status")
 			if err != nil {
 				s.RemoteStatus[ip] = "Offline"
 				continue
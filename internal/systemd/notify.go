@@ -0,0 +1,90 @@
+// Package systemd implements the sd_notify protocol so the engine can report
+// readiness, reloads and watchdog pings to systemd without linking libsystemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Notify sends a newline-separated list of assignments (e.g. "READY=1") to the service manager.
+// It is a no-op when the process was not started by systemd with a notify socket.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are advertised with a leading '@'
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to reach notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	return nil
+}
+
+// Ready tells systemd that startup has finished, along with a human-readable status line.
+func Ready(status string) error {
+	return Notify("READY=1\nSTATUS=" + status)
+}
+
+// Reloading tells systemd that a configuration reload has started.
+// Ready must be sent again once the reload has completed, whatever its outcome.
+func Reloading() error {
+	return Notify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+}
+
+// Stopping tells systemd that the service is beginning its shutdown.
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Status updates the free-form status line shown by `systemctl status`.
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// Watchdog sends a keep-alive ping to the service manager's watchdog.
+func Watchdog() error {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout configured by WatchdogSec=, if it applies to this process.
+// Pings should be sent at roughly half this interval.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+
+	// WATCHDOG_PID is set when the watchdog is meant for a specific process
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// monotonicUsec reads CLOCK_MONOTONIC, which systemd requires alongside RELOADING=1.
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano() / int64(time.Microsecond)
+}
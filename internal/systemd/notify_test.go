@@ -0,0 +1,98 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen stands in for systemd: a unixgram socket in a temp dir, advertised via NOTIFY_SOCKET.
+func listen(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no datagram received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifyDatagrams(t *testing.T) {
+	conn := listen(t)
+
+	tests := []struct {
+		name string
+		send func() error
+		want string
+	}{
+		{"ready", func() error { return Ready("Serving 1 site") }, "READY=1\nSTATUS=Serving 1 site"},
+		{"stopping", Stopping, "STOPPING=1"},
+		{"watchdog", Watchdog, "WATCHDOG=1"},
+		{"status", func() error { return Status("Unhealthy") }, "STATUS=Unhealthy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.send(); err != nil {
+				t.Fatal(err)
+			}
+			if got := receive(t, conn); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadingSendsMonotonicTimestamp(t *testing.T) {
+	conn := listen(t)
+
+	if err := Reloading(); err != nil {
+		t.Fatal(err)
+	}
+	got := receive(t, conn)
+
+	lines := strings.Split(got, "\n")
+	if len(lines) != 2 || lines[0] != "RELOADING=1" || !strings.HasPrefix(lines[1], "MONOTONIC_USEC=") {
+		t.Fatalf("unexpected datagram %q", got)
+	}
+	usec, err := strconv.ParseInt(strings.TrimPrefix(lines[1], "MONOTONIC_USEC="), 10, 64)
+	if err != nil || usec <= 0 {
+		t.Errorf("MONOTONIC_USEC is not a positive integer: %q", lines[1])
+	}
+}
+
+func TestNotifyWithoutSocketIsNoop(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Ready("ignored"); err != nil {
+		t.Errorf("Ready without NOTIFY_SOCKET: %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d, ok := WatchdogInterval(); !ok || d != 30*time.Second {
+		t.Errorf("got %v, %v; want 30s, true", d, ok)
+	}
+
+	t.Setenv("WATCHDOG_PID", "1")
+	if _, ok := WatchdogInterval(); ok {
+		t.Error("watchdog meant for another process was accepted")
+	}
+}
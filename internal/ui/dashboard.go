@@ -2,8 +2,11 @@ package ui
 
 import (
 	"fmt"
+	"onyx/internal/api"
 	"onyx/internal/config"
+	"onyx/internal/crypto"
 	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -29,16 +32,47 @@ var (
 	offlineStyle = lipgloss.NewStyle().
 			Bold(true).
 			Foreground(lipgloss.Color("#FF0000"))
+
+	warnStyle = lipgloss.NewStyle().
+			Bold(true).
+			Foreground(lipgloss.Color("#FFB000"))
 )
 
+// refreshInterval controls how often the dashboard polls the engine.
+const refreshInterval = 5 * time.Second
+
 type dashboardModel struct {
 	version string
 	node    *config.Node
+	warn    time.Duration // Flag the client certificate this close to expiry
+	client  *api.Client
+	status  *api.Status
+	err     error
+}
+
+// statusMsg carries the result of a /status poll back into the update loop.
+type statusMsg struct {
+	status *api.Status
+	err    error
+}
+
+// tickMsg triggers the next poll.
+type tickMsg time.Time
+
+// fetchStatus queries the engine in the background.
+func (m dashboardModel) fetchStatus() tea.Cmd {
+	return func() tea.Msg {
+		if m.client == nil {
+			return statusMsg{err: m.err}
+		}
+		s, err := m.client.Status()
+		return statusMsg{status: s, err: err}
+	}
 }
 
 // Init is called when the Bubble Tea program starts.
 func (m dashboardModel) Init() tea.Cmd {
-	return nil
+	return m.fetchStatus()
 }
 
 // Update handles incoming messages (like keypresses).
@@ -49,6 +83,11 @@ func (m dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "q", "ctrl+c", "esc":
 			return m, tea.Quit
 		}
+	case statusMsg:
+		m.status, m.err = msg.status, msg.err
+		return m, tea.Tick(refreshInterval, func(t time.Time) tea.Msg { return tickMsg(t) })
+	case tickMsg:
+		return m, m.fetchStatus()
 	}
 	return m, nil
 }
@@ -63,22 +102,87 @@ func (m dashboardModel) View() string {
 
 	b.WriteString(fmt.Sprintf("  TARGET NODE: %s\n", m.node.Name))
 	b.WriteString(fmt.Sprintf("  ADDRESS:     %s:%d\n", m.node.Address, m.node.Port))
+	if expiry, err := m.node.CertExpiry(); err == nil {
+		line := expiry.Local().Format("2006-01-02")
+		if warning := certWarning(expiry, m.warn); warning != "" {
+			line = warnStyle.Render(line + " (" + warning + ", run 'onyx-admin renew')")
+		}
+		b.WriteString(fmt.Sprintf("  CERT EXPIRY: %s\n", line))
+	}
 	b.WriteString(subTitleStyle.Render("  ──────────────────────────────────────────"))
 	b.WriteString("\n")
 
-	// Placeholder for the actual API fetch we'll build next
-	b.WriteString(fmt.Sprintf("  STATUS:      %s\n", offlineStyle.Render("[Offline - Awaiting /status endpoint implementation]")))
+	switch {
+	case m.err != nil:
+		b.WriteString(fmt.Sprintf("  STATUS:      %s\n", offlineStyle.Render("[Offline]")))
+		b.WriteString(fmt.Sprintf("  ERROR:       %v\n", m.err))
+	case m.status == nil:
+		b.WriteString(fmt.Sprintf("  STATUS:      %s\n", subTitleStyle.Render("Connecting...")))
+	default:
+		b.WriteString(fmt.Sprintf("  STATUS:      %s\n", statusStyle.Render("[Online]")))
+		b.WriteString(fmt.Sprintf("  HOSTNAME:    %s\n", m.status.Hostname))
+		b.WriteString(fmt.Sprintf("  ENGINE:      %s (up %s)\n", m.status.Version, time.Since(m.status.StartedAt).Round(time.Second)))
+
+		proxy := statusStyle.Render("Healthy")
+		if !m.status.Proxy.Healthy {
+			proxy = offlineStyle.Render("Unhealthy: " + m.status.Proxy.Error)
+		}
+		b.WriteString(fmt.Sprintf("  PROXY:       %s\n", proxy))
+		b.WriteString(fmt.Sprintf("               %s\n", m.status.Proxy.Summary))
+
+		for i, u := range m.status.Proxy.Upstreams {
+			label := "  UPSTREAMS:  "
+			if i > 0 {
+				label = "              "
+			}
+			state := statusStyle.Render("● up  ")
+			if !u.Healthy {
+				state = offlineStyle.Render("● down")
+			}
+			site := u.Site
+			if site == "" {
+				site = "*"
+			}
+			b.WriteString(fmt.Sprintf("%s %s %-21s %s (%d in flight, %d recent fails)\n", label, state, u.Address, site, u.Requests, u.Fails))
+		}
+
+		if rot := m.status.Authority.Rotation; rot != nil {
+			line := fmt.Sprintf("Rotating, previous CA retires %s (%d console(s) not moved yet)",
+				rot.RetiresAt.Local().Format("2006-01-02"), rot.ClientsOnPrevious)
+			b.WriteString(fmt.Sprintf("  ENGINE CA:   %s\n", warnStyle.Render(line)))
+		}
+	}
 
 	b.WriteString("\n\n  (Press 'q' or 'esc' to return to menu)\n")
 
 	return b.String()
 }
 
+// certWarning describes a certificate that expires within window, or returns "" if it does not.
+func certWarning(expiry time.Time, window time.Duration) string {
+	left := time.Until(expiry)
+	switch {
+	case left <= 0:
+		return "certificate expired"
+	case left <= window:
+		return fmt.Sprintf("certificate expires in %d days", int(left.Hours()/24))
+	}
+	return ""
+}
+
 // StartDashboard launches the single-node status view.
-func StartDashboard(version string, node *config.Node) error {
+func StartDashboard(version string, node *config.Node, settings config.GlobalSettings) error {
 	m := dashboardModel{
 		version: version,
 		node:    node,
+		warn:    settings.WarnWindow(),
+	}
+
+	httpClient, err := crypto.NewMTLSClient(node.CertFile, node.KeyFile, node.CAFile)
+	if err != nil {
+		m.err = err
+	} else {
+		m.client = api.NewClient(httpClient, fmt.Sprintf("%s:%d", node.Address, node.Port))
 	}
 
 	p := tea.NewProgram(m, tea.WithAltScreen())
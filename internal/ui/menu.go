@@ -78,6 +78,11 @@ func StartMenu(version string, conf *config.AdminConfig) (string, *config.Node)
 	for i := range conf.Nodes {
 		n := &conf.Nodes[i] // Use pointer to reference actual config data
 		desc := fmt.Sprintf("%s:%d • Last seen: %s", n.Address, n.Port, n.LastSeen.Format("Jan 02 15:04"))
+		if expiry, err := n.CertExpiry(); err == nil {
+			if warning := certWarning(expiry, conf.Settings.WarnWindow()); warning != "" {
+				desc += " • ⚠ " + warning
+			}
+		}
 		items = append(items, item{
 			title:  n.Name,
 			desc:   desc,